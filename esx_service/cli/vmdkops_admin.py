@@ -660,6 +660,10 @@ def get_creation_info(metadata):
 def get_attached_to(metadata):
     """ Return which VM a volume is attached to based on its metadata. """
     try:
+        if metadata.get(kv.ATTACHED_VMS):
+            # read-only-many volume attached to several VMs
+            return ",".join(vmdk_ops.vm_uuid2name(vm[kv.ATTACHED_VM_UUID]) or vm[kv.ATTACHED_VM_NAME]
+                            for vm in metadata[kv.ATTACHED_VMS])
         if kv.ATTACHED_VM_UUID in metadata:
             vm_name = vmdk_ops.vm_uuid2name(metadata[kv.ATTACHED_VM_UUID])
             if vm_name:
@@ -34,6 +34,15 @@ CMD_REMOVE = 'remove'
 CMD_ATTACH = 'attach'
 CMD_DETACH = 'detach'
 CMD_GET    = 'get'
+CMD_SET    = 'set'
+CMD_SNAPSHOT = 'snapshot'
+CMD_REVERT = 'revert'
+CMD_SNAPSHOT_REMOVE = 'rmsnapshot'
+CMD_REPLICATE = 'replicate'
+CMD_PROMOTE = 'promote'
+CMD_INFLATE = 'inflate'
+CMD_EXTEND = 'extend'
+CMD_MOVE = 'move'
 
 SIZE = 'size'
 
@@ -331,7 +340,7 @@ def check_privileges_for_command(cmd, opts, tenant_uuid, datastore_url, privileg
         result = error_code_to_message[ErrorCode.PRIVILEGE_NO_PRIVILEGE]
         return result
 
-    cmd_need_mount_privilege = [CMD_ATTACH, CMD_DETACH]
+    cmd_need_mount_privilege = [CMD_ATTACH, CMD_DETACH, CMD_SET]
     if cmd in cmd_need_mount_privilege:
         if not has_privilege(privileges):
             result = error_code_to_message[ErrorCode.PRIVILEGE_NO_MOUNT_PRIVILEGE]
@@ -348,6 +357,22 @@ def check_privileges_for_command(cmd, opts, tenant_uuid, datastore_url, privileg
         if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
             result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
 
+    # snapshots, replicas and inflate use space, revert replaces the volume
+    # content, promote creates a volume and move removes it from the datastore.
+    # The target datastore of move is checked as for create.
+    if cmd in [CMD_SNAPSHOT, CMD_REVERT, CMD_SNAPSHOT_REMOVE, CMD_REPLICATE, CMD_PROMOTE,
+               CMD_INFLATE, CMD_MOVE]:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+
+    # the growth of extend is checked against the quota in check_extend_quota(),
+    # opts only has the new size
+    if cmd == CMD_EXTEND:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+        if not check_max_volume_size(opts, privileges):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_MAX_VOL_EXCEED]
+
     return result
 
 def err_msg_no_table(table_name):
@@ -494,6 +519,53 @@ def add_volume_to_volumes_table(tenant_uuid, datastore_url, vol_name, vol_size_i
 
     return None
 
+def check_extend_quota(tenant_uuid, datastore_url, extend_by_MB):
+    """
+        Check if a volume can grow by extend_by_MB without violating the quota.
+        Return None on success or error string.
+    """
+    err_msg, _auth_mgr = get_auth_mgr()
+    if err_msg:
+        return err_msg
+    if _auth_mgr.allow_all_access():
+        return None
+
+    err_msg, privileges = get_privileges(tenant_uuid, datastore_url)
+    if err_msg:
+        return err_msg
+    if not check_usage_quota({SIZE: "{0}MB".format(extend_by_MB)}, tenant_uuid, datastore_url, privileges):
+        return error_code_to_message[ErrorCode.PRIVILEGE_USAGE_QUOTA_EXCEED]
+    return None
+
+def update_volume_size_in_volumes_table(tenant_uuid, datastore_url, vol_name, vol_size_in_MB):
+    """
+        Update the size of a volume in volumes table.
+        Return None on success or error string.
+    """
+    err_msg, _auth_mgr = get_auth_mgr()
+    if err_msg:
+        return err_msg
+
+    logging.debug("update size in volumes table(%s %s %s %s)", tenant_uuid, datastore_url,
+                  vol_name, vol_size_in_MB)
+
+    if _auth_mgr.allow_all_access():
+        logging.debug("Skipping update volume in DB %s (allow_all_access)", tenant_uuid)
+        return None
+
+    try:
+        _auth_mgr.conn.execute(
+            "UPDATE volumes SET volume_size = ? WHERE tenant_id = ? AND datastore_url = ? AND volume_name = ?",
+            (vol_size_in_MB, tenant_uuid, datastore_url, vol_name)
+            )
+        _auth_mgr.conn.commit()
+    except sqlite3.Error as e:
+        logging.error("Error %s when update volumes table for tenant_id %s and datastore_url %s",
+                      e, tenant_uuid, datastore_url)
+        return str(e)
+
+    return None
+
 def remove_volume_from_volumes_table(tenant_uuid, datastore_url, vol_name):
     """
         Remove volume from volumes table.
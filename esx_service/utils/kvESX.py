@@ -318,6 +318,16 @@ def get_info(volpath):
     """
     Return disk stats for the volume
     """
+    sizes = get_size_bytes(volpath)
+    if not sizes:
+        return None
+    return {VOL_SIZE: convert(sizes[VOL_SIZE]), VOL_ALLOC: convert(sizes[VOL_ALLOC])}
+
+@diskLibLock
+def get_size_bytes(volpath):
+    """
+    Return the disk size and allocated space in bytes for the volume
+    """
     dhandle = vol_open_path(volpath, VMDK_OPEN_DISKCHAIN_NOIO)
 
     if not disk_is_valid(dhandle):
@@ -332,7 +342,7 @@ def get_info(volpath):
         logging.warning("Failed to get size of disk %s - %x", volpath, res)
         return None
 
-    return {VOL_SIZE: convert(sinfo.size), VOL_ALLOC: convert(sinfo.allocated)}
+    return {VOL_SIZE: sinfo.size, VOL_ALLOC: sinfo.allocated}
 
 
 def get_uint(val):
@@ -100,6 +100,19 @@ def init_datastoreCache(force=False):
         datastores = tmp_ds
 
 
+def get_datastore_free_space(datastore):
+    """ Returns the free space in bytes on the datastore, or None if not found """
+    si = vmdk_ops.get_si()
+    # look in all datacenters, and in datastore folders, not only the first one
+    for dc in si.content.rootFolder.childEntity:
+        if not isinstance(dc, vim.Datacenter):
+            continue
+        for ds in dc.datastore:
+            if ds.info.name == datastore:
+                ds.RefreshDatastore()
+                return ds.summary.freeSpace
+    return None
+
 def validate_datastore(datastore):
     """
     Checks if the datastore is part of datastoreCache.
@@ -161,6 +174,9 @@ def get_volumes(tenant_re):
                 #  tenant_name which will be used to match
                 #  pattern specified by tenant_re
                 logging.debug("get_volumes: path=%s root=%s", path, root)
+                # skip the snapshot and replica folders (.snapshots, .replicas),
+                # their disks are not volumes
+                dirs[:] = [d for d in dirs if not d.startswith(".")]
                 sub_dir = root.replace(path, "")
                 sub_dir_name = sub_dir[1:]
                 # sub_dir_name is the tenant uuid
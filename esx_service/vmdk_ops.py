@@ -32,12 +32,15 @@ Commands ("cmd" in request):
 '''
 
 import atexit
+import calendar
 import getopt
+import glob
 import json
 import logging
 import os
 import os.path
 import re
+import shutil
 import signal
 import subprocess
 import sys
@@ -115,10 +118,12 @@ ECONNABORTED = 103 # Error on non privileged client
 # Volume data returned on Get request
 CAPACITY = 'capacity'
 SIZE = 'size'
+SIZE_BYTES = 'size-bytes'
 ALLOCATED = 'allocated'
 LOCATION = 'datastore'
 CREATED_BY_VM = 'created by VM'
 ATTACHED_TO_VM = 'attached to VM'
+ATTACHED_TO_VMS = 'attached to VMs'
 
 # Virtual machine power states
 VM_POWERED_OFF = "poweredOff"
@@ -126,6 +131,16 @@ VM_POWERED_OFF = "poweredOff"
 # Maximum number of PVSCSI targets
 PVSCSI_MAX_TARGETS = 16
 
+# Maximum number of vNVMe namespaces per controller
+NVME_MAX_NAMESPACES = 15
+
+# Controllers per VM, of one type
+MAX_CONTROLLERS = 4
+
+# Seconds between progress checks of long running tasks (inflate)
+TASK_PROGRESS_INTERVAL = 2
+MB = 1024 * 1024
+
 # Service instance provide from connection to local hostd
 _service_instance = None
 
@@ -135,6 +150,12 @@ lib = None
 # For managing resource locks.
 lockManager = threadutils.LockManager()
 
+# Progress in percent of running inflates, by full volume name
+inflate_progress = {}
+
+# Progress in percent of running moves, by full volume name before the move
+move_progress = {}
+
 # Run executable on ESX as needed.
 # Returns int with return value,  and a string with either stdout (on success) or  stderr (on error)
 def RunCommand(cmd):
@@ -344,11 +365,18 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None):
     vol_meta[kv.CREATED_BY] = vm_name
     vol_meta[kv.CREATED] = time.asctime(time.gmtime())
     vol_meta[kv.VOL_OPTS][kv.CLONE_FROM] = src_volume
+    # the provenance of the clone, not of the source volume
+    for key in kv.PROVENANCE_OPTS:
+        vol_meta[kv.VOL_OPTS].pop(key, None)
+        if key in opts:
+            vol_meta[kv.VOL_OPTS][key] = opts[key]
     vol_meta[kv.VOL_OPTS][kv.DISK_ALLOCATION_FORMAT] = opts[kv.DISK_ALLOCATION_FORMAT]
     if kv.ACCESS in opts:
         vol_meta[kv.VOL_OPTS][kv.ACCESS] = opts[kv.ACCESS]
     if kv.ATTACH_AS in opts:
         vol_meta[kv.VOL_OPTS][kv.ATTACH_AS] = opts[kv.ATTACH_AS]
+    if kv.CONTROLLER_TYPE in opts:
+        vol_meta[kv.VOL_OPTS][kv.CONTROLLER_TYPE] = opts[kv.CONTROLLER_TYPE]
 
     if not kv.setAll(vmdk_path, vol_meta):
         msg = "Failed to create metadata kv store for {0}".format(vmdk_path)
@@ -358,6 +386,10 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None):
 
 def create_kv_store(vm_name, vmdk_path, opts):
     """ Create the metadata kv store for a volume """
+    if opts.get(kv.FORMAT) == kv.FORMAT_LAZY or opts.get(kv.ACCESS) == kv.ACCESS_READONLY_MANY:
+        # The plugin creates the filesystem on first mount, or right after
+        # create, and read-only-many volumes are attached persistent until then
+        opts[kv.FORMATTED] = 'false'
     vol_meta = {kv.STATUS: kv.DETACHED,
                 kv.VOL_OPTS: opts,
                 kv.CREATED: time.asctime(time.gmtime()),
@@ -371,13 +403,33 @@ def validate_opts(opts, vmdk_path):
      * size - The size of the disk to create
      * vsan-policy-name - The name of an existing policy to use
      * diskformat - The allocation format of allocated disk
+     * format - When the plugin creates the filesystem
+     * expires-at - When the plugin removes the volume
+     * snapshot-schedule - When the plugin takes snapshots of the volume
+     * replicate-to - Datastore the plugin keeps a copy of the volume on
+     * autogrow - When the plugin extends the volume
+     * exclusive - Whether one container at a time may mount the volume
+     * created-host, created-by-plugin, created-from - Creation provenance
+     * fsck-policy - How the plugin checks the filesystem before the mount
+     * mkfs-opts - Options for mkfs
+     * trim - Whether the plugin trims the mounted volume
+     * fs-label - The filesystem label the plugin created
+     * controller-type - The controller the disk is attached to
     """
     valid_opts = [kv.SIZE, kv.VSAN_POLICY_NAME, kv.DISK_ALLOCATION_FORMAT,
-                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM]
+                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM,
+                  kv.FORMAT, kv.EXPIRES_AT, kv.CREATED_HOST, kv.SNAPSHOT_SCHEDULE,
+                  kv.REPLICATE_TO, kv.AUTOGROW, kv.EXCLUSIVE, kv.CREATED_BY_PLUGIN,
+                  kv.CREATED_FROM, kv.FSCK_POLICY, kv.MKFS_OPTS, kv.TRIM, kv.FS_LABEL,
+                  kv.CONTROLLER_TYPE]
     defaults = [kv.DEFAULT_DISK_SIZE, kv.DEFAULT_VSAN_POLICY,\
                 kv.DEFAULT_ALLOCATION_FORMAT, kv.DEFAULT_ATTACH_AS,\
-                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM]
-    invalid = frozenset(opts.keys()).difference(valid_opts)
+                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM,\
+                kv.DEFAULT_FORMAT, None, None, None, None, None, kv.DEFAULT_EXCLUSIVE,\
+                None, None, None, None, kv.DEFAULT_TRIM, None,\
+                kv.DEFAULT_CONTROLLER_TYPE]
+    labels = [key for key in opts.keys() if key.startswith(kv.LABEL_PREFIX)]
+    invalid = frozenset(opts.keys()).difference(valid_opts).difference(labels)
     if len(invalid) != 0:
         msg = 'Invalid options: {0} \n'.format(list(invalid)) \
                + 'Valid options and defaults: ' \
@@ -395,10 +447,32 @@ def validate_opts(opts, vmdk_path):
         validate_disk_allocation_format(opts[kv.DISK_ALLOCATION_FORMAT])
     if kv.ATTACH_AS in opts:
         validate_attach_as(opts[kv.ATTACH_AS])
+    if kv.CONTROLLER_TYPE in opts:
+        validate_controller_type(opts[kv.CONTROLLER_TYPE])
     if kv.ACCESS in opts:
         validate_access(opts[kv.ACCESS])
     if kv.FILESYSTEM_TYPE in opts:
         validate_fstype(opts[kv.FILESYSTEM_TYPE], clone)
+    if kv.MKFS_OPTS in opts:
+        validate_mkfs_opts(clone)
+    if kv.FORMAT in opts:
+        validate_format(opts[kv.FORMAT], clone)
+    if kv.EXPIRES_AT in opts:
+        validate_expires_at(opts[kv.EXPIRES_AT], opts.get(kv.CREATED_HOST))
+    if kv.SNAPSHOT_SCHEDULE in opts:
+        validate_snapshot_schedule(opts[kv.SNAPSHOT_SCHEDULE])
+    if kv.REPLICATE_TO in opts:
+        validate_replicate_to(opts[kv.REPLICATE_TO], vmdk_path)
+    if kv.AUTOGROW in opts:
+        validate_autogrow(opts[kv.AUTOGROW])
+    if kv.EXCLUSIVE in opts:
+        validate_exclusive(opts[kv.EXCLUSIVE])
+    if kv.FSCK_POLICY in opts:
+        validate_fsck_policy(opts[kv.FSCK_POLICY])
+    if kv.TRIM in opts:
+        validate_trim(opts[kv.TRIM])
+    for label in labels:
+        validate_label(label, opts[label])
 
 
 def validate_size(size, clone=False):
@@ -475,6 +549,15 @@ def validate_attach_as(attach_type):
         raise ValidationError("Attach type '{0}' is not supported."
                               " Valid options are: {1}".format(attach_type, kv.ATTACH_AS_TYPES))
 
+def validate_controller_type(controller_type):
+    """
+    Ensure that we recognize the controller type
+    """
+    if not controller_type in kv.CONTROLLER_TYPES:
+        raise ValidationError("Controller type '{0}' is not supported."
+                              " Valid options are: {1}".format(controller_type,
+                                                               kv.CONTROLLER_TYPES))
+
 def validate_access(access_type):
     """
     Ensure that we recognize the access type
@@ -484,6 +567,32 @@ def validate_access(access_type):
                              " Valid options are: {1}".format(access_type,
                                                               kv.ACCESS_TYPES))
 
+def validate_exclusive(exclusive):
+    """
+    Ensure that exclusive is true or false
+    """
+    if not exclusive in kv.EXCLUSIVE_TYPES:
+        raise ValidationError("Invalid value '{0}' for option {1}."
+                              " Valid options are: {2}".format(exclusive, kv.EXCLUSIVE,
+                                                               kv.EXCLUSIVE_TYPES))
+
+def validate_fsck_policy(policy):
+    """
+    Ensure that the fsck policy is one of kv.FSCK_POLICY_TYPES
+    """
+    if not policy in kv.FSCK_POLICY_TYPES:
+        raise ValidationError("Invalid value '{0}' for option {1}."
+                              " Valid options are: {2}".format(policy, kv.FSCK_POLICY,
+                                                               kv.FSCK_POLICY_TYPES))
+
+def validate_trim(trim):
+    """
+    Ensure that trim is true or false
+    """
+    if not trim in kv.TRIM_TYPES:
+        raise ValidationError("Invalid value '{0}' for option {1}."
+                              " Valid options are: {2}".format(trim, kv.TRIM, kv.TRIM_TYPES))
+
 def validate_fstype(fstype, clone=False):
     """
     Ensure that we don't accept fstype for a clone
@@ -491,6 +600,79 @@ def validate_fstype(fstype, clone=False):
     if clone:
         raise ValidationError("Cannot define the filesystem type for a clone")
 
+def validate_mkfs_opts(clone=False):
+    """
+    Ensure that we don't accept mkfs options for a clone
+    """
+    if clone:
+        raise ValidationError("Cannot define mkfs options for a clone")
+
+def validate_format(format_type, clone=False):
+    """
+    Ensure that we recognize the format type, and don't accept it for a clone
+    """
+    if clone:
+        raise ValidationError("Cannot define the format type for a clone")
+    if not format_type in kv.FORMAT_TYPES:
+        raise ValidationError("Format type '{0}' is not supported."
+                              " Valid options are: {1}".format(format_type, kv.FORMAT_TYPES))
+
+def validate_expires_at(expires_at, created_host):
+    """
+    Ensure that the expiry time is in EXPIRES_AT_FORMAT, and that we know
+    the host which will remove the volume
+    """
+    try:
+        time.strptime(expires_at, kv.EXPIRES_AT_FORMAT)
+    except ValueError:
+        raise ValidationError("Invalid expiry time '{0}', expected UTC time "
+                              "as YYYY-MM-DDTHH:MM:SSZ".format(expires_at))
+    if not created_host:
+        raise ValidationError("Option {0} requires {1}".format(kv.EXPIRES_AT, kv.CREATED_HOST))
+
+def validate_snapshot_schedule(schedule):
+    """ Ensure that the snapshot schedule is <interval>[;keep=<count>] """
+    if not re.match(kv.SNAPSHOT_SCHEDULE_PATTERN, schedule):
+        raise ValidationError("Invalid snapshot schedule '{0}', expected hourly, daily, "
+                              "weekly, <n>m or <n>h, optionally followed by ;keep=<count>".format(schedule))
+
+def validate_replicate_to(datastore, vmdk_path):
+    """ Ensure that the replica datastore exists and is not the volume datastore """
+    if not vmdk_utils.validate_datastore(datastore):
+        raise ValidationError("Invalid datastore '{0}' for {1}. Known datastores: {2}".format(
+                              datastore, kv.REPLICATE_TO, ", ".join(get_datastore_names_list())))
+    if datastore == vmdk_utils.get_datastore_from_vmdk_path(vmdk_path):
+        raise ValidationError("Option {0} must name another datastore than the "
+                              "volume's".format(kv.REPLICATE_TO))
+
+def validate_autogrow(autogrow):
+    """ Ensure autogrow is "<n>%;step=<size>;max=<size>" """
+    match = re.match(kv.AUTOGROW_PATTERN, autogrow.lower())
+    if not match:
+        raise ValidationError("Invalid value '{0}' for option {1}, expected "
+                              "<n>%;step=<size>;max=<size>, e.g. 85%;step=10gb;max=200gb".format(
+                              autogrow, kv.AUTOGROW))
+    if convert.convert_to_MB(match.group(2)) > convert.convert_to_MB(match.group(3)):
+        raise ValidationError("The step of option {0} is bigger than its max".format(kv.AUTOGROW))
+
+def validate_label(label, value, allow_empty=False):
+    """
+    Ensure that a "label.<key>=<value>" option has a sane key and value
+    """
+    key = label[len(kv.LABEL_PREFIX):]
+    if not re.match(r'^[A-Za-z0-9][A-Za-z0-9_.\-]*$', key) or len(key) > kv.MAX_LABEL_LEN:
+        raise ValidationError("Invalid label key '{0}'. Keys must start with a letter or digit, "
+                              "contain only letters, digits, '_', '.' and '-', and be at most "
+                              "{1} characters long".format(key, kv.MAX_LABEL_LEN))
+    if (not value and not allow_empty) or len(value) > kv.MAX_LABEL_LEN:
+        raise ValidationError("Invalid value for label '{0}'. Values must be 1 to {1} "
+                              "characters long".format(key, kv.MAX_LABEL_LEN))
+
+def get_labels(vol_opts):
+    """ Return {key: value} of user labels kept in volume options """
+    return dict((key[len(kv.LABEL_PREFIX):], value) for key, value in vol_opts.items()
+                if key.startswith(kv.LABEL_PREFIX))
+
 # Returns the UUID if the vmdk_path is for a VSAN backed.
 def get_vsan_uuid(vmdk_path):
     f = open(vmdk_path)
@@ -527,6 +709,10 @@ def vol_info(vol_meta, vol_size_info, datastore):
             vinfo[ATTACHED_TO_VM] = vol_meta[kv.ATTACHED_VM_UUID]
     if kv.ATTACHED_VM_DEV in vol_meta:
         vinfo[kv.ATTACHED_VM_DEV] = vol_meta[kv.ATTACHED_VM_DEV]
+    if vol_meta.get(kv.ATTACHED_VMS):
+        # read-only-many volume, list every VM it is attached to
+        vinfo[ATTACHED_TO_VMS] = [vm_uuid2name(vm[kv.ATTACHED_VM_UUID]) or vm[kv.ATTACHED_VM_NAME]
+                                  for vm in vol_meta[kv.ATTACHED_VMS]]
 
     if kv.VOL_OPTS in vol_meta:
        if kv.FILESYSTEM_TYPE in vol_meta[kv.VOL_OPTS]:
@@ -541,18 +727,92 @@ def vol_info(vol_meta, vol_size_info, datastore):
           vinfo[kv.ATTACH_AS] = vol_meta[kv.VOL_OPTS][kv.ATTACH_AS]
        else:
           vinfo[kv.ATTACH_AS] = kv.DEFAULT_ATTACH_AS
+       if kv.CONTROLLER_TYPE in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.CONTROLLER_TYPE] = vol_meta[kv.VOL_OPTS][kv.CONTROLLER_TYPE]
+       else:
+          vinfo[kv.CONTROLLER_TYPE] = kv.DEFAULT_CONTROLLER_TYPE
        if kv.ACCESS in vol_meta[kv.VOL_OPTS]:
           vinfo[kv.ACCESS] = vol_meta[kv.VOL_OPTS][kv.ACCESS]
        else:
           vinfo[kv.ACCESS] = kv.DEFAULT_ACCESS
+       if kv.EXCLUSIVE in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.EXCLUSIVE] = vol_meta[kv.VOL_OPTS][kv.EXCLUSIVE]
        if kv.CLONE_FROM in vol_meta[kv.VOL_OPTS]:
           vinfo[kv.CLONE_FROM] = vol_meta[kv.VOL_OPTS][kv.CLONE_FROM]
        else:
           vinfo[kv.CLONE_FROM] = kv.DEFAULT_CLONE_FROM
+       for key in [kv.MKFS_OPTS, kv.FS_LABEL]:
+          if key in vol_meta[kv.VOL_OPTS]:
+             vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+       if kv.FORMAT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.FORMAT] = vol_meta[kv.VOL_OPTS][kv.FORMAT]
+       if kv.FORMATTED in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.FORMATTED] = vol_meta[kv.VOL_OPTS][kv.FORMATTED]
+       if kv.EXPIRES_AT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.EXPIRES_AT] = vol_meta[kv.VOL_OPTS][kv.EXPIRES_AT]
+       for key in kv.PROVENANCE_OPTS:
+          if key in vol_meta[kv.VOL_OPTS]:
+             vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+       if kv.SNAPSHOT_SCHEDULE in vol_meta[kv.VOL_OPTS]:
+          for key in [kv.SNAPSHOT_SCHEDULE, kv.SNAPSHOT_LAST_RUN, kv.SNAPSHOT_NEXT_RUN,
+                      kv.SNAPSHOT_LAST_ERROR]:
+             if key in vol_meta[kv.VOL_OPTS]:
+                vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+          vinfo[kv.SNAPSHOT_SCHEDULE_STATE] = snapshot_schedule_state(vol_meta[kv.VOL_OPTS],
+                                                                      vol_meta[kv.STATUS] == kv.ATTACHED)
+       if kv.REPLICATE_TO in vol_meta[kv.VOL_OPTS]:
+          for key in [kv.REPLICATE_TO, kv.REPLICA_LAST_SYNC, kv.REPLICA_LAST_ERROR]:
+             if key in vol_meta[kv.VOL_OPTS]:
+                vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+          lag = replica_lag_minutes(vol_meta[kv.VOL_OPTS])
+          if lag is not None:
+             vinfo[kv.REPLICA_LAG_MINUTES] = lag
+       if kv.AUTOGROW in vol_meta[kv.VOL_OPTS]:
+          for key in [kv.AUTOGROW, kv.AUTOGROW_LAST_GROW, kv.AUTOGROW_GROWS, kv.AUTOGROW_LAST_ERROR]:
+             if key in vol_meta[kv.VOL_OPTS]:
+                vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+       for key in [kv.FSCK_POLICY, kv.FSCK_LAST_RESULT, kv.FSCK_LAST_RUN,
+                   kv.TRIM, kv.TRIM_LAST_RUN, kv.TRIM_LAST_BYTES]:
+          if key in vol_meta[kv.VOL_OPTS]:
+             vinfo[key] = vol_meta[kv.VOL_OPTS][key]
+       if kv.PROMOTED_FROM in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.PROMOTED_FROM] = vol_meta[kv.VOL_OPTS][kv.PROMOTED_FROM]
+       if kv.MOVED_FROM in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.MOVED_FROM] = vol_meta[kv.VOL_OPTS][kv.MOVED_FROM]
+       labels = get_labels(vol_meta[kv.VOL_OPTS])
+       if labels:
+          vinfo[kv.LABELS] = labels
 
     return vinfo
 
 
+def snapshot_schedule_state(vol_opts, attached):
+    """
+    Returns the state of the snapshot schedule of a volume:
+    "error" if the last scheduled snapshot failed, "idle" if the volume is not
+    attached so no plugin runs the schedule, "pending" before the first run,
+    "overdue" if the next run is late, and "ok" otherwise.
+    """
+    if vol_opts.get(kv.SNAPSHOT_LAST_ERROR):
+        return "error"
+    if not attached:
+        return "idle"
+    try:
+        next_run = calendar.timegm(time.strptime(vol_opts[kv.SNAPSHOT_NEXT_RUN], kv.EXPIRES_AT_FORMAT))
+    except (KeyError, ValueError):
+        return "pending"
+    if time.time() > next_run + kv.SNAPSHOT_OVERDUE_SECS:
+        return "overdue"
+    return "ok"
+
+def replica_lag_minutes(vol_opts):
+    """ Returns the minutes since the replica was last refreshed, or None """
+    try:
+        synced = calendar.timegm(time.strptime(vol_opts[kv.REPLICA_LAST_SYNC], kv.EXPIRES_AT_FORMAT))
+    except (KeyError, ValueError):
+        return None
+    return max(0, int(time.time() - synced) // 60)
+
 def cleanVMDK(vmdk_path, vol_name=None):
     """
     Delete the vmdk file. Retry if the attempt fails
@@ -640,12 +900,65 @@ def getVMDK(vmdk_path, vol_name, datastore):
         result = vol_info(kv.getAll(vmdk_path),
                           kv.get_vol_info(vmdk_path),
                           datastore)
+        # the exact size, "size" is rounded for display
+        sizes = kv.get_vol_size_bytes(vmdk_path)
+        if sizes:
+            result[CAPACITY][SIZE_BYTES] = sizes[SIZE]
     except Exception as ex:
         logging.error("Failed to get disk details for %s (%s)" % (vmdk_path, ex))
         return None
 
     return result
 
+def setVMDK(vmdk_path, vol_name, opts):
+    """
+    Update volume options the plugin is allowed to change after create
+    (see kv.PLUGIN_SETTABLE_OPTS). Returns error, or None for OK
+    """
+    logging.debug("setVMDK: vmdk_path=%s opts=%s", vmdk_path, opts)
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
+
+    for key, value in opts.items():
+        if key.startswith(kv.LABEL_PREFIX):
+            try:
+                validate_label(key, value, allow_empty=True)
+            except ValidationError as e:
+                return err(e.msg)
+            continue
+        if not key in kv.PLUGIN_SETTABLE_OPTS:
+            return err("Option {0} can't be changed. Options that can be changed: {1}".format(
+                       key, list(kv.PLUGIN_SETTABLE_OPTS)))
+        if kv.PLUGIN_SETTABLE_OPTS[key] is None:
+            try:
+                if key == kv.SNAPSHOT_SCHEDULE and value:
+                    validate_snapshot_schedule(value)
+                if key == kv.REPLICATE_TO and value:
+                    validate_replicate_to(value, vmdk_path)
+                if key == kv.AUTOGROW and value:
+                    validate_autogrow(value)
+            except ValidationError as e:
+                return err(e.msg)
+            continue
+        if not value in kv.PLUGIN_SETTABLE_OPTS[key]:
+            return err("Invalid value {0} for option {1}. Supported values are {2}".format(
+                       value, key, kv.PLUGIN_SETTABLE_OPTS[key]))
+
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0}".format(vol_name))
+    if not vol_meta.get(kv.VOL_OPTS):
+        vol_meta[kv.VOL_OPTS] = {}
+    for key, value in opts.items():
+        # an empty value removes the option
+        if not value:
+            vol_meta[kv.VOL_OPTS].pop(key, None)
+        else:
+            vol_meta[kv.VOL_OPTS][key] = value
+    if not kv.setAll(vmdk_path, vol_meta):
+        return err("Failed to save volume metadata for {0}".format(vol_name))
+    return None
+
 def listVMDK(tenant):
     """
     Returns a list of volume names (note: may be an empty list).
@@ -654,11 +967,718 @@ def listVMDK(tenant):
     """
     vmdk_utils.init_datastoreCache(force=True)
     vmdks = vmdk_utils.get_volumes(tenant)
-    # build  fully qualified vol name for each volume found
-    return [{u'Name': get_full_vol_name(x['filename'], x['datastore']),
-             u'Attributes': {}} \
+    # build  fully qualified vol name for each volume found,
+    # with user labels as attributes and the creation provenance
+    return [vol_list_entry(get_full_vol_name(x['filename'], x['datastore']),
+                           os.path.join(x['path'], x['filename'])) \
             for x in vmdks]
 
+def vol_list_entry(full_vol_name, vmdk_path):
+    """
+    Returns the listVMDK() entry of a volume: its name, user labels, creation
+    time, the creation provenance recorded by the plugin and the full name it
+    had before a move
+    """
+    vol_meta = kv.getAll(vmdk_path) or {}
+    vol_opts = vol_meta.get(kv.VOL_OPTS) or {}
+    provenance = dict((key, vol_opts[key]) for key in kv.PROVENANCE_OPTS if key in vol_opts)
+    if kv.CREATED_BY in vol_meta:
+        provenance[CREATED_BY_VM] = vol_meta[kv.CREATED_BY]
+    return {u'Name': full_vol_name,
+            u'Attributes': get_labels(vol_opts),
+            u'Created': vol_meta.get(kv.CREATED, ""),
+            u'Provenance': provenance,
+            u'MovedFrom': vol_opts.get(kv.MOVED_FROM, "")}
+
+def groupRequest(vm_uuid, cmd, group, opts, tenant_name,
+                 default_datastore, default_datastore_url, vm_datastore, vm_datastore_url):
+    """
+    Takes (cmd "snapshot"), reverts to (cmd "revert") or removes (cmd
+    "rmsnapshot") a consistency group snapshot of volumes. Snapshots are full
+    copies of point-in-time images of the volumes, taken together with the
+    volumes locked. For "snapshot" the volumes are listed in opts, otherwise
+    (and for the copy of the images) they are read from the group record.
+    Returns error, or None for OK.
+    """
+    if not re.match(r'^[A-Za-z0-9][A-Za-z0-9_.\-]*$', group):
+        return err("Invalid snapshot group ID '{0}'".format(group))
+    copy = cmd == auth.CMD_SNAPSHOT and opts.get(kv.SNAPSHOT_COPY) == "true"
+    record = None
+    if cmd == auth.CMD_SNAPSHOT and not copy:
+        volumes = [v for v in opts.get(kv.SNAPSHOT_VOLUMES, "").split(",") if v]
+        if not volumes:
+            return err("No volumes given for snapshot group {0}".format(group))
+    else:
+        record = get_snapshot_group(tenant_name, group)
+        if not record:
+            return err("Snapshot group {0} not found".format(group))
+        volumes = record[kv.SNAPSHOT_VOLUMES]
+
+    members = []
+    for full_vol_name in volumes:
+        vol_name, datastore, _, vmdk_path, error_info = \
+            get_vol_location(vm_uuid, cmd, full_vol_name, {}, tenant_name,
+                             default_datastore, default_datastore_url, vm_datastore, vm_datastore_url)
+        if error_info:
+            return error_info
+        # snapshots of removed volumes can still be removed
+        if not os.path.isfile(vmdk_path) and cmd != auth.CMD_SNAPSHOT_REMOVE:
+            return err("Volume {0} not found".format(full_vol_name))
+        members.append((get_full_vol_name(vol_name, datastore), vmdk_path,
+                        "{}.{}.{}".format(vm_datastore, tenant_name, vol_name)))
+
+    # Lock the volumes in a fixed order, so group requests can not deadlock
+    locks = [lockManager.get_lock(lockname) for lockname in sorted(set(m[2] for m in members))]
+    for lock in locks:
+        lock.acquire()
+    try:
+        if copy:
+            return copy_snapshot_images(group, members, record)
+        if cmd == auth.CMD_SNAPSHOT:
+            return snapshotVMDKs(group, members)
+        if cmd == auth.CMD_REVERT:
+            return revertVMDKs(group, members)
+        logging.info("*** removing snapshot group %s", group)
+        remove_snapshot_group(group, members)
+        return None
+    finally:
+        for lock in reversed(locks):
+            lock.release()
+
+def get_snapshot_path(vmdk_path, group):
+    """ Returns the path of the snapshot of vmdk_path in the group """
+    return os.path.join(os.path.dirname(vmdk_path), kv.SNAPSHOTS_DIR, group,
+                        os.path.basename(vmdk_path))
+
+def write_snapshot_group(snapshot_dirs, record):
+    """ Writes the group record to the snapshot folders of the group """
+    for snapshot_dir in snapshot_dirs:
+        with open(os.path.join(snapshot_dir, kv.SNAPSHOT_GROUP_FILE), 'w') as f:
+            json.dump(record, f)
+
+def running_vm_of(full_vol_name, vmdk_path):
+    """
+    Returns (error, vm) with the powered on VM the volume is attached to and
+    writes, or vm None if there's none. A VM on another ESX is an error, its
+    disks can't be snapshotted from here.
+    """
+    attached, uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    if not attached or not uuid or is_read_only_many(kv.getAll(vmdk_path)):
+        return None, None
+    vm = findVmByUuid(uuid)
+    if not vm:
+        return err("Volume {0} is attached to VM {1} on another ESX".format(full_vol_name,
+                   attached_vm_name)), None
+    if vm.runtime.powerState == VM_POWERED_OFF:
+        return None, None
+    return None, vm
+
+def find_vm_snapshot(snapshots, name):
+    """ Returns the VM snapshot named name in the snapshot tree, or None """
+    for snapshot in snapshots or []:
+        if snapshot.name == name:
+            return snapshot.snapshot
+        found = find_vm_snapshot(snapshot.childSnapshotList, name)
+        if found:
+            return found
+    return None
+
+def remove_vm_snapshots(group, vm_uuids):
+    """
+    Removes the VM snapshots snapshotVMDKs() took for the group, which
+    consolidates the writes since into the volume disks.
+    Returns error, or None for OK.
+    """
+    si = get_si()
+    name = kv.SNAPSHOT_VM_NAME.format(group)
+    error_info = None
+    for uuid in vm_uuids:
+        vm = findVmByUuid(uuid)
+        snapshot = find_vm_snapshot(vm.snapshot.rootSnapshotList, name) \
+                   if vm and vm.snapshot else None
+        if not snapshot:
+            continue
+        try:
+            wait_for_tasks(si, [snapshot.RemoveSnapshot_Task(removeChildren=False)])
+        except vim.fault.VimFault as ex:
+            logging.warning("*** failed to remove snapshot %s of VM %s: %s", name, uuid, ex.msg)
+            error_info = err("Failed to remove snapshot {0} of VM {1}: {2}".format(name,
+                             vm.config.name, ex.msg))
+    return error_info
+
+def snapshotVMDKs(group, members):
+    """
+    Takes a point-in-time image of each volume of the group, for
+    copy_snapshot_images() to copy once the plugin has thawed the volumes.
+    A volume no running VM writes is its own image. A volume attached as
+    "persistent" gets a VM snapshot of its VM, which leaves the volume disk
+    read-only. Independent disks are left out of VM snapshots, so volumes
+    attached as independent can't be snapshotted while in use.
+    Returns error, or None for OK.
+    """
+    logging.info("*** snapshotVMDKs: group=%s volumes=%s", group, [m[0] for m in members])
+    snapshot_dirs = set(os.path.dirname(get_snapshot_path(m[1], group)) for m in members)
+    for snapshot_dir in snapshot_dirs:
+        if os.path.exists(snapshot_dir):
+            return err("Snapshot group {0} already exists".format(group))
+
+    images = {}
+    vms = {}
+    covered = {}  # volumes in a VM snapshot -> the VM uuid
+    for full_vol_name, vmdk_path, _ in members:
+        error_info, vm = running_vm_of(full_vol_name, vmdk_path)
+        if error_info:
+            return error_info
+        if vm:
+            _, _, attach_as, _ = getStatusAttached(vmdk_path)
+            if attach_as != kv.DEPENDENT:
+                return err("Volume {0} is attached to VM {1} as an independent disk and can't "
+                           "be snapshotted while in use, unless {2}={3}".format(full_vol_name,
+                           vm.config.name, kv.ATTACH_AS, kv.DEPENDENT))
+            vms[vm.config.uuid] = vm
+            covered[full_vol_name] = vm.config.uuid
+        # the VM writes to a delta disk after its snapshot, the volume disk
+        # is the image either way
+        images[full_vol_name] = vmdk_path
+
+    record = {u'Group': group,
+              u'Created': time.asctime(time.gmtime()),
+              kv.SNAPSHOT_VOLUMES: [m[0] for m in members],
+              kv.SNAPSHOT_PENDING: {u'Images': images, u'VMs': list(vms.keys()),
+                                    u'Covered': covered}}
+    try:
+        for snapshot_dir in snapshot_dirs:
+            os.makedirs(snapshot_dir)
+        write_snapshot_group(snapshot_dirs, record)
+
+        si = get_si()
+        tasks = [vm.CreateSnapshot_Task(name=kv.SNAPSHOT_VM_NAME.format(group),
+                                        description="Consistency group snapshot of volumes",
+                                        memory=False, quiesce=False)
+                 for vm in vms.values()]
+        wait_for_tasks(si, tasks)
+    except (vim.fault.VimFault, OSError, IOError) as ex:
+        logging.warning("*** snapshotVMDKs: group %s failed: %s", group, ex)
+        remove_snapshot_group(group, members)
+        return err("Failed to snapshot volumes: {0}".format(getattr(ex, 'msg', ex)))
+    return None
+
+def copy_snapshot_images(group, members, record):
+    """
+    Copies the images snapshotVMDKs() took into the snapshot folders, with
+    all copies running at once, and removes the VM snapshots taken for them.
+    Returns error, or None for OK.
+    """
+    pending = record.get(kv.SNAPSHOT_PENDING)
+    if not pending:
+        return err("Snapshot group {0} has been copied already".format(group))
+    logging.info("*** copy_snapshot_images: group=%s volumes=%s", group, [m[0] for m in members])
+
+    images = []
+    covered = pending.get(u'Covered', {})
+    for full_vol_name, vmdk_path, _ in members:
+        image = pending[u'Images'].get(full_vol_name)
+        if not image or not os.path.isfile(image):
+            remove_snapshot_group(group, members)
+            return err("Image of volume {0} in snapshot group {1} not found".format(full_vol_name, group))
+        # a volume detached when the group was taken must not have been
+        # written since, the VM snapshot keeps the others unchanged
+        if full_vol_name not in covered:
+            error_info, vm = running_vm_of(full_vol_name, vmdk_path)
+            if error_info or vm:
+                remove_snapshot_group(group, members)
+                return err("Volume {0} was attached after snapshot group {1} was taken".format(
+                           full_vol_name, group))
+        images.append(image)
+
+    snapshot_dirs = set(os.path.dirname(get_snapshot_path(image, group)) for image in images)
+    try:
+        si = get_si()
+        tasks = [si.content.virtualDiskManager.CopyVirtualDisk(
+                     sourceName=vmdk_utils.get_datastore_path(image),
+                     destName=vmdk_utils.get_datastore_path(get_snapshot_path(image, group)))
+                 for image in images]
+        wait_for_tasks(si, tasks)
+        del record[kv.SNAPSHOT_PENDING]
+        write_snapshot_group(snapshot_dirs, record)
+    except (vim.fault.VimFault, OSError, IOError) as ex:
+        logging.warning("*** copy_snapshot_images: group %s failed: %s", group, ex)
+        remove_snapshot_group(group, members)
+        return err("Failed to snapshot volumes: {0}".format(getattr(ex, 'msg', ex)))
+    return remove_vm_snapshots(group, pending[u'VMs'])
+
+def remove_snapshot_group(group, members):
+    """
+    Removes the snapshots of a group, and their folders, and the VM
+    snapshots of a group which wasn't copied yet
+    """
+    for _, vmdk_path, _ in members:
+        snapshot_dir = os.path.dirname(get_snapshot_path(vmdk_path, group))
+        try:
+            with open(os.path.join(snapshot_dir, kv.SNAPSHOT_GROUP_FILE)) as f:
+                pending = json.load(f).get(kv.SNAPSHOT_PENDING)
+        except (IOError, ValueError, AttributeError):
+            continue
+        if pending:
+            remove_vm_snapshots(group, pending.get(u'VMs', []))
+        break
+    for _, vmdk_path, _ in members:
+        snapshot_path = get_snapshot_path(vmdk_path, group)
+        if os.path.isfile(snapshot_path):
+            cleanVMDK(snapshot_path)
+    for _, vmdk_path, _ in members:
+        snapshot_dir = os.path.dirname(get_snapshot_path(vmdk_path, group))
+        if os.path.isdir(snapshot_dir):
+            shutil.rmtree(snapshot_dir, ignore_errors=True)
+
+def move_vmdk(si, source, dest):
+    """ Moves the disk source to dest, raises vim.fault.VimFault on failure """
+    wait_for_tasks(si, [si.content.virtualDiskManager.MoveVirtualDisk(
+        sourceName=vmdk_utils.get_datastore_path(source),
+        destName=vmdk_utils.get_datastore_path(dest))])
+
+def restore_vmdk(si, vmdk_path, aside_path):
+    """
+    Puts the disk moved aside to aside_path back to vmdk_path, replacing what
+    took its place. Returns error, or None for OK.
+    """
+    if not os.path.isfile(aside_path):
+        return None
+    if os.path.isfile(vmdk_path):
+        clean_err = cleanVMDK(vmdk_path)
+        if clean_err:
+            return clean_err
+    try:
+        move_vmdk(si, aside_path, vmdk_path)
+    except vim.fault.VimFault as ex:
+        logging.error("*** failed to move %s back to %s: %s", aside_path, vmdk_path, ex.msg)
+        return err("Failed to restore {0} from {1}: {2}".format(vmdk_path, aside_path, ex.msg))
+    return None
+
+def revertVMDKs(group, members):
+    """
+    Replaces the volumes of the group with their snapshots. The volumes keep
+    their current metadata. None of the volumes may be attached.
+    Returns error, or None for OK.
+    """
+    logging.info("*** revertVMDKs: group=%s volumes=%s", group, [m[0] for m in members])
+    for full_vol_name, vmdk_path, _ in members:
+        attached, uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+        if attached and handle_stale_attach(vmdk_path, uuid):
+            return err("Volume {0} is in use by VM {1} and can't be reverted".format(full_vol_name,
+                       attached_vm_name))
+        if not os.path.isfile(get_snapshot_path(vmdk_path, group)):
+            return err("Snapshot of volume {0} in group {1} not found".format(full_vol_name, group))
+
+    # Copy the snapshots first, so a failure leaves the volumes as they are
+    si = get_si()
+    reverted = [(vmdk_path, get_snapshot_path(vmdk_path, group)[:-len(".vmdk")] + "-revert.vmdk",
+                 get_snapshot_path(vmdk_path, group)[:-len(".vmdk")] + "-orig.vmdk")
+                for _, vmdk_path, _ in members]
+    tasks = [si.content.virtualDiskManager.CopyVirtualDisk(
+                 sourceName=vmdk_utils.get_datastore_path(get_snapshot_path(vmdk_path, group)),
+                 destName=vmdk_utils.get_datastore_path(copy_path))
+             for vmdk_path, copy_path, _ in reverted]
+    try:
+        wait_for_tasks(si, tasks)
+    except vim.fault.VimFault as ex:
+        for _, copy_path, _ in reverted:
+            if os.path.isfile(copy_path):
+                cleanVMDK(copy_path)
+        return err("Failed to revert volumes: {0}".format(ex.msg))
+
+    # Move each volume aside and its copy into its place. The volumes are
+    # deleted only once all are swapped, a failure moves them all back.
+    metas = [kv.getAll(vmdk_path) for vmdk_path, _, _ in reverted]
+    swapped = []
+    try:
+        for vmdk_path, copy_path, aside_path in reverted:
+            move_vmdk(si, vmdk_path, aside_path)
+            swapped.append((vmdk_path, aside_path))
+            move_vmdk(si, copy_path, vmdk_path)
+    except vim.fault.VimFault as ex:
+        logging.warning("*** revertVMDKs: group %s failed, restoring the volumes: %s", group, ex.msg)
+        for vmdk_path, aside_path in reversed(swapped):
+            restore_vmdk(si, vmdk_path, aside_path)
+        for _, copy_path, _ in reverted:
+            if os.path.isfile(copy_path):
+                cleanVMDK(copy_path)
+        return err("Failed to revert volumes: {0}".format(ex.msg))
+
+    for (vmdk_path, _, aside_path), vol_meta in zip(reverted, metas):
+        if vol_meta and not kv.setAll(vmdk_path, vol_meta):
+            logging.warning("*** revertVMDKs: failed to restore metadata of %s", vmdk_path)
+        if cleanVMDK(aside_path):
+            logging.warning("*** revertVMDKs: failed to remove %s", aside_path)
+    return None
+
+def get_replica_path(vol_path, vol_name):
+    """ Returns the path of the replica of vol_name in the volume folder vol_path """
+    return vmdk_utils.get_vmdk_path(os.path.join(vol_path, kv.REPLICAS_DIR), vol_name)
+
+def replicateVMDK(vm_uuid, vmdk_path, vol_name, datastore, tenant_name, opts):
+    """
+    Refreshes the replica of a volume from the snapshot group opts["group"]
+    taken by the plugin, which is removed afterwards. The replica is written
+    to a temp file first, so a failure leaves the last replica.
+    Returns error, or None for OK.
+    """
+    group = opts.get("group", "")
+    members = [(get_full_vol_name(vol_name, datastore), vmdk_path, None)]
+    try:
+        return refresh_replica(vm_uuid, vmdk_path, vol_name, datastore, tenant_name, group)
+    finally:
+        if group:
+            remove_snapshot_group(group, members)
+
+def refresh_replica(vm_uuid, vmdk_path, vol_name, datastore, tenant_name, group):
+    """ Copies the snapshot of the group to the replica, see replicateVMDK() """
+    snapshot_path = get_snapshot_path(vmdk_path, group)
+    if not group or not os.path.isfile(snapshot_path):
+        return err("Snapshot group {0} of volume {1} not found".format(group, vol_name))
+    vol_meta = kv.getAll(vmdk_path)
+    target = vol_meta.get(kv.VOL_OPTS, {}).get(kv.REPLICATE_TO) if vol_meta else None
+    if not target:
+        return err("Volume {0} has no {1} option".format(vol_name, kv.REPLICATE_TO))
+    target_url = vmdk_utils.get_datastore_url(target)
+    if not target_url:
+        return err("Invalid datastore '{0}' in {1}".format(target, kv.REPLICATE_TO))
+
+    # The replica uses space on the target datastore, as a new volume would
+    error_info, _, _ = auth.authorize(vm_uuid, target_url, auth.CMD_CREATE,
+                                      {kv.SIZE: kv.get_vol_info(vmdk_path)["size"]})
+    if error_info:
+        return err(error_info)
+    target_path, errMsg = get_vol_path(target, tenant_name)
+    if target_path is None:
+        return err("Failed to get path of datastore {0}: {1}".format(target, errMsg))
+    if os.path.isfile(vmdk_utils.get_vmdk_path(target_path, vol_name)):
+        return err("Volume {0} already exists on {1}, can't replicate there".format(vol_name, target))
+
+    source = get_full_vol_name(vol_name, datastore)
+    replica_path = get_replica_path(target_path, vol_name)
+    record_path = replica_path[:-len(".vmdk")] + kv.REPLICA_FILE_SUFFIX
+    try:
+        with open(record_path) as f:
+            record = json.load(f)
+        if record[u'Source'] != source:
+            return err("{0} has a replica of volume {1} already".format(target, record[u'Source']))
+    except (IOError, ValueError, KeyError):
+        pass
+
+    logging.info("*** replicateVMDK: %s to %s", source, replica_path)
+    tmp_path = replica_path[:-len(".vmdk")] + "-tmp.vmdk"
+    old_path = replica_path[:-len(".vmdk")] + "-old.vmdk"
+    si = get_si()
+    try:
+        if not os.path.isdir(os.path.dirname(replica_path)):
+            os.makedirs(os.path.dirname(replica_path))
+        for path in [tmp_path, old_path]:
+            if os.path.isfile(path):
+                cleanVMDK(path)
+        wait_for_tasks(si, [si.content.virtualDiskManager.CopyVirtualDisk(
+            sourceName=vmdk_utils.get_datastore_path(snapshot_path),
+            destName=vmdk_utils.get_datastore_path(tmp_path))])
+    except (vim.fault.VimFault, OSError, IOError) as ex:
+        return err("Failed to replicate volume {0}: {1}".format(vol_name, getattr(ex, 'msg', ex)))
+
+    # Move the last replica aside and the new one into its place, the last
+    # replica is deleted only once the new one is there
+    try:
+        if os.path.isfile(replica_path):
+            move_vmdk(si, replica_path, old_path)
+        move_vmdk(si, tmp_path, replica_path)
+    except vim.fault.VimFault as ex:
+        logging.warning("*** replicateVMDK: %s failed, restoring the last replica: %s", source, ex.msg)
+        restore_vmdk(si, replica_path, old_path)
+        if os.path.isfile(tmp_path):
+            cleanVMDK(tmp_path)
+        return err("Failed to replicate volume {0}: {1}".format(vol_name, ex.msg))
+    if os.path.isfile(old_path) and cleanVMDK(old_path):
+        logging.warning("*** replicateVMDK: failed to remove %s", old_path)
+
+    try:
+        with open(record_path, 'w') as f:
+            json.dump({u'Source': source, u'Synced': time.strftime(kv.EXPIRES_AT_FORMAT, time.gmtime())}, f)
+    except IOError as ex:
+        return err("Failed to replicate volume {0}: {1}".format(vol_name, ex))
+    return None
+
+def promoteVMDK(vmdk_path, vol_name, datastore):
+    """
+    Turns the replica of vol_name on datastore into a volume, for use when
+    the datastore of the source volume is lost. Returns error, or None for OK.
+    """
+    replica_path = get_replica_path(os.path.dirname(vmdk_path), vol_name)
+    record_path = replica_path[:-len(".vmdk")] + kv.REPLICA_FILE_SUFFIX
+    if os.path.isfile(vmdk_path):
+        return err("Volume {0} already exists on {1}".format(vol_name, datastore))
+    if not os.path.isfile(replica_path):
+        return err("No replica of volume {0} on {1}".format(vol_name, datastore))
+
+    logging.info("*** promoteVMDK: %s on %s", vol_name, datastore)
+    si = get_si()
+    try:
+        wait_for_tasks(si, [si.content.virtualDiskManager.MoveVirtualDisk(
+            sourceName=vmdk_utils.get_datastore_path(replica_path),
+            destName=vmdk_utils.get_datastore_path(vmdk_path))])
+    except vim.fault.VimFault as ex:
+        return err("Failed to promote replica of volume {0}: {1}".format(vol_name, ex.msg))
+
+    # The replica metadata is the source volume's at the last refresh
+    source = None
+    try:
+        with open(record_path) as f:
+            source = json.load(f)[u'Source']
+        os.remove(record_path)
+    except (IOError, OSError, ValueError, KeyError) as ex:
+        logging.warning("*** promoteVMDK: failed to read replica record %s: %s", record_path, ex)
+    vol_meta = kv.getAll(vmdk_path) or {}
+    vol_meta[kv.STATUS] = kv.DETACHED
+    for key in [kv.ATTACHED_VM_UUID, kv.ATTACHED_VM_NAME, kv.ATTACHED_VM_DEV, kv.ATTACHED_VMS]:
+        vol_meta.pop(key, None)
+    vol_opts = vol_meta.get(kv.VOL_OPTS) or {}
+    for key in [kv.REPLICATE_TO, kv.REPLICA_LAST_SYNC, kv.REPLICA_LAST_ERROR]:
+        vol_opts.pop(key, None)
+    if source:
+        vol_opts[kv.PROMOTED_FROM] = source
+    vol_meta[kv.VOL_OPTS] = vol_opts
+    if not kv.setAll(vmdk_path, vol_meta):
+        return err("Failed to save metadata of promoted volume {0}".format(vol_name))
+    return None
+
+def inflateVMDK(vmdk_path, vol_name, datastore):
+    """
+    Converts a thin or zeroedthick volume to eagerzeroedthick. The volume
+    must be detached, and for thin volumes the datastore must have the space
+    not allocated yet. The progress is in inflate_progress while it runs.
+    Returns error, or None for OK.
+    """
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found".format(vol_name))
+    attached, uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached and handle_stale_attach(vmdk_path, uuid):
+        return err("Volume {0} is attached to VM {1} and can't be inflated".format(vol_name,
+                   attached_vm_name))
+
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0}".format(vol_name))
+    disk_format = vol_meta.get(kv.VOL_OPTS, {}).get(kv.DISK_ALLOCATION_FORMAT,
+                                                    kv.DEFAULT_ALLOCATION_FORMAT)
+    if disk_format == "eagerzeroedthick":
+        return err("Volume {0} is eagerzeroedthick already".format(vol_name))
+
+    si = get_si()
+    ds_path = vmdk_utils.get_datastore_path(vmdk_path)
+    if disk_format == "thin":
+        sizes = kv.get_vol_size_bytes(vmdk_path)
+        free = vmdk_utils.get_datastore_free_space(datastore)
+        if not sizes or free is None:
+            return err("Failed to get the space needed to inflate volume {0}".format(vol_name))
+        needed = sizes[SIZE] - sizes[ALLOCATED]
+        if needed > free:
+            return err("Not enough free space on {0} to inflate volume {1}: {2}MB needed, "
+                       "{3}MB free".format(datastore, vol_name, needed // MB, free // MB))
+        task = si.content.virtualDiskManager.InflateVirtualDisk(name=ds_path)
+    else:
+        # zeroedthick is allocated already, only the zeroing is left
+        task = si.content.virtualDiskManager.EagerZeroVirtualDisk(name=ds_path)
+
+    full_vol_name = get_full_vol_name(vol_name, datastore)
+    logging.info("*** inflateVMDK: %s from %s", full_vol_name, disk_format)
+    inflate_progress[full_vol_name] = 0
+    try:
+        wait_for_task_progress(task, lambda percent: inflate_progress.update({full_vol_name: percent}))
+    except vim.fault.VimFault as ex:
+        return err("Failed to inflate volume {0}: {1}".format(vol_name, ex.msg))
+    finally:
+        inflate_progress.pop(full_vol_name, None)
+
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0}".format(vol_name))
+    vol_meta.setdefault(kv.VOL_OPTS, {})[kv.DISK_ALLOCATION_FORMAT] = "eagerzeroedthick"
+    if not kv.setAll(vmdk_path, vol_meta):
+        return err("Failed to save volume metadata for {0}".format(vol_name))
+    return None
+
+def moveVMDK(vm_uuid, vmdk_path, vol_name, datastore, datastore_url, tenant_uuid, tenant_name, opts):
+    """
+    Moves a volume to the datastore opts["target"], where it becomes
+    vol_name@target. The volume must be detached and have no snapshots.
+    The metadata is kept in the disk sidecar, which moves with the disk.
+    The progress is in move_progress while it runs.
+    Returns error, or None for OK.
+    """
+    target = opts.get("target", "")
+    if not target or not vmdk_utils.validate_datastore(target):
+        return err("Invalid target datastore '{0}'".format(target))
+    if target == datastore:
+        return err("Volume {0} is on {1} already".format(vol_name, target))
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found".format(vol_name))
+    attached, uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached and handle_stale_attach(vmdk_path, uuid):
+        return err("Volume {0} is attached to VM {1} and can't be moved".format(vol_name,
+                   attached_vm_name))
+    if glob.glob(os.path.join(os.path.dirname(vmdk_path), kv.SNAPSHOTS_DIR, "*",
+                              os.path.basename(vmdk_path))):
+        return err("Volume {0} has snapshots, remove them before moving it".format(vol_name))
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0}".format(vol_name))
+    if vol_meta.get(kv.VOL_OPTS, {}).get(kv.REPLICATE_TO) == target:
+        return err("Volume {0} is replicated to {1}, stop replicating it first".format(vol_name, target))
+
+    # The volume uses space on the target datastore, as a new volume would
+    target_url = vmdk_utils.get_datastore_url(target)
+    sizes = kv.get_vol_size_bytes(vmdk_path)
+    if not sizes:
+        return err("Failed to get the size of volume {0}".format(vol_name))
+    size_mb = sizes[SIZE] // MB
+    error_info, _, _ = auth.authorize(vm_uuid, target_url, auth.CMD_CREATE,
+                                      {kv.SIZE: "{0}MB".format(size_mb)})
+    if error_info:
+        return err(error_info)
+    target_path, errMsg = get_vol_path(target, tenant_name)
+    if target_path is None:
+        return err("Failed to get path of datastore {0}: {1}".format(target, errMsg))
+    target_vmdk_path = vmdk_utils.get_vmdk_path(target_path, vol_name)
+    if os.path.isfile(target_vmdk_path):
+        return err("Volume {0} already exists on {1}".format(vol_name, target))
+
+    full_vol_name = get_full_vol_name(vol_name, datastore)
+    logging.info("*** moveVMDK: %s to %s", full_vol_name, target_vmdk_path)
+    si = get_si()
+    move_progress[full_vol_name] = 0
+    try:
+        task = si.content.virtualDiskManager.MoveVirtualDisk(
+            sourceName=vmdk_utils.get_datastore_path(vmdk_path),
+            destName=vmdk_utils.get_datastore_path(target_vmdk_path))
+        wait_for_task_progress(task, lambda percent: move_progress.update({full_vol_name: percent}))
+    except vim.fault.VimFault as ex:
+        return err("Failed to move volume {0}: {1}".format(vol_name, ex.msg))
+    finally:
+        move_progress.pop(full_vol_name, None)
+
+    # The volume is gone from the source datastore, failures below only log
+    error_info = auth.remove_volume_from_volumes_table(tenant_uuid, datastore_url, vol_name)
+    if error_info:
+        logging.warning("*** moveVMDK: failed to remove %s from volumes table: %s", full_vol_name, error_info)
+    error_info = auth.add_volume_to_volumes_table(tenant_uuid, target_url, vol_name, size_mb)
+    if error_info:
+        logging.warning("*** moveVMDK: failed to add %s to volumes table: %s", vol_name, error_info)
+
+    vol_meta = kv.getAll(target_vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0} after the move".format(vol_name))
+    vol_meta.setdefault(kv.VOL_OPTS, {})[kv.MOVED_FROM] = full_vol_name
+    if not kv.setAll(target_vmdk_path, vol_meta):
+        return err("Failed to save volume metadata for {0}".format(vol_name))
+
+    # The replica keeps being refreshed from the volume under its new name
+    replicate_to = vol_meta[kv.VOL_OPTS].get(kv.REPLICATE_TO)
+    replica_vol_path, _ = get_vol_path(replicate_to, tenant_name) if replicate_to else (None, None)
+    if replica_vol_path:
+        record_path = get_replica_path(replica_vol_path, vol_name)[:-len(".vmdk")] + kv.REPLICA_FILE_SUFFIX
+        try:
+            with open(record_path) as f:
+                record = json.load(f)
+            if record[u'Source'] == full_vol_name:
+                record[u'Source'] = get_full_vol_name(vol_name, target)
+                with open(record_path, 'w') as f:
+                    json.dump(record, f)
+        except (IOError, ValueError, KeyError):
+            pass
+    return None
+
+def extendVMDK(vm_uuid, vmdk_path, vol_name, datastore_url, tenant_uuid, opts):
+    """
+    Grows a volume to the size in opts. A volume attached to the requesting
+    VM is extended online, the guest has to rescan the disk and grow the
+    filesystem. Returns error, or None for OK.
+    """
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found".format(vol_name))
+    try:
+        validate_size(opts.get(kv.SIZE, ""))
+    except ValidationError as e:
+        return err(e.msg)
+    new_size_mb = convert.convert_to_MB(opts[kv.SIZE])
+    sizes = kv.get_vol_size_bytes(vmdk_path)
+    if not sizes:
+        return err("Failed to get the size of volume {0}".format(vol_name))
+    size_mb = sizes[SIZE] // MB
+    if new_size_mb <= size_mb:
+        return err("Volume {0} is {1}MB, can't extend it to {2}MB".format(vol_name, size_mb, new_size_mb))
+    if tenant_uuid:
+        error_info = auth.check_extend_quota(tenant_uuid, datastore_url, new_size_mb - size_mb)
+        if error_info:
+            return err(error_info)
+
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta:
+        return err("Failed to get volume metadata for {0}".format(vol_name))
+    disk_format = vol_meta.get(kv.VOL_OPTS, {}).get(kv.DISK_ALLOCATION_FORMAT,
+                                                    kv.DEFAULT_ALLOCATION_FORMAT)
+    si = get_si()
+    vm = findVmByUuid(vm_uuid)
+    attached, uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    logging.info("*** extendVMDK: %s from %dMB to %dMB", vmdk_path, size_mb, new_size_mb)
+    try:
+        if attached and vm and uuid == vm.config.uuid:
+            device = findDeviceByPath(vmdk_path, vm)
+            if not device:
+                return err("Volume {0} not found in VM {1}".format(vol_name, vm.config.name))
+            device.capacityInKB = new_size_mb * 1024
+            disk_spec = vim.vm.device.VirtualDeviceSpec()
+            disk_spec.operation = vim.vm.device.VirtualDeviceSpec.Operation.edit
+            disk_spec.device = device
+            wait_for_tasks(si, [vm.ReconfigVM_Task(spec=vim.vm.ConfigSpec(deviceChange=[disk_spec]))])
+        elif attached and handle_stale_attach(vmdk_path, uuid):
+            return err("Volume {0} is attached to VM {1} and can only be extended from it".format(
+                       vol_name, attached_vm_name))
+        else:
+            wait_for_tasks(si, [si.content.virtualDiskManager.ExtendVirtualDisk(
+                name=vmdk_utils.get_datastore_path(vmdk_path),
+                newCapacityKb=new_size_mb * 1024,
+                eagerZero=(disk_format == "eagerzeroedthick"))])
+    except vim.fault.VimFault as ex:
+        return err("Failed to extend volume {0}: {1}".format(vol_name, ex.msg))
+
+    vol_meta = kv.getAll(vmdk_path)
+    if vol_meta and kv.SIZE in vol_meta.get(kv.VOL_OPTS, {}):
+        vol_meta[kv.VOL_OPTS][kv.SIZE] = "{0}mb".format(new_size_mb)
+        kv.setAll(vmdk_path, vol_meta)
+    if tenant_uuid:
+        auth.update_volume_size_in_volumes_table(tenant_uuid, datastore_url, vol_name, new_size_mb)
+    return None
+
+def get_snapshot_groups(tenant_name):
+    """ Returns {group: record} of the snapshot groups on all datastores """
+    groups = {}
+    for datastore, _, _ in vmdk_utils.get_datastores():
+        path, _ = get_vol_path(datastore, tenant_name)
+        if path is None:
+            continue
+        for group_file in glob.glob(os.path.join(path, kv.SNAPSHOTS_DIR, "*", kv.SNAPSHOT_GROUP_FILE)):
+            try:
+                with open(group_file) as f:
+                    record = json.load(f)
+                groups[record[u'Group']] = record
+            except (IOError, ValueError, KeyError) as ex:
+                logging.warning("Ignoring snapshot group record %s: %s", group_file, ex)
+    return groups
+
+def get_snapshot_group(tenant_name, group):
+    """ Returns the record of a snapshot group, or None """
+    return get_snapshot_groups(tenant_name).get(group)
+
+def listSnapshotGroups(tenant_name):
+    """ Returns the list of snapshot group records """
+    return sorted(get_snapshot_groups(tenant_name).values(), key=lambda r: r[u'Group'])
+
 
 # Return VM managed object, reconnect if needed. Throws if fails twice.
 def findVmByUuid(vm_uuid):
@@ -824,6 +1844,58 @@ def authorize_check(vm_uuid, datastore_url, cmd, opts, use_default_ds, datastore
     return None
 
 
+def get_vol_location(vm_uuid, cmd, full_vol_name, opts, tenant_name,
+                     default_datastore, default_datastore_url, vm_datastore, vm_datastore_url):
+    """
+    Resolves volume[@datastore] to the path of the volume vmdk, after checking
+    that the VM may run <cmd> on the datastore.
+    Returns (vol_name, datastore, datastore_url, vmdk_path, None), or a tuple of
+    Nones with the error last on failure.
+    """
+    failed = (None, None, None, None)
+    try:
+        vol_name, datastore = parse_vol_name(full_vol_name)
+    except ValidationError as ex:
+        return failed + (err(str(ex)),)
+
+    if datastore and not vmdk_utils.validate_datastore(datastore):
+        return failed + (err("Invalid datastore '%s'.\n" \
+                             "Known datastores: %s.\n" \
+                             "Default datastore: %s" \
+                             % (datastore, ", ".join(get_datastore_names_list()), default_datastore)),)
+
+    if not datastore:
+        datastore_url = default_datastore_url
+        datastore = default_datastore
+        use_default_ds = True
+    else:
+        datastore_url = vmdk_utils.get_datastore_url(datastore)
+        use_default_ds = False
+
+    logging.debug("get_vol_location: vm_uuid=%s, tenant_name=%s, "
+                  "default_datastore_url=%s datastore_url=%s",
+                  vm_uuid, tenant_name, default_datastore_url, datastore_url)
+
+    error_info = authorize_check(vm_uuid, datastore_url, cmd, opts, use_default_ds, datastore, vm_datastore)
+    if error_info:
+        return failed + (err(error_info),)
+
+    # get_vol_path() need to pass in a real datastore name
+    if datastore == auth_data_const.VM_DS:
+        datastore = vm_datastore
+        # set datastore_url to a real datastore_url
+        # createVMDK() and removeVMDK() need to pass in
+        # a real datastore_url instead of url of _VM_DS
+        datastore_url = vm_datastore_url
+
+    path, errMsg = get_vol_path(datastore, tenant_name)
+    logging.debug("get_vol_location for tenant %s with path %s", tenant_name, path)
+    if path is None:
+        return failed + (errMsg,)
+
+    return vol_name, datastore, datastore_url, vmdk_utils.get_vmdk_path(path, vol_name), None
+
+
 # gets the requests, calculates path for volumes, and calls the relevant handler
 def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts):
     """
@@ -873,47 +1945,31 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts):
         # if default_datastore is not set, should return error
         return listVMDK(tenant_name)
 
-    try:
-        vol_name, datastore = parse_vol_name(full_vol_name)
-    except ValidationError as ex:
-        return err(str(ex))
+    if cmd == "snapshots":
+        threadutils.set_thread_name("{0}-nolock-{1}".format(vm_name, cmd))
+        return listSnapshotGroups(tenant_name)
 
-    if datastore and not vmdk_utils.validate_datastore(datastore):
-        return err("Invalid datastore '%s'.\n" \
-                   "Known datastores: %s.\n" \
-                   "Default datastore: %s" \
-                   % (datastore, ", ".join(get_datastore_names_list()), default_datastore))
+    if cmd == "inflatestatus":
+        # inflate holds the volume lock, so its progress is read without it
+        threadutils.set_thread_name("{0}-nolock-{1}".format(vm_name, cmd))
+        return dict(inflate_progress)
 
-    if not datastore:
-        datastore_url = default_datastore_url
-        datastore = default_datastore
-        use_default_ds = True
-    else:
-        datastore_url = vmdk_utils.get_datastore_url(datastore)
-        use_default_ds = False
+    if cmd == "movestatus":
+        # as for inflatestatus
+        threadutils.set_thread_name("{0}-nolock-{1}".format(vm_name, cmd))
+        return dict(move_progress)
 
-    logging.debug("executeRequest: vm_uuid=%s, vm_name=%s, tenant_name=%s, tenant_uuid=%s, "
-                  "default_datastore_url=%s datastore_url=%s",
-                  vm_uuid, vm_name, tenant_uuid, tenant_name, default_datastore_url, datastore_url)
+    if cmd in [auth.CMD_SNAPSHOT, auth.CMD_REVERT, auth.CMD_SNAPSHOT_REMOVE]:
+        # The request is about a group of volumes, full_vol_name is the group ID
+        threadutils.set_thread_name("{0}-{1}-{2}".format(vm_name, cmd, full_vol_name))
+        return groupRequest(vm_uuid, cmd, full_vol_name, opts, tenant_name,
+                            default_datastore, default_datastore_url, vm_datastore, vm_datastore_url)
 
-    error_info = authorize_check(vm_uuid, datastore_url, cmd, opts, use_default_ds, datastore, vm_datastore)
+    vol_name, datastore, datastore_url, vmdk_path, error_info = \
+        get_vol_location(vm_uuid, cmd, full_vol_name, opts, tenant_name,
+                         default_datastore, default_datastore_url, vm_datastore, vm_datastore_url)
     if error_info:
-        return err(error_info)
-
-    # get_vol_path() need to pass in a real datastore name
-    if datastore == auth_data_const.VM_DS:
-        datastore = vm_datastore
-        # set datastore_url to a real datastore_url
-        # createVMDK() and removeVMDK() need to pass in
-        # a real datastore_url instead of url of _VM_DS
-        datastore_url = vm_datastore_url
-
-    path, errMsg = get_vol_path(datastore, tenant_name)
-    logging.debug("executeRequest for tenant %s with path %s", tenant_name, path)
-    if path is None:
-        return errMsg
-
-    vmdk_path = vmdk_utils.get_vmdk_path(path, vol_name)
+        return error_info
 
     # Set up locking for volume operations.
     # Lock name defaults to combination of DS,tenant name and vol name
@@ -941,6 +1997,21 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts):
                                   vm_name=vm_name,
                                   tenant_uuid=tenant_uuid,
                                   datastore_url=datastore_url)
+        elif cmd == "set":
+            response = setVMDK(vmdk_path, vol_name, opts)
+        elif cmd == auth.CMD_REPLICATE:
+            response = replicateVMDK(vm_uuid, vmdk_path, vol_name, datastore, tenant_name, opts)
+        elif cmd == auth.CMD_PROMOTE:
+            response = promoteVMDK(vmdk_path, vol_name, datastore)
+        elif cmd == auth.CMD_INFLATE:
+            response = inflateVMDK(vmdk_path, vol_name, datastore)
+        elif cmd == auth.CMD_MOVE:
+            response = moveVMDK(vm_uuid, vmdk_path, vol_name, datastore, datastore_url,
+                                tenant_uuid, tenant_name, opts)
+        elif cmd == auth.CMD_EXTEND:
+            # reconfigures the VM when the volume is attached
+            with lockManager.get_lock(vm_uuid):
+                response = extendVMDK(vm_uuid, vmdk_path, vol_name, datastore_url, tenant_uuid, opts)
 
         # For attach/detach reconfigure tasks, hold a per vm lock.
         elif cmd == "attach":
@@ -1039,21 +2110,64 @@ def findDeviceByPath(vmdk_path, vm):
             return d
     return None
 
+class ControllerKind(object):
+    '''
+    A kind of controller disks are attached to. The controllers are devices
+    of device_class, with the key offset_from_bus_number + bus number,
+    sharing the bus numbers with the devices of bus_class. Disks get one of
+    units. The PCI slot number of a controller is in the VM config as
+    <config_prefix><bus number>.pciSlotNumber.
+    '''
+    def __init__(self, controller_type, device_class, bus_class,
+                 offset_from_bus_number, units, config_prefix):
+        self.controller_type = controller_type
+        self.device_class = device_class
+        self.bus_class = bus_class
+        self.offset_from_bus_number = offset_from_bus_number
+        self.units = units
+        self.config_prefix = config_prefix
+
+def controller_kind(controller_type):
+    '''
+    Return the ControllerKind of controller_type, None if this ESX doesn't
+    support it
+    '''
+    if controller_type == kv.NVME:
+        # vNVMe is in the API of ESX 6.5 and later
+        nvme = getattr(vim.vm.device, 'VirtualNVMEController', None)
+        if not nvme:
+            return None
+        # Namespaces are units 0 to 14, controller keys 31000 to 31003
+        return ControllerKind(kv.NVME, nvme, nvme, 31000,
+                              set(range(0, NVME_MAX_NAMESPACES)), 'nvme')
+    # SCSI controller keys are 1000 to 1003, unit 7 is the controller
+    return ControllerKind(kv.PVSCSI, vim.ParaVirtualSCSIController,
+                          vim.VirtualSCSIController, 1000,
+                          set(range(0, 7)) | set(range(8, PVSCSI_MAX_TARGETS)),
+                          'scsi')
+
+def controller_kind_of(controller):
+    '''Return the ControllerKind of the controller device'''
+    nvme = controller_kind(kv.NVME)
+    if nvme and isinstance(controller, nvme.device_class):
+        return nvme
+    return controller_kind(kv.PVSCSI)
+
 # Find the PCI slot number
-def get_controller_pci_slot(vm, pvscsi, key_offset):
-    ''' Return PCI slot number of the given PVSCSI controller
+def get_controller_pci_slot(vm, controller, kind):
+    ''' Return PCI slot number of the given controller
     Input parameters:
     vm: VM configuration
-    pvscsi: given PVSCSI controller
-    key_offset: offset from the bus number, controller_key - key_offset
-    is equal to the slot number of this given PVSCSI controller
+    controller: given PVSCSI or vNVMe controller
+    kind: ControllerKind of the controller, controller_key - its
+    offset_from_bus_number is the bus number of this given controller
     '''
-    if pvscsi.slotInfo:
-       return str(pvscsi.slotInfo.pciSlotNumber)
+    if controller.slotInfo:
+       return str(controller.slotInfo.pciSlotNumber)
     else:
        # Slot number is got from from the VM config
-       key = 'scsi{0}.pciSlotNumber'.format(pvscsi.key -
-                                            key_offset)
+       key = '{0}{1}.pciSlotNumber'.format(kind.config_prefix, controller.key -
+                                          kind.offset_from_bus_number)
        slot = [cfg for cfg in vm.config.extraConfig \
                if cfg.key == key]
        # If the given controller exists
@@ -1062,13 +2176,32 @@ def get_controller_pci_slot(vm, pvscsi, key_offset):
        else:
           return None
 
-def dev_info(unit_number, pci_slot_number):
-    '''Return a dictionary with Unit/Bus for the vmdk (or error)'''
-    return {'Unit': str(unit_number),
-            'ControllerPciSlotNumber': pci_slot_number}
-
-def reset_vol_meta(vmdk_path):
-    '''Clears metadata for vmdk_path'''
+def dev_info(unit_number, pci_slot_number, disk_uuid=None,
+             controller_type=kv.PVSCSI):
+    '''
+    Return a dictionary with Unit/Bus for the vmdk (or error), and the
+    UUID of the disk, which the guest sees as its WWN, for the plugin to
+    verify the device. Disks on vNVMe controllers are namespaces, their
+    namespace ID is the unit number plus one.
+    '''
+    info = {'Unit': str(unit_number),
+            'ControllerPciSlotNumber': pci_slot_number,
+            'ControllerType': controller_type}
+    if controller_type == kv.NVME:
+        info['Namespace'] = str(unit_number + 1)
+    if disk_uuid:
+        info['DiskUUID'] = disk_uuid
+    return info
+
+def get_disk_uuid(device):
+    '''Return the UUID of the disk device, None if it has none'''
+    return getattr(device.backing, 'uuid', None)
+
+def reset_vol_meta(vmdk_path, vm_uuid=None):
+    '''
+    Clears metadata for vmdk_path. For a read-only-many volume still attached
+    to other VMs only the attachment to vm_uuid is cleared.
+    '''
     vol_meta = kv.getAll(vmdk_path)
     if not vol_meta:
        vol_meta = {}
@@ -1077,9 +2210,10 @@ def reset_vol_meta(vmdk_path):
           logging.debug("Old meta-data for %s was (status=%s VM uuid=%s)",
                         vmdk_path, vol_meta[kv.STATUS],
                         vol_meta[kv.ATTACHED_VM_UUID])
-    vol_meta[kv.STATUS] = kv.DETACHED
-    vol_meta[kv.ATTACHED_VM_UUID] = None
-    vol_meta[kv.ATTACHED_VM_NAME] = None
+    if not remove_attached_vm(vol_meta, vm_uuid):
+        vol_meta[kv.STATUS] = kv.DETACHED
+        vol_meta[kv.ATTACHED_VM_UUID] = None
+        vol_meta[kv.ATTACHED_VM_NAME] = None
     if not kv.setAll(vmdk_path, vol_meta):
        msg = "Failed to save volume metadata for {0}.".format(vmdk_path)
        logging.warning("reset_vol_meta: " + msg)
@@ -1097,28 +2231,78 @@ def setStatusAttached(vmdk_path, vm, vm_dev_info=None):
     vol_meta[kv.ATTACHED_VM_NAME] = vm.config.name
     if vm_dev_info:
         vol_meta[kv.ATTACHED_VM_DEV] = vm_dev_info
+    if is_read_only_many(vol_meta):
+        attached_vms = vol_meta.get(kv.ATTACHED_VMS) or []
+        for a in attached_vms:
+            if a[kv.ATTACHED_VM_UUID] == vm.config.uuid:
+                # already attached, keep the device unless there is a new one
+                vm_dev_info = vm_dev_info or a[kv.ATTACHED_VM_DEV]
+        attached_vms = [a for a in attached_vms if a[kv.ATTACHED_VM_UUID] != vm.config.uuid]
+        attached_vms.append({kv.ATTACHED_VM_UUID: vm.config.uuid,
+                             kv.ATTACHED_VM_NAME: vm.config.name,
+                             kv.ATTACHED_VM_DEV: vm_dev_info})
+        vol_meta[kv.ATTACHED_VMS] = attached_vms
+        vol_meta[kv.ATTACHED_VM_DEV] = vm_dev_info
     if not kv.setAll(vmdk_path, vol_meta):
         logging.warning("Attach: Failed to save Disk metadata for %s", vmdk_path)
 
 
-def setStatusDetached(vmdk_path):
-    '''Sets metadata for vmdk_path to "detached"'''
-    logging.debug("Set status=detached disk=%s", vmdk_path)
+def setStatusDetached(vmdk_path, vm_uuid=None):
+    '''
+    Sets metadata for vmdk_path to "detached". A read-only-many volume stays
+    attached to the VMs other than vm_uuid.
+    '''
+    logging.debug("Set status=detached disk=%s VM uuid=%s", vmdk_path, vm_uuid)
     vol_meta = kv.getAll(vmdk_path)
     if not vol_meta:
         vol_meta = {}
-    vol_meta[kv.STATUS] = kv.DETACHED
-    # If attachedVMName is present, so is attachedVMUuid
-    try:
-        del vol_meta[kv.ATTACHED_VM_UUID]
-        del vol_meta[kv.ATTACHED_VM_NAME]
-        del vol_meta[kv.ATTACHED_VM_DEV]
-    except:
-        pass
+    if not remove_attached_vm(vol_meta, vm_uuid):
+        vol_meta[kv.STATUS] = kv.DETACHED
+        # If attachedVMName is present, so is attachedVMUuid
+        try:
+            del vol_meta[kv.ATTACHED_VM_UUID]
+            del vol_meta[kv.ATTACHED_VM_NAME]
+            del vol_meta[kv.ATTACHED_VM_DEV]
+        except:
+            pass
     if not kv.setAll(vmdk_path, vol_meta):
         logging.warning("Detach: Failed to save Disk metadata for %s", vmdk_path)
 
 
+def is_unformatted(vol_meta):
+    '''Returns True if the plugin hasn't made the filesystem of the volume yet'''
+    try:
+        return vol_meta[kv.VOL_OPTS][kv.FORMATTED] == 'false'
+    except (KeyError, TypeError):
+        return False
+
+def is_read_only_many(vol_meta):
+    '''Returns True if the volume can be attached to several VMs at once'''
+    try:
+        return vol_meta[kv.VOL_OPTS][kv.ACCESS] == kv.ACCESS_READONLY_MANY
+    except:
+        return False
+
+
+def remove_attached_vm(vol_meta, vm_uuid):
+    '''
+    Drops vm_uuid from the VMs a read-only-many volume is attached to, and
+    points the attached VM keys to one of the others. Returns True if the
+    volume is still attached to other VMs, False if it is detached now.
+    '''
+    attached_vms = [a for a in vol_meta.get(kv.ATTACHED_VMS) or []
+                    if a[kv.ATTACHED_VM_UUID] != vm_uuid]
+    if not vm_uuid or not attached_vms:
+        vol_meta.pop(kv.ATTACHED_VMS, None)
+        return False
+    vol_meta[kv.ATTACHED_VMS] = attached_vms
+    vol_meta[kv.STATUS] = kv.ATTACHED
+    vol_meta[kv.ATTACHED_VM_UUID] = attached_vms[-1][kv.ATTACHED_VM_UUID]
+    vol_meta[kv.ATTACHED_VM_NAME] = attached_vms[-1][kv.ATTACHED_VM_NAME]
+    vol_meta[kv.ATTACHED_VM_DEV] = attached_vms[-1][kv.ATTACHED_VM_DEV]
+    return True
+
+
 def getStatusAttached(vmdk_path):
     '''
     Returns (attached, uuid, attach_as, vm_name) tuple. For 'detached' status
@@ -1171,7 +2355,7 @@ def handle_stale_attach(vmdk_path, kv_uuid):
              else:
                 logging.warning("Failed to find disk %s in powered off VM - %s, resetting volume metadata\n",
                                 vmdk_path, cur_vm.config.name)
-                ret = reset_vol_meta(vmdk_path)
+                ret = reset_vol_meta(vmdk_path, kv_uuid)
                 if ret:
                    return ret
           else:
@@ -1182,75 +2366,79 @@ def handle_stale_attach(vmdk_path, kv_uuid):
        else:
           logging.warning("Failed to find VM (id %s) attaching the disk %s, resetting volume metadata",
                           kv_uuid, vmdk_path)
-          ret = reset_vol_meta(vmdk_path)
+          ret = reset_vol_meta(vmdk_path, kv_uuid)
           if ret:
              return ret
 
-def add_pvscsi_controller(vm, controllers, max_scsi_controllers, offset_from_bus_number):
+       # A read-only-many volume may still be attached to other VMs
+       attached, uuid, _, _ = getStatusAttached(vmdk_path)
+       if attached and uuid and uuid != kv_uuid:
+          return handle_stale_attach(vmdk_path, uuid)
+
+def add_controller(vm, controllers, kind):
     '''
-    Add a new PVSCSI controller, return (controller_key, err) pair
+    Add a new controller of the given kind, return (controller_key, err) pair
     '''
     # find empty bus slot for the controller:
     taken = set([c.busNumber for c in controllers])
-    avail = set(range(0, max_scsi_controllers)) - taken
+    avail = set(range(0, MAX_CONTROLLERS)) - taken
 
     key = avail.pop()  # bus slot
-    controller_key = key + offset_from_bus_number
-    disk_slot = 0
-    controller_spec = vim.VirtualDeviceConfigSpec(
-        operation='add',
-        device=vim.ParaVirtualSCSIController(key=controller_key,
-                                                busNumber=key,
-                                                sharedBus='noSharing', ), )
+    controller_key = key + kind.offset_from_bus_number
+    if kind.controller_type == kv.NVME:
+        device = kind.device_class(key=controller_key, busNumber=key)
+    else:
+        device = kind.device_class(key=controller_key, busNumber=key,
+                                   sharedBus='noSharing')
+    controller_spec = vim.VirtualDeviceConfigSpec(operation='add',
+                                                  device=device)
     # changes spec content goes here
-    pvscsi_change = []
-    pvscsi_change.append(controller_spec)
+    controller_change = []
+    controller_change.append(controller_spec)
     spec = vim.vm.ConfigSpec()
-    spec.deviceChange = pvscsi_change
+    spec.deviceChange = controller_change
 
     try:
         si = get_si()
         wait_for_tasks(si, [vm.ReconfigVM_Task(spec=spec)])
     except vim.fault.VimFault as ex:
-        msg=("Failed to add PVSCSI Controller: %s", ex.msg)
+        msg = "Failed to add {0} Controller: {1}".format(kind.controller_type, ex.msg)
         return None, err(msg)
-    logging.debug("Added a PVSCSI controller, controller_id=%d", controller_key)
+    logging.debug("Added a %s controller, controller_id=%d", kind.controller_type,
+                  controller_key)
     return controller_key, None
 
-def find_disk_slot_in_controller(vm, devices, pvsci, idx, offset_from_bus_number):
+def find_disk_slot_in_controller(vm, devices, controllers, idx, kind):
     '''
     Find an empty disk slot in the given controller, return disk_slot if an empty slot
     can be found, otherwise, return None
     '''
     disk_slot = None
-    controller_key = pvsci[idx].key
+    controller_key = controllers[idx].key
     taken = set([dev.unitNumber
              for dev in devices
              if type(dev) == vim.VirtualDisk and dev.controllerKey ==
              controller_key])
-    # search in 15 slots, with unit_number 7 reserved for scsi controller
-    avail_slots = (set(range(0, 7)) | set(range(8, PVSCSI_MAX_TARGETS))) - taken
+    avail_slots = kind.units - taken
     logging.debug("idx=%d controller_key=%d avail_slots=%d", idx, controller_key, len(avail_slots))
 
     if len(avail_slots) != 0:
         disk_slot = avail_slots.pop()
-        pci_slot_number = get_controller_pci_slot(vm, pvsci[idx],
-                                                  offset_from_bus_number)
-
         logging.debug("Find an available slot: controller_key = %d slot = %d", controller_key, disk_slot)
     else:
         logging.warning("No available slot in this controller: controller_key = %d", controller_key)
     return disk_slot
 
-def find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number):
+def find_available_disk_slot(vm, devices, controllers, kind):
     '''
-    Iterate through all the existing PVSCSI controllers attached to a VM to find an empty
-    disk slot. Return disk_slot is an empty slot can be found, otherwise, return None
+    Iterate through all the existing controllers of the given kind attached to a VM to
+    find an empty disk slot. Return disk_slot is an empty slot can be found, otherwise,
+    return None
     '''
     idx = 0
     disk_slot = None
-    while ((disk_slot is None) and (idx < len(pvsci))):
-            disk_slot = find_disk_slot_in_controller(vm, devices, pvsci, idx, offset_from_bus_number)
+    while ((disk_slot is None) and (idx < len(controllers))):
+            disk_slot = find_disk_slot_in_controller(vm, devices, controllers, idx, kind)
             if (disk_slot is None):
                 idx = idx + 1;
     return idx, disk_slot
@@ -1258,16 +2446,24 @@ def find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number):
 def disk_attach(vmdk_path, vm):
     '''
     Attaches *existing* disk to a vm on a PVSCI controller
-    (we need PVSCSI to avoid SCSI rescans in the guest)
+    (we need PVSCSI to avoid SCSI rescans in the guest), or on a vNVMe
+    controller for volumes with controller-type nvme.
     return error or unit:bus numbers of newly attached disk.
     '''
 
     kv_status_attached, kv_uuid, attach_mode, _ = getStatusAttached(vmdk_path)
+    vol_meta = kv.getAll(vmdk_path)
+    # The filesystem of a read-only-many volume is made on a persistent
+    # attach by the creating host, later attaches never write the base disk,
+    # so any number of VMs can attach it
+    shared = is_read_only_many(vol_meta) and not is_unformatted(vol_meta)
+    if shared:
+        attach_mode = kv.NONPERSISTENT
     logging.info("Attaching {0} as {1}".format(vmdk_path, attach_mode))
 
     # If the volume is attached then check if the attach is stale (VM is powered off).
     # Otherwise, detach the disk from the VM it's attached to.
-    if kv_status_attached and kv_uuid != vm.config.uuid:
+    if kv_status_attached and kv_uuid != vm.config.uuid and not shared:
        ret_err = handle_stale_attach(vmdk_path, kv_uuid)
        if ret_err:
           return ret_err
@@ -1278,15 +2474,23 @@ def disk_attach(vmdk_path, vm):
     # 0 to 15 with 7 being reserved (for older SCSI controllers).
     # It is up to the API client to add controllers as needed.
     # SCSI Controller keys are in the range of 1000 to 1003 (1000 + bus_number).
-    offset_from_bus_number = 1000
-    max_scsi_controllers = 4
-
+    controller_type = kv.DEFAULT_CONTROLLER_TYPE
+    if vol_meta and kv.VOL_OPTS in vol_meta:
+        controller_type = vol_meta[kv.VOL_OPTS].get(kv.CONTROLLER_TYPE,
+                                                    kv.DEFAULT_CONTROLLER_TYPE)
+    kind = controller_kind(controller_type)
+    if not kind:
+        msg = "Failed to attach {0} - controller type {1} is not supported on this ESX.".format(
+              vmdk_path, controller_type)
+        logging.error(msg)
+        return err(msg)
 
     devices = vm.config.hardware.device
 
-    # get all scsi controllers (pvsci, lsi logic, whatever)
+    # get all controllers sharing the bus numbers (for scsi: pvsci, lsi
+    # logic, whatever)
     controllers = [d for d in devices
-                   if isinstance(d, vim.VirtualSCSIController)]
+                   if isinstance(d, kind.bus_class)]
 
     # Check if this disk is already attached, and if it is - skip the disk
     # attach and the checks on attaching a controller if needed.
@@ -1296,54 +2500,54 @@ def disk_attach(vmdk_path, vm):
         logging.warning("Disk %s already attached. VM=%s",
                         vmdk_path, vm.config.uuid)
         setStatusAttached(vmdk_path, vm)
-        # Get that controller to which the device is configured for
-        pvsci = [d for d in controllers
-                   if type(d) == vim.ParaVirtualSCSIController and
-                      d.key == device.controllerKey]
+        # Get that controller to which the device is configured for, it
+        # may be of another type than the volume asks for
+        attached_to = [d for d in devices
+                       if isinstance(d, vim.VirtualController) and
+                          d.key == device.controllerKey]
+        attached_kind = controller_kind_of(attached_to[0])
 
         return dev_info(device.unitNumber,
-                        get_controller_pci_slot(vm, pvsci[0],
-                                                offset_from_bus_number))
+                        get_controller_pci_slot(vm, attached_to[0], attached_kind),
+                        get_disk_uuid(device), attached_kind.controller_type)
 
 
-    # Disk isn't attached, make sure we have a PVSCI and add it if we don't
-    # check if we already have a pvsci one
-    pvsci = [d for d in controllers
-             if type(d) == vim.ParaVirtualSCSIController]
+    # Disk isn't attached, make sure we have a controller of the kind and add
+    # it if we don't
+    # check if we already have one
+    kind_controllers = [d for d in controllers
+                        if type(d) == kind.device_class]
     disk_slot = None
-    if len(pvsci) > 0:
-        idx, disk_slot = find_available_disk_slot(vm, devices, pvsci, offset_from_bus_number);
+    if len(kind_controllers) > 0:
+        idx, disk_slot = find_available_disk_slot(vm, devices, kind_controllers, kind);
         if (disk_slot is not None):
-            controller_key = pvsci[idx].key
-            pci_slot_number = get_controller_pci_slot(vm, pvsci[idx],
-                                                      offset_from_bus_number)
+            controller_key = kind_controllers[idx].key
+            pci_slot_number = get_controller_pci_slot(vm, kind_controllers[idx], kind)
             logging.debug("Find an available disk slot, controller_key=%d, slot_id=%d",
                           controller_key, disk_slot)
 
     if (disk_slot is None):
         disk_slot = 0  # starting on a fresh controller
-        if len(controllers) >= max_scsi_controllers:
+        if len(controllers) >= MAX_CONTROLLERS:
             msg = "Failed to place new disk - The maximum number of supported volumes has been reached."
             logging.error(msg + " VM=%s", vm.config.uuid)
             return err(msg)
 
-        logging.info("Adding a PVSCSI controller")
+        logging.info("Adding a %s controller", kind.controller_type)
 
-        controller_key, ret_err = add_pvscsi_controller(vm, controllers, max_scsi_controllers,
-                                                        offset_from_bus_number)
+        controller_key, ret_err = add_controller(vm, controllers, kind)
 
         if (ret_err):
             return ret_err
 
         # Find the controller just added
         devices = vm.config.hardware.device
-        pvsci = [d for d in devices
-                 if type(d) == vim.ParaVirtualSCSIController and
+        added = [d for d in devices
+                 if type(d) == kind.device_class and
                  d.key == controller_key]
-        pci_slot_number = get_controller_pci_slot(vm, pvsci[0],
-                                                  offset_from_bus_number)
-        logging.info("Added a PVSCSI controller, controller_key=%d pci_slot_number=%s",
-                      controller_key, pci_slot_number)
+        pci_slot_number = get_controller_pci_slot(vm, added[0], kind)
+        logging.info("Added a %s controller, controller_key=%d pci_slot_number=%s",
+                      kind.controller_type, controller_key, pci_slot_number)
 
     # add disk as independent, so it won't be snapshotted with the Docker VM
     disk_spec = vim.VirtualDeviceConfigSpec(
@@ -1378,7 +2582,10 @@ def disk_attach(vmdk_path, vm):
                 msg += "(Current VM)"
         return err(msg)
 
-    vm_dev_info = dev_info(disk_slot, pci_slot_number)
+    device = findDeviceByPath(vmdk_path, vm)
+    vm_dev_info = dev_info(disk_slot, pci_slot_number,
+                           get_disk_uuid(device) if device else None,
+                           kind.controller_type)
 
     setStatusAttached(vmdk_path, vm, vm_dev_info)
     logging.info("Disk %s successfully attached. controller pci_slot_number=%s, disk_slot=%d",
@@ -1426,7 +2633,7 @@ def disk_detach_int(vmdk_path, vm, device):
         logging.warning("%s\n%s", msg, "".join(traceback.format_tb(ex_traceback)))
         return err(msg)
 
-    setStatusDetached(vmdk_path)
+    setStatusDetached(vmdk_path, vm.config.uuid)
     logging.info("Disk detached %s", vmdk_path)
     return None
 
@@ -1508,6 +2715,12 @@ def set_vol_opts(name, tenant_name, options):
 
     vol_meta = kv.getAll(vmdk_path)
     if vol_meta:
+       # The disk mode of read-only-many is set on attach
+       if kv.ACCESS in opts and vol_meta.get(kv.STATUS) == kv.ATTACHED and \
+          is_read_only_many(vol_meta) != (opts[kv.ACCESS] == kv.ACCESS_READONLY_MANY):
+           logging.warning("Access of attached volume %s can't be changed to or from %s",
+                           vol_name, kv.ACCESS_READONLY_MANY)
+           return False
        if not vol_meta[kv.VOL_OPTS]:
            vol_meta[kv.VOL_OPTS] = {}
        for key in opts.keys():
@@ -1776,6 +2989,17 @@ def wait_for_tasks(si, tasks):
         if pcfilter:
             pcfilter.Destroy()
 
+def wait_for_task_progress(task, report):
+    """
+    Returns after the task is complete, as wait_for_tasks(), calling
+    report(percent) while it runs
+    """
+    while task.info.state in [vim.TaskInfo.State.queued, vim.TaskInfo.State.running]:
+        report(task.info.progress or 0)
+        time.sleep(TASK_PROGRESS_INTERVAL)
+    if task.info.state == vim.TaskInfo.State.error:
+        raise task.info.error
+
 #------------------------
 
 class ValidationError(Exception):
@@ -21,6 +21,7 @@ import unittest
 import sys
 import logging
 import glob
+import json
 import os
 import os.path
 import time
@@ -348,6 +349,72 @@ class VmdkCreateCloneRemoveTestCase(unittest.TestCase):
         err = vmdk_ops.removeVMDK(self.name3)
         self.assertEqual(err, None, err)
 
+class VmdkInflateTestCase(unittest.TestCase):
+    """Unit test for VMDK inflate"""
+
+    volName = "vol_InflateTest"
+    vm_name = test_utils.generate_test_vm_name()
+
+    def setUp(self):
+        datastore = vmdk_utils.get_datastores()[0]
+        self.datastore = datastore[0]
+        path, err = vmdk_ops.get_vol_path(self.datastore, auth_data_const.DEFAULT_TENANT)
+        self.assertEqual(err, None, err)
+        self.name = vmdk_utils.get_vmdk_path(path, self.volName)
+        self.full_name = vmdk_ops.get_full_vol_name(self.volName, self.datastore)
+        err = vmdk_ops.createVMDK(vmdk_path=self.name,
+                                  vm_name=self.vm_name,
+                                  vol_name=self.volName,
+                                  opts={volume_kv.DISK_ALLOCATION_FORMAT: 'thin'})
+        self.assertEqual(err, None, err)
+
+    def tearDown(self):
+        vmdk_ops.removeVMDK(self.name)
+
+    def disk_format(self):
+        return volume_kv.getAll(self.name)[volume_kv.VOL_OPTS][volume_kv.DISK_ALLOCATION_FORMAT]
+
+    def testNotEnoughSpace(self):
+        """ A thin volume isn't inflated if the datastore can't hold it """
+        get_free_space = vmdk_utils.get_datastore_free_space
+        vmdk_utils.get_datastore_free_space = lambda datastore: 0
+        try:
+            err = vmdk_ops.inflateVMDK(self.name, self.volName, self.datastore)
+        finally:
+            vmdk_utils.get_datastore_free_space = get_free_space
+        self.assertNotEqual(err, None, err)
+        self.assertIn("Not enough free space", err[u'Error'])
+        self.assertEqual(self.disk_format(), 'thin')
+
+    def testProgress(self):
+        """ The progress is in inflate_progress while the inflate runs """
+        reported = []
+        wait_for_task_progress = vmdk_ops.wait_for_task_progress
+
+        def record_progress(task, report):
+            def record(percent):
+                report(percent)
+                reported.append(vmdk_ops.inflate_progress.get(self.full_name))
+            record(0)
+            wait_for_task_progress(task, record)
+
+        vmdk_ops.wait_for_task_progress = record_progress
+        try:
+            err = vmdk_ops.inflateVMDK(self.name, self.volName, self.datastore)
+        finally:
+            vmdk_ops.wait_for_task_progress = wait_for_task_progress
+        self.assertEqual(err, None, err)
+        self.assertTrue(reported)
+        self.assertNotIn(None, reported)
+        self.assertEqual(reported, sorted(reported))
+        self.assertNotIn(self.full_name, vmdk_ops.inflate_progress)
+        self.assertEqual(self.disk_format(), 'eagerzeroedthick')
+
+        # inflated already
+        err = vmdk_ops.inflateVMDK(self.name, self.volName, self.datastore)
+        self.assertNotEqual(err, None, err)
+
+
 class ValidationTestCase(unittest.TestCase):
     """ Test validation of -o options on create """
 
@@ -491,6 +558,77 @@ class VmdkAttachDetachTestCase(unittest.TestCase):
                                        vm=vm[0])
             self.assertTrue(ret is None)
 
+    def testAttachReadOnlyMany(self):
+        """ A read-only-many volume is attached persistent until it is formatted """
+        si = vmdk_ops.get_si()
+        vm = [d for d in si.content.rootFolder.childEntity[0].vmFolder.childEntity
+              if d.config.name == self.vm_name]
+        volName = 'VmdkAttachDetachTestVolShared'
+        fullpath = os.path.join(self.datastore_path, volName + '.vmdk')
+        self.assertEqual(None,
+                         vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                             vmdk_path=fullpath,
+                                             vol_name=volName,
+                                             opts={volume_kv.ACCESS: volume_kv.ACCESS_READONLY_MANY}))
+        opts = volume_kv.getAll(fullpath)[volume_kv.VOL_OPTS]
+        self.assertEqual(opts[volume_kv.FORMATTED], 'false')
+
+        # the create attach, for mkfs
+        ret = vmdk_ops.disk_attach(vmdk_path=fullpath, vm=vm[0])
+        self.assertFalse("Error" in ret)
+        device = vmdk_ops.findDeviceByPath(fullpath, vm[0])
+        self.assertNotEqual(device.backing.diskMode, volume_kv.NONPERSISTENT)
+        self.assertEqual(None, vmdk_ops.disk_detach(vmdk_path=fullpath, vm=vm[0]))
+
+        # the mount after the plugin recorded the filesystem
+        self.assertEqual(None, vmdk_ops.setVMDK(fullpath, volName, {volume_kv.FORMATTED: 'true'}))
+        ret = vmdk_ops.disk_attach(vmdk_path=fullpath, vm=vm[0])
+        self.assertFalse("Error" in ret)
+        device = vmdk_ops.findDeviceByPath(fullpath, vm[0])
+        self.assertEqual(device.backing.diskMode, volume_kv.NONPERSISTENT)
+        self.assertEqual(None, vmdk_ops.disk_detach(vmdk_path=fullpath, vm=vm[0]))
+
+    def testGroupSnapshotAttached(self):
+        """ A group snapshot of a volume in use, attached persistent, and a detached one """
+        si = vmdk_ops.get_si()
+        vm = [d for d in si.content.rootFolder.childEntity[0].vmFolder.childEntity
+              if d.config.name == self.vm_name]
+        group = "cg-unittest"
+        members = []
+        for volName in ['VmdkAttachDetachTestVolLive', 'VmdkAttachDetachTestVol1']:
+            fullpath = os.path.join(self.datastore_path, volName + '.vmdk')
+            members.append((vmdk_ops.get_full_vol_name(volName, self.datastore_name), fullpath,
+                            volName))
+        live_path = members[0][1]
+        self.assertEqual(None,
+                         vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                             vmdk_path=live_path,
+                                             vol_name='VmdkAttachDetachTestVolLive',
+                                             opts={volume_kv.ATTACH_AS: volume_kv.DEPENDENT}))
+        ret = vmdk_ops.disk_attach(vmdk_path=live_path, vm=vm[0])
+        self.assertFalse("Error" in ret)
+
+        self.assertEqual(None, vmdk_ops.snapshotVMDKs(group, members))
+        record_path = os.path.join(os.path.dirname(vmdk_ops.get_snapshot_path(live_path, group)),
+                                   volume_kv.SNAPSHOT_GROUP_FILE)
+        with open(record_path) as f:
+            record = json.load(f)
+        pending = record[volume_kv.SNAPSHOT_PENDING]
+        self.assertEqual(list(pending[u'Covered'].keys()), [members[0][0]])
+        self.assertEqual(None, vmdk_ops.copy_snapshot_images(group, members, record))
+
+        for _, fullpath, _ in members:
+            self.assertTrue(os.path.isfile(vmdk_ops.get_snapshot_path(fullpath, group)))
+        with open(record_path) as f:
+            self.assertFalse(volume_kv.SNAPSHOT_PENDING in json.load(f))
+        # the VM snapshot is consolidated into the volume
+        self.assertEqual(None, vmdk_ops.find_vm_snapshot(
+            vm[0].snapshot.rootSnapshotList if vm[0].snapshot else None,
+            volume_kv.SNAPSHOT_VM_NAME.format(group)))
+
+        vmdk_ops.remove_snapshot_group(group, members)
+        self.assertEqual(None, vmdk_ops.disk_detach(vmdk_path=live_path, vm=vm[0]))
+
 class VmdkAuthorizeTestCase(unittest.TestCase):
     """ Unit test for VMDK Authorization """
 
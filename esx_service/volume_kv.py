@@ -41,6 +41,9 @@ ATTACHED_VM_UUID = 'attachedVMUuid'
 ATTACHED_VM_NAME = "attachedVMName"
 # The device to which the volume is attached.
 ATTACHED_VM_DEV = "attachedVMDevice"
+# All the VMs a read-only-many volume is attached to, a list of dicts with
+# the three keys above. The keys above are for the last VM that attached it.
+ATTACHED_VMS = "attachedVMs"
 
 # Dictionary of options passed in by the user
 VOL_OPTS = 'volOpts'
@@ -73,25 +76,188 @@ ATTACH_AS = 'attach-as'
 # We support the following ones:
 INDEPENDENT = 'independent_persistent'  # does not participate in vm snashot
 DEPENDENT   = 'persistent' # does participated in VM snapshot
+NONPERSISTENT = 'independent_nonpersistent' # writes are discarded on detach
 DEFAULT_ATTACH_AS = INDEPENDENT
 ATTACH_AS_TYPES = [INDEPENDENT, DEPENDENT]
 
+# Controller the disk is attached to. vNVMe controllers need VM hardware
+# version 13. The attach reply names the controller type, and for NVMe the
+# namespace of the disk, which is its unit number plus one.
+CONTROLLER_TYPE = 'controller-type'
+PVSCSI = 'pvscsi'
+NVME = 'nvme'
+DEFAULT_CONTROLLER_TYPE = PVSCSI
+CONTROLLER_TYPES = [PVSCSI, NVME]
+
 # Access types
 ACCESS = 'access'
 ACCESS_READONLY = 'read-only'
 ACCESS_READWRITE = 'read-write'
+# read-only, attached non-persistent to any number of VMs at once
+ACCESS_READONLY_MANY = 'read-only-many'
 DEFAULT_ACCESS = ACCESS_READWRITE
-ACCESS_TYPES = [ACCESS_READWRITE, ACCESS_READONLY]
+ACCESS_TYPES = [ACCESS_READWRITE, ACCESS_READONLY, ACCESS_READONLY_MANY]
+
+# Exclusive volumes are mounted by one container at a time on the Docker host
+EXCLUSIVE = 'exclusive'
+DEFAULT_EXCLUSIVE = 'false'
+EXCLUSIVE_TYPES = ['true', 'false']
 
 # Filesystem type
 # This option is handled in the volume-plugin at the docker host, and tracked in volume metadata.
 FILESYSTEM_TYPE = 'fstype'
 DEFAULT_FILESYSTEM_TYPE = 'ext4'
 
+# Options for mkfs, handled in the volume-plugin at the docker host and
+# tracked in volume metadata.
+MKFS_OPTS = 'mkfs-opts'
+
+# Label of the filesystem created by the volume-plugin, which checks it on
+# mount. Clones keep the label of their parent.
+FS_LABEL = 'fs-label'
+
 # Clone references
 CLONE_FROM = 'clone-from' # clone volume parent
 DEFAULT_CLONE_FROM = 'None'
 
+# When the filesystem is created. Handled in the volume-plugin at the docker host.
+# "lazy" defers mkfs to the first mount of the volume.
+FORMAT = 'format'
+FORMAT_IMMEDIATE = 'immediate'
+FORMAT_LAZY = 'lazy'
+DEFAULT_FORMAT = FORMAT_IMMEDIATE
+FORMAT_TYPES = [FORMAT_IMMEDIATE, FORMAT_LAZY]
+
+# Whether the filesystem was created yet, tracked for "lazy" and
+# read-only-many volumes only. Set by the volume-plugin after the first
+# mount, or after create for read-only-many volumes.
+FORMATTED = 'formatted'
+FORMATTED_TYPES = ['true', 'false']
+
+# User labels, passed as "label.<key>=<value>" options and kept as such in
+# VOL_OPTS. Returned in volume info as LABELS dict of <key>: <value>.
+# Labels can be changed after create via the "set" command, an empty value
+# removes the label.
+LABEL_PREFIX = 'label.'
+LABELS = 'labels'
+MAX_LABEL_LEN = 128
+
+# Expiry time of the volume, UTC in EXPIRES_AT_FORMAT. Handled in the
+# volume-plugin: the plugin on the Docker host named in CREATED_HOST removes
+# the volume once it expired and is not in use.
+EXPIRES_AT = 'expires-at'
+EXPIRES_AT_FORMAT = '%Y-%m-%dT%H:%M:%SZ'
+# Creation provenance, set by the volume-plugin on create: the hostname of
+# the Docker host, the plugin version, and what the volume was created from
+# ("clone:<volume>", "seed:<source>" or "backup:<id>"), if anything.
+CREATED_HOST = 'created-host'
+CREATED_BY_PLUGIN = 'created-by-plugin'
+CREATED_FROM = 'created-from'
+PROVENANCE_OPTS = [CREATED_HOST, CREATED_BY_PLUGIN, CREATED_FROM]
+
+# Consistency group snapshots (see groupRequest() in vmdk_ops.py). The volume
+# copies of a group are kept in SNAPSHOTS_DIR/<group> in the volume folder,
+# on each datastore with a volume in the group, together with the group
+# record in SNAPSHOT_GROUP_FILE.
+SNAPSHOTS_DIR = '.snapshots'
+SNAPSHOT_GROUP_FILE = 'group.json'
+# Comma separated full names of the volumes to snapshot
+SNAPSHOT_VOLUMES = 'volumes'
+# "snapshot" only takes a point-in-time image of each volume, while the
+# plugin has the volumes frozen. The plugin then sends "snapshot" with
+# SNAPSHOT_COPY "true" to copy the images. Until then the group record has
+# SNAPSHOT_PENDING, with the image of each volume and the VMs snapshotted
+# (as SNAPSHOT_VM_NAME) for them.
+SNAPSHOT_COPY = 'copy'
+SNAPSHOT_PENDING = 'Pending'
+SNAPSHOT_VM_NAME = 'docker-volume-snapshot-{0}'
+
+# Scheduled snapshots, "<interval>[;keep=<count>]" with the interval hourly,
+# daily, weekly, or <n>m or <n>h. Run by the volume-plugin on the Docker host
+# which has the volume mounted, which records the schedule state in the
+# SNAPSHOT_LAST_RUN, SNAPSHOT_NEXT_RUN (UTC in EXPIRES_AT_FORMAT) and
+# SNAPSHOT_LAST_ERROR options.
+SNAPSHOT_SCHEDULE = 'snapshot-schedule'
+SNAPSHOT_SCHEDULE_PATTERN = r'^(hourly|daily|weekly|[1-9][0-9]*[mh])(;keep=[1-9][0-9]*)?$'
+SNAPSHOT_LAST_RUN = 'snapshot-last-run'
+SNAPSHOT_NEXT_RUN = 'snapshot-next-run'
+SNAPSHOT_LAST_ERROR = 'snapshot-last-error'
+# Schedule state in volume info, see snapshot_schedule_state() in vmdk_ops.py
+SNAPSHOT_SCHEDULE_STATE = 'snapshot-schedule-state'
+# A schedule is overdue when its next run is late by this long
+SNAPSHOT_OVERDUE_SECS = 30 * 60
+
+# Replication of the volume to another datastore. The volume-plugin on the
+# Docker host which has the volume mounted periodically snapshots the volume
+# and ESX copies the snapshot to REPLICAS_DIR/<volume>.vmdk in the volume
+# folder of the REPLICATE_TO datastore, with a REPLICA_FILE_SUFFIX record of
+# the source volume. The plugin records REPLICA_LAST_SYNC (UTC in
+# EXPIRES_AT_FORMAT) and REPLICA_LAST_ERROR. "promote" turns a replica into
+# a volume on its datastore, recording the source as PROMOTED_FROM.
+REPLICATE_TO = 'replicate-to'
+REPLICAS_DIR = '.replicas'
+REPLICA_FILE_SUFFIX = '.json'
+REPLICA_LAST_SYNC = 'replica-last-sync'
+REPLICA_LAST_ERROR = 'replica-last-error'
+# Minutes since REPLICA_LAST_SYNC, in volume info
+REPLICA_LAG_MINUTES = 'replica-lag-minutes'
+PROMOTED_FROM = 'promoted-from'
+
+# "move" relocates a volume with its metadata to another datastore, recording
+# the full name it had as MOVED_FROM
+MOVED_FROM = 'moved-from'
+
+# Automatic growth, "<n>%;step=<size>;max=<size>". The volume-plugin on the
+# Docker host which has the volume mounted extends the volume by step when
+# the filesystem usage crosses n percent, up to max, and records the growth
+# in AUTOGROW_LAST_GROW ("<UTC in EXPIRES_AT_FORMAT> <old>mb-><new>mb"),
+# AUTOGROW_GROWS (count) and AUTOGROW_LAST_ERROR.
+AUTOGROW = 'autogrow'
+AUTOGROW_PATTERN = r'^([1-9][0-9]?)%;step=([1-9][0-9]*[mgt]b);max=([1-9][0-9]*[mgt]b)$'
+AUTOGROW_LAST_GROW = 'autogrow-last-grow'
+AUTOGROW_GROWS = 'autogrow-grows'
+AUTOGROW_LAST_ERROR = 'autogrow-last-error'
+
+# Filesystem check before the mount, handled in the volume-plugin at the
+# Docker host, which uses its own policy for volumes without FSCK_POLICY. The
+# volume-plugin records the result of the last check in FSCK_LAST_RESULT
+# and its time in FSCK_LAST_RUN (UTC in EXPIRES_AT_FORMAT).
+FSCK_POLICY = 'fsck-policy'
+FSCK_POLICY_TYPES = ['never', 'auto', 'force', 'refuse-on-error']
+FSCK_LAST_RESULT = 'fsck-last-result'
+FSCK_LAST_RUN = 'fsck-last-run'
+
+# Background trim, handled in the volume-plugin at the Docker host which has
+# the volume mounted. TRIM 'false' opts the volume out. The volume-plugin
+# records the time of the last trim in TRIM_LAST_RUN (UTC in
+# EXPIRES_AT_FORMAT) and the bytes trimmed in TRIM_LAST_BYTES.
+TRIM = 'trim'
+DEFAULT_TRIM = 'true'
+TRIM_TYPES = ['true', 'false']
+TRIM_LAST_RUN = 'trim-last-run'
+TRIM_LAST_BYTES = 'trim-last-bytes'
+
+# Options the volume-plugin may change after create (via the "set" command),
+# and their valid values, None for options validated in setVMDK()
+PLUGIN_SETTABLE_OPTS = {
+    FORMATTED: FORMATTED_TYPES,
+    SNAPSHOT_SCHEDULE: None,
+    SNAPSHOT_LAST_RUN: None,
+    SNAPSHOT_NEXT_RUN: None,
+    SNAPSHOT_LAST_ERROR: None,
+    REPLICATE_TO: None,
+    REPLICA_LAST_SYNC: None,
+    REPLICA_LAST_ERROR: None,
+    AUTOGROW: None,
+    AUTOGROW_LAST_GROW: None,
+    AUTOGROW_GROWS: None,
+    AUTOGROW_LAST_ERROR: None,
+    FSCK_LAST_RESULT: None,
+    FSCK_LAST_RUN: None,
+    TRIM_LAST_RUN: None,
+    TRIM_LAST_BYTES: None
+}
+
 # Create a kv store object for this volume identified by vol_path
 # Create the side car or open if it exists.
 def init():
@@ -176,3 +342,6 @@ def remove(vol_path, key):
 
 def get_vol_info(vol_path):
    return kvESX.get_info(vol_path)
+
+def get_vol_size_bytes(vol_path):
+   return kvESX.get_size_bytes(vol_path)
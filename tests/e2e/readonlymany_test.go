@@ -0,0 +1,80 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This test suite verifies read-only-many volumes, which several VMs can
+// mount at once
+
+package e2e
+
+import (
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/vmware/docker-volume-vsphere/tests/utils/dockercli"
+	"github.com/vmware/docker-volume-vsphere/tests/utils/inputparams"
+)
+
+type ReadOnlyManyTestSuite struct {
+	volumeName    string
+	containerName string
+}
+
+func (s *ReadOnlyManyTestSuite) SetUpTest(c *C) {
+	s.volumeName = inputparams.GetVolumeNameWithTimeStamp("rom_test")
+	s.containerName = inputparams.GetContainerNameWithTimeStamp("rom_test")
+}
+
+var _ = Suite(&ReadOnlyManyTestSuite{})
+
+// Test that the filesystem made when a read-only-many volume is created,
+// or on its first mount with format=lazy, is kept.
+//
+// Test steps, for each format:
+// 1. Create a read-only-many volume from VM1
+// 2. Mount the volume in a container on VM1
+// 3. Remove the container
+// 4. Mount the volume in containers on VM1 and VM2 at once
+// 5. Remove the containers and the volume
+func (s *ReadOnlyManyTestSuite) TestCreateAndMount(c *C) {
+	log.Printf("START: readonlymany-test.TestCreateAndMount")
+
+	vm1, vm2 := os.Getenv("VM1"), os.Getenv("VM2")
+	for _, format := range []string{"immediate", "lazy"} {
+		volumeName := s.volumeName + "_" + format
+		out, err := dockercli.CreateVolumeWithOptions(vm1, volumeName, "-o access=read-only-many -o format="+format)
+		c.Assert(err, IsNil, Commentf(out))
+
+		out, err = dockercli.AttachVolume(vm1, volumeName, s.containerName)
+		c.Assert(err, IsNil, Commentf(out))
+		out, err = dockercli.RemoveContainer(vm1, s.containerName)
+		c.Assert(err, IsNil, Commentf(out))
+
+		// the shared attaches find the filesystem
+		for _, host := range []string{vm1, vm2} {
+			out, err = dockercli.AttachVolume(host, volumeName, s.containerName)
+			c.Assert(err, IsNil, Commentf(out))
+		}
+		for _, host := range []string{vm1, vm2} {
+			out, err = dockercli.RemoveContainer(host, s.containerName)
+			c.Assert(err, IsNil, Commentf(out))
+		}
+
+		out, err = dockercli.DeleteVolume(vm1, volumeName)
+		c.Assert(err, IsNil, Commentf(out))
+	}
+
+	log.Printf("END: readonlymany-test.TestCreateAndMount")
+}
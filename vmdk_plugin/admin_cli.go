@@ -0,0 +1,510 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+//
+// Plugin CLI.
+//
+// Operations which are not part of the Docker VolumeDriver API are run as
+//   docker-volume-vsphere [plugin flags] <command> [command flags] [args]
+// The CLI sends the command to the running plugin over the plugin unix
+// socket (adminPath), and the plugin runs it in the driver (see Admin() in
+// drivers/vmdk/admin.go). The request format follows the one used between
+// the plugin and ESX: a command, a volume name and options.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+)
+
+const (
+	adminPath        = "/Vsphere.Admin"
+	adminContentType = "application/json"
+
+	progressInterval = 2 * time.Second // of copy, inflate and move
+)
+
+// adminDriver is implemented by drivers which serve plugin CLI commands
+type adminDriver interface {
+	Admin(cmd string, name string, opts map[string]string) (interface{}, error)
+}
+
+// A plugin CLI request
+type adminRequest struct {
+	Cmd  string
+	Name string            `json:",omitempty"`
+	Opts map[string]string `json:",omitempty"`
+}
+
+// A plugin CLI response, Result depends on the command
+type adminResponse struct {
+	Err    string          `json:",omitempty"`
+	Result json.RawMessage `json:",omitempty"`
+}
+
+// adminCommand describes a plugin CLI command
+type adminCommand struct {
+	usage string
+	run   func(socket string, args []string) error
+}
+
+var adminCommands = map[string]adminCommand{
+	"ls": {
+		usage: "ls [-label key[=value]]...  List volumes, optionally only those with the given labels",
+		run:   runList,
+	},
+	"label": {
+		usage: "label VOLUME key=value|key-...  Set (key=value) or remove (key-) volume labels",
+		run:   runLabel,
+	},
+	"backup": {
+		usage: "backup -repo DIR VOLUME  Back up the files of a volume into a backup repository",
+		run:   runBackup,
+	},
+	"restore": {
+		usage: "restore -repo DIR BACKUP VOLUME  Create a new volume from a backup",
+		run:   runRestore,
+	},
+	"snapshot": {
+		usage: "snapshot VOLUME...  Snapshot volumes together as a consistency group, prints the group ID",
+		run:   runSnapshot,
+	},
+	"snapshots": {
+		usage: "snapshots  List snapshot groups",
+		run:   runSnapshots,
+	},
+	"revert": {
+		usage: "revert GROUP  Revert the volumes of a snapshot group, they must not be in use",
+		run:   runRevert,
+	},
+	"rmsnapshot": {
+		usage: "rmsnapshot GROUP  Remove the snapshots of a snapshot group",
+		run:   runRemoveSnapshot,
+	},
+	"schedule": {
+		usage: "schedule VOLUME [SCHEDULE]  Set the snapshot schedule of a volume, e.g. hourly;keep=24, or remove it",
+		run:   runSchedule,
+	},
+	"replicate": {
+		usage: "replicate VOLUME [DATASTORE]  Replicate a volume to another datastore, or stop replicating it",
+		run:   runReplicate,
+	},
+	"autogrow": {
+		usage: "autogrow VOLUME [POLICY]  Set the autogrow policy of a volume, e.g. 85%;step=10gb;max=200gb, or remove it",
+		run:   runAutogrow,
+	},
+	"promote": {
+		usage: "promote VOLUME@DATASTORE  Turn the replica of a volume on DATASTORE into a volume",
+		run:   runPromote,
+	},
+	"copy": {
+		usage: "copy [-live] SOURCE TARGET  Copy the files of a volume into another volume",
+		run:   runCopy,
+	},
+	"inflate": {
+		usage: "inflate VOLUME  Convert a detached volume to diskformat eagerzeroedthick",
+		run:   runInflate,
+	},
+	"move": {
+		usage: "move VOLUME DATASTORE  Move a detached volume to another datastore",
+		run:   runMove,
+	},
+}
+
+// registerAdminHandler serves plugin CLI requests, if the driver supports them
+func registerAdminHandler(handler *volume.Handler, driver volume.Driver) {
+	admin, ok := driver.(adminDriver)
+	if !ok {
+		return
+	}
+	handler.HandleFunc(adminPath, func(w http.ResponseWriter, r *http.Request) {
+		var req adminRequest
+		var resp adminResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			resp.Err = fmt.Sprintf("Failed to decode request: %v", err)
+		} else if result, err := admin.Admin(req.Cmd, req.Name, req.Opts); err != nil {
+			resp.Err = err.Error()
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Err = fmt.Sprintf("Failed to encode result: %v", err)
+		}
+		if resp.Err != "" {
+			log.WithFields(log.Fields{"cmd": req.Cmd, "name": req.Name, "error": resp.Err}).Error("Admin command failed ")
+		}
+		w.Header().Set("Content-Type", adminContentType)
+		json.NewEncoder(w).Encode(&resp)
+	})
+}
+
+// runAdminCommand runs a plugin CLI command, returns the exit code
+func runAdminCommand(socket string, args []string) int {
+	switch args[0] {
+	case "help", "-h", "--help":
+		fmt.Println("Commands:")
+		printAdminUsage(os.Stdout)
+		return 0
+	}
+	command, exists := adminCommands[args[0]]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "Unknown command %s. Commands:\n", args[0])
+		printAdminUsage(os.Stderr)
+		return 2
+	}
+	if err := command.run(socket, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// printAdminUsage prints the usage of the plugin CLI commands, sorted by
+// command name
+func printAdminUsage(w io.Writer) {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", adminCommands[name].usage)
+	}
+}
+
+// sendAdminRequest sends a command to the plugin and decodes the result
+// into result (if not nil)
+func sendAdminRequest(socket string, req adminRequest, result interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(proto, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	r, err := client.Post("http://plugin"+adminPath, adminContentType, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to talk to the plugin at %s: %v", socket, err)
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	var resp adminResponse
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return fmt.Errorf("Unexpected reply from the plugin (%v): %s", err, data)
+	}
+	if resp.Err != "" {
+		return fmt.Errorf("%s", resp.Err)
+	}
+	if result != nil && len(resp.Result) != 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// labelFilters collects repeated -label key[=value] flags
+type labelFilters map[string]string
+
+func (f labelFilters) String() string {
+	return vmdk.FormatLabels(f)
+}
+
+func (f labelFilters) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if kv[0] == "" {
+		return fmt.Errorf("empty label key")
+	}
+	if len(kv) == 1 {
+		f[kv[0]] = ""
+	} else {
+		f[kv[0]] = kv[1]
+	}
+	return nil
+}
+
+func runList(socket string, args []string) error {
+	filters := make(labelFilters)
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.Var(filters, "label", "Only list volumes with this label, key or key=value (can be repeated)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var volumes []vmdk.VolumeSummary
+	err := sendAdminRequest(socket, adminRequest{Cmd: "ls", Opts: filters}, &volumes)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tLABELS")
+	for _, vol := range volumes {
+		fmt.Fprintf(w, "%s\t%s\n", vol.Name, vmdk.FormatLabels(vol.Labels))
+	}
+	return w.Flush()
+}
+
+func runLabel(socket string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("Expected a volume name and at least one label")
+	}
+	labels := make(map[string]string)
+	for _, arg := range args[1:] {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			labels[strings.TrimSuffix(arg, "-")] = "" // empty value removes the label
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid label %s, expected key=value or key-", arg)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "label", Name: args[0], Opts: labels}, nil)
+}
+
+func runBackup(socket string, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Backup repository directory, created if needed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *repo == "" || flags.NArg() != 1 {
+		return fmt.Errorf("Expected -repo and a volume name")
+	}
+
+	var result vmdk.BackupResult
+	err := sendAdminRequest(socket, adminRequest{Cmd: "backup", Name: flags.Arg(0),
+		Opts: map[string]string{"repo": *repo}}, &result)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backup %s: %d files, %d bytes, %d new bytes\n", result.ID,
+		result.Stats.Files, result.Stats.Bytes, result.Stats.NewBytes)
+	return nil
+}
+
+func runRestore(socket string, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Backup repository directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *repo == "" || flags.NArg() != 2 {
+		return fmt.Errorf("Expected -repo, a backup ID and a new volume name")
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "restore", Name: flags.Arg(1),
+		Opts: map[string]string{"repo": *repo, "backup": flags.Arg(0)}}, nil)
+}
+
+func runSnapshot(socket string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Expected at least one volume name")
+	}
+	var group string
+	err := sendAdminRequest(socket, adminRequest{Cmd: "snapshot",
+		Opts: map[string]string{"volumes": strings.Join(args, ",")}}, &group)
+	if err != nil {
+		return err
+	}
+	fmt.Println(group)
+	return nil
+}
+
+func runSnapshots(socket string, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("Unexpected arguments %v", args)
+	}
+	var groups []vmdkops.SnapshotGroup
+	if err := sendAdminRequest(socket, adminRequest{Cmd: "snapshots"}, &groups); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tCREATED\tVOLUMES")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", g.Group, g.Created, strings.Join(g.Volumes, ","))
+	}
+	return w.Flush()
+}
+
+func runRevert(socket string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a snapshot group ID")
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "revert", Name: args[0]}, nil)
+}
+
+func runRemoveSnapshot(socket string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a snapshot group ID")
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "rmsnapshot", Name: args[0]}, nil)
+}
+
+func runSchedule(socket string, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Expected a volume name and optionally a snapshot schedule")
+	}
+	schedule := ""
+	if len(args) == 2 {
+		schedule = args[1]
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "schedule", Name: args[0],
+		Opts: map[string]string{"snapshot-schedule": schedule}}, nil)
+}
+
+func runReplicate(socket string, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Expected a volume name and optionally a datastore")
+	}
+	datastore := ""
+	if len(args) == 2 {
+		datastore = args[1]
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "replicate", Name: args[0],
+		Opts: map[string]string{"replicate-to": datastore}}, nil)
+}
+
+func runAutogrow(socket string, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Expected a volume name and optionally an autogrow policy")
+	}
+	policy := ""
+	if len(args) == 2 {
+		policy = args[1]
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "autogrow", Name: args[0],
+		Opts: map[string]string{"autogrow": policy}}, nil)
+}
+
+func runPromote(socket string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected volume@datastore of the replica")
+	}
+	return sendAdminRequest(socket, adminRequest{Cmd: "promote", Name: args[0]}, nil)
+}
+
+func runCopy(socket string, args []string) error {
+	flags := flag.NewFlagSet("copy", flag.ContinueOnError)
+	live := flags.Bool("live", false, "Copy the source even if it is attached read-write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("Expected a source and a target volume")
+	}
+	source, target := flags.Arg(0), flags.Arg(1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sendAdminRequest(socket, adminRequest{Cmd: "copy", Name: source,
+			Opts: map[string]string{"target": target, "live": fmt.Sprint(*live)}}, nil)
+	}()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case err := <-done:
+			if reported {
+				fmt.Fprintln(os.Stderr)
+			}
+			return err
+		case <-ticker.C:
+			var progress vmdk.CopyProgress
+			if sendAdminRequest(socket, adminRequest{Cmd: "copystatus", Name: target}, &progress) == nil {
+				fmt.Fprintf(os.Stderr, "\r%d of %d MB copied", progress.Done>>20, progress.Total>>20)
+				reported = true
+			}
+		}
+	}
+}
+
+func runInflate(socket string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Expected a volume name")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- sendAdminRequest(socket, adminRequest{Cmd: "inflate", Name: args[0]}, nil)
+	}()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case err := <-done:
+			if reported {
+				fmt.Fprintln(os.Stderr)
+			}
+			return err
+		case <-ticker.C:
+			var progress vmdk.InflateProgress
+			if sendAdminRequest(socket, adminRequest{Cmd: "inflatestatus", Name: args[0]}, &progress) == nil {
+				fmt.Fprintf(os.Stderr, "\r%s: %d%% inflated", progress.Name, progress.Percent)
+				reported = true
+			}
+		}
+	}
+}
+
+func runMove(socket string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("Expected a volume name and a datastore")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- sendAdminRequest(socket, adminRequest{Cmd: "move", Name: args[0],
+			Opts: map[string]string{"target": args[1]}}, nil)
+	}()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case err := <-done:
+			if reported {
+				fmt.Fprintln(os.Stderr)
+			}
+			return err
+		case <-ticker.C:
+			var progress vmdk.MoveProgress
+			if sendAdminRequest(socket, adminRequest{Cmd: "movestatus", Name: args[0]}, &progress) == nil {
+				fmt.Fprintf(os.Stderr, "\r%s: %d%% moved", progress.Name, progress.Percent)
+				reported = true
+			}
+		}
+	}
+}
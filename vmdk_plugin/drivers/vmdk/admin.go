@@ -0,0 +1,224 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Admin commands for the plugin CLI.
+//
+// Docker only knows about the VolumeDriver API, operations beyond it are
+// sent by the plugin CLI (see ../../admin_cli.go) to the running plugin and
+// served here, in the plugin process, so they share state (refcounts,
+// mounts) with the Docker requests.
+//
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const (
+	labelOptPrefix = "label." // user labels are kept as label.<key> options
+	labelsKey      = "labels" // labels in Get status
+)
+
+// VolumeSummary is returned by the "ls" admin command
+type VolumeSummary struct {
+	Name   string
+	Labels map[string]string
+}
+
+// Admin runs an admin command from the plugin CLI.
+// Returns the command result to be sent back to the CLI, or an error.
+func (d *VolumeDriver) Admin(cmd string, name string, opts map[string]string) (interface{}, error) {
+	log.WithFields(log.Fields{"cmd": cmd, "name": name, "opts": opts}).Info("Admin command ")
+	switch cmd {
+	case "ls":
+		return d.listVolumes(opts)
+	case "label":
+		return nil, d.setLabels(name, opts)
+	case "backup":
+		return d.backupVolume(name, opts[backupRepoOpt])
+	case "restore":
+		return nil, d.restoreVolume(name, opts[backupRepoOpt], opts[backupIDOpt])
+	case "snapshot":
+		return d.snapshotVolumes(strings.Split(opts[snapshotVolumesOpt], ","))
+	case "snapshots":
+		return d.listSnapshots()
+	case "revert":
+		return nil, d.revertSnapshot(name)
+	case "rmsnapshot":
+		return nil, d.removeSnapshot(name)
+	case "schedule":
+		return nil, d.setSnapshotSchedule(name, opts[snapshotScheduleOpt])
+	case "replicate":
+		return nil, d.setReplicateTo(name, opts[replicateToOpt])
+	case "promote":
+		return nil, d.promoteReplica(name)
+	case "copy":
+		return nil, d.copyVolume(name, opts[copyTargetOpt], opts[copyLiveOpt] == "true")
+	case "copystatus":
+		return d.copies.get(name)
+	case "autogrow":
+		return nil, d.setAutogrow(name, opts[autogrowOpt])
+	case "inflate":
+		return nil, d.inflateVolume(name)
+	case "inflatestatus":
+		return d.inflateStatus(name)
+	case "move":
+		return nil, d.moveVolume(name, opts[moveTargetOpt])
+	case "movestatus":
+		return d.moveStatus(name)
+	}
+	return nil, fmt.Errorf("Unknown command: %s", cmd)
+}
+
+// listVolumes returns volumes with all the labels given in filters.
+// A filter "key" matches any value, "key=value" only the given value.
+func (d *VolumeDriver) listVolumes(filters map[string]string) ([]VolumeSummary, error) {
+	volumes, err := d.ops.List()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]VolumeSummary, 0, len(volumes))
+	for _, vol := range volumes {
+		if matchLabels(vol.Attributes, filters) {
+			result = append(result, VolumeSummary{Name: vol.Name, Labels: vol.Attributes})
+		}
+	}
+	sort.Sort(byName(result))
+	return result, nil
+}
+
+// byName sorts volume summaries by volume name
+type byName []VolumeSummary
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// matchLabels checks labels against filters of key -> value, an empty
+// value matches any value
+func matchLabels(labels map[string]string, filters map[string]string) bool {
+	for key, value := range filters {
+		labelValue, exists := labels[key]
+		if !exists || (value != "" && value != labelValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// setLabels sets labels of key -> value on the volume, an empty value
+// removes the label
+func (d *VolumeDriver) setLabels(name string, labels map[string]string) error {
+	if len(labels) == 0 {
+		return fmt.Errorf("No labels given for volume %s", name)
+	}
+	opts := make(map[string]string)
+	for key, value := range labels {
+		opts[labelOptPrefix+key] = value
+	}
+	return d.ops.Set(name, opts)
+}
+
+// adminMount mounts a volume for an admin command through the refcounted
+// path, as a container would. Docker mounts of the volume are refused until
+// adminUnmount(), so no container gets the admin mount. For readOnly a
+// volume in use is not mounted again, its mountpoint is reused; otherwise
+// the volume is mounted read-only. A read-write mount needs a volume not in
+// use here. Returns the mountpoint and full volume name.
+func (d *VolumeDriver) adminMount(name string, cmd string, readOnly bool) (string, string, error) {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+
+	if d.refCounts.GetInitSuccess() != true {
+		return "", "", fmt.Errorf("Volume usage is not known yet, retry later")
+	}
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return "", "", err
+	}
+	name = volumeInfo.VolumeName
+	if other, exists := d.adminMounts[name]; exists {
+		return "", "", fmt.Errorf("Volume %s is busy with %s", name, other)
+	}
+
+	if d.incrRefCount(name) > 1 {
+		if readOnly {
+			log.WithFields(log.Fields{"name": name, "cmd": cmd}).Info("Volume in use, reusing its mountpoint ")
+			return getMountPoint(name), name, nil
+		}
+		d.decrRefCount(name)
+		return "", "", fmt.Errorf("Volume %s is in use", name)
+	}
+	meta := volumeInfo.VolumeMeta
+	if meta == nil {
+		meta, err = d.ops.Get(name)
+	}
+	if err == nil && !readOnly && plugin_utils.IsReadOnlyAccess(meta["access"]) {
+		err = fmt.Errorf("Volume %s is read-only", name)
+	}
+	device := ""
+	if err == nil {
+		fstype, exists := meta["fstype"].(string)
+		if !exists {
+			fstype = fs.FstypeDefault
+		}
+		// a "format=lazy" volume gets its filesystem on the first write mount
+		formatIfBlank := !readOnly && meta[formattedOpt] == "false"
+		var mountpoint string
+		mountpoint, device, err = d.mountVolume(name, fstype, readOnly, formatIfBlank)
+		if err == nil {
+			d.adminMounts[name] = cmd
+			return mountpoint, name, nil
+		}
+	}
+	log.WithFields(log.Fields{"name": name, "cmd": cmd, "error": err}).Error("Failed to mount ")
+	if refcnt, _ := d.decrRefCount(name); refcnt == 0 {
+		d.releaseAndDetach(name, device)
+	}
+	return "", "", err
+}
+
+// adminUnmount drops the mount reference taken by adminMount. The volume
+// is unmounted and detached if nobody else uses it.
+func (d *VolumeDriver) adminUnmount(name string) {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+
+	delete(d.adminMounts, name)
+	refcnt, err := d.decrRefCount(name)
+	if err != nil || refcnt != 0 {
+		return
+	}
+	if err = d.UnmountVolume(name); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to unmount ")
+	}
+}
+
+// FormatLabels returns labels as a sorted "key=value,..." string
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Asynchronous volume create.
+//
+// Creating a large eagerzeroedthick volume can take longer than the Docker
+// plugin request timeout. With "-o async=true" Create only validates the
+// request and queues it. A single background worker then runs the usual
+// create steps (see createVolume()). Until the create is done Get reports
+// the volume as "creating" with its progress, and Mount fails right away.
+// Failing fast matters: Mount holds the refcount state lock, so waiting
+// there would block mounts of all other volumes.
+//
+// A failed async create stays visible (state "failed") until Docker
+// removes the volume.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	asyncCreateOpt      = "async" // Create option, plugin side only
+	asyncCreateQueueLen = 64      // creates waiting for the worker
+
+	asyncStateCreating = "creating"
+	asyncStateFailed   = "failed"
+)
+
+// createSteps lists create steps in order, to report progress
+var createSteps = []createStep{
+	createStepRequested,
+	createStepCreated,
+	createStepAttached,
+	createStepFormatted,
+}
+
+// asyncCreate is a create request accepted but not finished yet
+type asyncCreate struct {
+	name    string
+	opts    map[string]string
+	mkfscmd string
+	state   string
+	step    createStep
+	started time.Time
+	err     error
+}
+
+// asyncCreates tracks asynchronous creates and feeds them to the worker
+type asyncCreates struct {
+	mtx     sync.Mutex
+	volumes map[string]*asyncCreate // volume name -> create in progress
+	queue   chan *asyncCreate
+}
+
+func newAsyncCreates() *asyncCreates {
+	return &asyncCreates{
+		volumes: make(map[string]*asyncCreate),
+		queue:   make(chan *asyncCreate, asyncCreateQueueLen),
+	}
+}
+
+// isAsyncCreate checks the async create option, and removes it from
+// opts since ESX does not know about it
+func isAsyncCreate(opts map[string]string) (bool, error) {
+	value, exists := opts[asyncCreateOpt]
+	if !exists {
+		return false, nil
+	}
+	delete(opts, asyncCreateOpt)
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value '%s' for option %s, expected true or false", value, asyncCreateOpt)
+	}
+	return async, nil
+}
+
+// add queues a create for the worker
+func (a *asyncCreates) add(name string, opts map[string]string, mkfscmd string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if _, exists := a.volumes[name]; exists {
+		return fmt.Errorf("Volume %s is already being created", name)
+	}
+	c := &asyncCreate{
+		name:    name,
+		opts:    opts,
+		mkfscmd: mkfscmd,
+		state:   asyncStateCreating,
+		step:    createStepRequested,
+		started: time.Now(),
+	}
+	select {
+	case a.queue <- c:
+		a.volumes[name] = c
+		return nil
+	default:
+		return fmt.Errorf("Too many volume creates in progress, retry later")
+	}
+}
+
+// setStep records the progress of an async create, if there is one
+func (a *asyncCreates) setStep(name string, step createStep) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if c, exists := a.volumes[name]; exists {
+		c.step = step
+	}
+}
+
+// done ends an async create, a failed one is kept until removed
+func (a *asyncCreates) done(name string, err error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err == nil {
+		delete(a.volumes, name)
+		return
+	}
+	if c, exists := a.volumes[name]; exists {
+		c.state = asyncStateFailed
+		c.err = err
+	}
+}
+
+// status returns the Get status of an unfinished create, or nil if
+// there is no async create for the volume
+func (a *asyncCreates) status(name string) map[string]interface{} {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	c, exists := a.volumes[name]
+	if !exists {
+		return nil
+	}
+	status := map[string]interface{}{
+		"state":   c.state,
+		"started": c.started.Format(time.RFC3339),
+		"fstype":  c.opts["fstype"],
+	}
+	if c.err != nil {
+		status["error"] = c.err.Error()
+	} else {
+		status["progress"] = progress(c.step)
+	}
+	return status
+}
+
+// checkReady returns an error if the volume has an unfinished create
+func (a *asyncCreates) checkReady(name string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	c, exists := a.volumes[name]
+	if !exists {
+		return nil
+	}
+	if c.err != nil {
+		return fmt.Errorf("Volume %s is not usable, create failed: %v", name, c.err)
+	}
+	return fmt.Errorf("Volume %s is not ready yet, create in progress: %s", name, progress(c.step))
+}
+
+// forget drops a failed create. Returns an error if the create is
+// still running.
+func (a *asyncCreates) forget(name string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	c, exists := a.volumes[name]
+	if !exists {
+		return nil
+	}
+	if c.err == nil {
+		return fmt.Errorf("Volume %s is still being created: %s", name, progress(c.step))
+	}
+	delete(a.volumes, name)
+	return nil
+}
+
+// progress formats a create step as "step (n/total)"
+func progress(step createStep) string {
+	for i, s := range createSteps {
+		if s == step {
+			return fmt.Sprintf("%s (%d/%d)", step, i+1, len(createSteps))
+		}
+	}
+	return string(step)
+}
+
+// asyncCreateWorker runs queued creates one at a time, forever
+func (d *VolumeDriver) asyncCreateWorker() {
+	for c := range d.async.queue {
+		log.WithFields(log.Fields{"name": c.name,
+			"queued": time.Since(c.started)}).Info("Starting asynchronous create ")
+		err := d.createVolume(c.name, c.opts, c.mkfscmd)
+		d.async.done(c.name, err)
+		if err != nil {
+			log.WithFields(log.Fields{"name": c.name, "error": err}).Error("Asynchronous create failed ")
+		}
+	}
+}
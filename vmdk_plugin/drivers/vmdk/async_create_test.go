@@ -0,0 +1,69 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test async create bookkeeping, without running the worker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsAsyncCreate(t *testing.T) {
+	opts := map[string]string{"size": "1gb", asyncCreateOpt: "true"}
+	async, err := isAsyncCreate(opts)
+	assert.Nil(t, err)
+	assert.True(t, async)
+	assert.Equal(t, map[string]string{"size": "1gb"}, opts)
+
+	async, err = isAsyncCreate(opts)
+	assert.Nil(t, err)
+	assert.False(t, async)
+
+	_, err = isAsyncCreate(map[string]string{asyncCreateOpt: "maybe"})
+	assert.NotNil(t, err)
+}
+
+func TestAsyncCreates(t *testing.T) {
+	a := newAsyncCreates()
+	assert.Nil(t, a.status("vol1"))
+	assert.Nil(t, a.checkReady("vol1"))
+
+	assert.Nil(t, a.add("vol1", map[string]string{"fstype": "ext4"}, "/sbin/mkfs.ext4"))
+	assert.NotNil(t, a.add("vol1", map[string]string{}, "/sbin/mkfs.ext4"))
+	assert.Equal(t, 1, len(a.queue))
+
+	a.setStep("vol1", createStepAttached)
+	status := a.status("vol1")
+	assert.Equal(t, asyncStateCreating, status["state"])
+	assert.Equal(t, "attached (3/4)", status["progress"])
+	assert.NotNil(t, a.checkReady("vol1"))
+	assert.NotNil(t, a.forget("vol1"), "running create can't be forgotten")
+
+	a.done("vol1", errors.New("mkfs failed"))
+	status = a.status("vol1")
+	assert.Equal(t, asyncStateFailed, status["state"])
+	assert.Equal(t, "mkfs failed", status["error"])
+	assert.NotNil(t, a.checkReady("vol1"))
+	assert.Nil(t, a.forget("vol1"))
+	assert.Nil(t, a.status("vol1"))
+
+	assert.Nil(t, a.add("vol2", map[string]string{}, "/sbin/mkfs.ext4"))
+	a.done("vol2", nil)
+	assert.Nil(t, a.status("vol2"))
+	assert.Nil(t, a.checkReady("vol2"))
+}
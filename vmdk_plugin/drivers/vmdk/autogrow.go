@@ -0,0 +1,227 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Automatic volume growth.
+//
+// "-o autogrow=85%;step=10gb;max=200gb" on Create (or the "autogrow" admin
+// command later) has the plugin which has the volume mounted check the
+// filesystem usage every AutogrowCheckMinutes. When the usage crosses the
+// threshold ESX extends the volume by step, up to max, online, then the
+// disk is rescanned and the filesystem grown while mounted. Each growth and
+// the last error are kept in the volume metadata, ESX reports them in Get.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+const (
+	autogrowOpt          = "autogrow"            // <n>%;step=<size>;max=<size>
+	autogrowLastGrowOpt  = "autogrow-last-grow"  // "<UTC in expiresAtFormat> <old>mb-><new>mb"
+	autogrowGrowsOpt     = "autogrow-grows"      // count
+	autogrowLastErrorOpt = "autogrow-last-error" // empty after a good growth
+)
+
+// Same as kv.AUTOGROW_PATTERN on ESX, matched in lower case
+var autogrowPattern = regexp.MustCompile(`^([1-9][0-9]?)%;step=([1-9][0-9]*[mgt]b);max=([1-9][0-9]*[mgt]b)$`)
+
+// autogrowPolicy is a parsed autogrow option
+type autogrowPolicy struct {
+	threshold int    // percent of the filesystem used
+	stepMB    uint64 // growth
+	maxMB     uint64 // volume size limit
+}
+
+// parseAutogrow parses "<n>%;step=<size>;max=<size>", sizes in mb, gb or tb
+func parseAutogrow(value string) (autogrowPolicy, error) {
+	match := autogrowPattern.FindStringSubmatch(strings.ToLower(value))
+	if match == nil {
+		return autogrowPolicy{}, fmt.Errorf("Invalid value '%s' for option %s, expected <n>%%;step=<size>;max=<size>, e.g. 85%%;step=10gb;max=200gb",
+			value, autogrowOpt)
+	}
+	policy := autogrowPolicy{stepMB: parseSizeMB(match[2]), maxMB: parseSizeMB(match[3])}
+	policy.threshold, _ = strconv.Atoi(match[1])
+	if policy.stepMB > policy.maxMB {
+		return autogrowPolicy{}, fmt.Errorf("The step of option %s is bigger than its max", autogrowOpt)
+	}
+	return policy, nil
+}
+
+// checkAutogrow verifies the autogrow Create option
+func checkAutogrow(opts map[string]string) error {
+	if value, exists := opts[autogrowOpt]; exists {
+		_, err := parseAutogrow(value)
+		return err
+	}
+	return nil
+}
+
+// setAutogrow changes the autogrow policy of a volume, an empty policy
+// removes it. The growth history is kept.
+func (d *VolumeDriver) setAutogrow(name string, value string) error {
+	if value != "" {
+		if _, err := parseAutogrow(value); err != nil {
+			return err
+		}
+	}
+	return d.ops.Set(name, map[string]string{autogrowOpt: value, autogrowLastErrorOpt: ""})
+}
+
+// nextAutogrowSize returns the size to grow a volume of sizeMB to, false
+// if it is at max already
+func nextAutogrowSize(policy autogrowPolicy, sizeMB uint64) (uint64, bool) {
+	if sizeMB >= policy.maxMB {
+		return sizeMB, false
+	}
+	if sizeMB+policy.stepMB > policy.maxMB {
+		return policy.maxMB, true
+	}
+	return sizeMB + policy.stepMB, true
+}
+
+// runAutogrowMonitor checks the usage of the volumes mounted here with an
+// autogrow policy every interval, forever
+func (d *VolumeDriver) runAutogrowMonitor(interval time.Duration) {
+	log.WithFields(log.Fields{"interval": interval}).Info("Starting autogrow monitor ")
+	for {
+		time.Sleep(interval)
+		for _, name := range d.mountedVolumes() {
+			meta, err := d.ops.Get(name)
+			if err != nil {
+				continue
+			}
+			if value, _ := meta[autogrowOpt].(string); value != "" {
+				d.autogrowVolume(name, value, meta, time.Now())
+			}
+		}
+	}
+}
+
+// autogrowVolume grows the volume if its usage is above the threshold of
+// the policy in value, and records the result in the volume metadata
+func (d *VolumeDriver) autogrowVolume(name string, value string, meta map[string]interface{}, now time.Time) {
+	lastError, _ := meta[autogrowLastErrorOpt].(string)
+	state := map[string]string{}
+	oldMB, newMB, err := d.growVolume(name, value, meta)
+	if err != nil {
+		if err.Error() == lastError {
+			// logged and recorded already
+			return
+		}
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Autogrow failed ")
+		state[autogrowLastErrorOpt] = err.Error()
+	} else if newMB == 0 {
+		return
+	} else {
+		grows, _ := strconv.Atoi(fmt.Sprintf("%v", meta[autogrowGrowsOpt]))
+		state[autogrowLastGrowOpt] = fmt.Sprintf("%s %dmb->%dmb", now.UTC().Format(expiresAtFormat), oldMB, newMB)
+		state[autogrowGrowsOpt] = strconv.Itoa(grows + 1)
+		state[autogrowLastErrorOpt] = ""
+	}
+	if err = d.ops.Set(name, state); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save autogrow state ")
+	}
+}
+
+// volumeSizeMB returns the exact size of a volume in MB from its Get
+// metadata, 0 if it isn't there
+func volumeSizeMB(meta map[string]interface{}) uint64 {
+	capacity, _ := meta[capacityKey].(map[string]interface{})
+	sizeBytes, _ := capacity[sizeBytesKey].(float64)
+	return uint64(sizeBytes) / (1024 * 1024)
+}
+
+// growVolume extends the volume and grows its filesystem if the usage is
+// above the threshold. Returns the old and new size in MB, 0 for the new
+// size if the volume wasn't grown. The volume is pinned mounted while it
+// grows, with StateMtx released.
+func (d *VolumeDriver) growVolume(name string, value string, meta map[string]interface{}) (uint64, uint64, error) {
+	policy, err := parseAutogrow(value)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	d.refCounts.StateMtx.Lock()
+	sizeMB, newMB, device, fstype, err := d.checkGrowth(name, policy, meta)
+	if err != nil || newMB == 0 {
+		d.refCounts.StateMtx.Unlock()
+		return 0, 0, err
+	}
+	d.pinVolume(name)
+	d.refCounts.StateMtx.Unlock()
+	defer func() {
+		d.refCounts.StateMtx.Lock()
+		d.unpinVolume(name)
+		d.refCounts.StateMtx.Unlock()
+	}()
+
+	mountpoint := getMountPoint(name)
+	if err = d.ops.Extend(name, newMB); err != nil {
+		return 0, 0, err
+	}
+	if err = fs.RescanDevice(device); err != nil {
+		return 0, 0, err
+	}
+	if err = fs.GrowFs(fstype, device, mountpoint); err != nil {
+		return 0, 0, err
+	}
+	log.WithFields(log.Fields{"name": name, "size": newMB}).Info("Volume grown ")
+	return sizeMB, newMB, nil
+}
+
+// checkGrowth returns the size of the volume in MB and the size to grow it
+// to, 0 if it doesn't need to grow, and its device and filesystem type.
+// Called with StateMtx held.
+func (d *VolumeDriver) checkGrowth(name string, policy autogrowPolicy, meta map[string]interface{}) (uint64, uint64, string, string, error) {
+	if d.getRefCount(name) == 0 {
+		// unmounted since the check
+		return 0, 0, "", "", nil
+	}
+	mountpoint := getMountPoint(name)
+	used, total, err := fs.Usage(mountpoint)
+	if err != nil {
+		return 0, 0, "", "", err
+	}
+	if total == 0 || used*100 < uint64(policy.threshold)*total {
+		return 0, 0, "", "", nil
+	}
+
+	sizeMB := volumeSizeMB(meta)
+	if sizeMB == 0 {
+		return 0, 0, "", "", fmt.Errorf("Failed to get the size of volume %s", name)
+	}
+	newMB, grow := nextAutogrowSize(policy, sizeMB)
+	if !grow {
+		return 0, 0, "", "", fmt.Errorf("Volume %s is %d%% full and at its autogrow max of %dmb", name,
+			used*100/total, policy.maxMB)
+	}
+
+	device, fstype, err := fs.GetMountInfo(mountpoint)
+	if err != nil {
+		return 0, 0, "", "", err
+	}
+	log.WithFields(log.Fields{"name": name, "used": used, "total": total, "from": sizeMB,
+		"to": newMB}).Warning("Growing volume ")
+	return sizeMB, newMB, device, fstype, nil
+}
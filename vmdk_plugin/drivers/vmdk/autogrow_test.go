@@ -0,0 +1,57 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test autogrow policy parsing and growth steps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAutogrow(t *testing.T) {
+	policy, err := parseAutogrow("85%;step=10gb;max=200GB")
+	if assert.Nil(t, err) {
+		assert.Equal(t, autogrowPolicy{threshold: 85, stepMB: 10 * 1024, maxMB: 200 * 1024}, policy)
+	}
+
+	for _, value := range []string{"", "85", "0%;step=1gb;max=2gb", "100%;step=1gb;max=2gb",
+		"85%;max=200gb", "85%;step=10gb", "85%;step=10kb;max=200gb", "85%;step=20gb;max=10gb"} {
+		_, err = parseAutogrow(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestNextAutogrowSize(t *testing.T) {
+	policy := autogrowPolicy{threshold: 85, stepMB: 10, maxMB: 25}
+	size, grow := nextAutogrowSize(policy, 10)
+	assert.True(t, grow)
+	assert.Equal(t, uint64(20), size)
+	size, grow = nextAutogrowSize(policy, 20)
+	assert.True(t, grow)
+	assert.Equal(t, uint64(25), size)
+	_, grow = nextAutogrowSize(policy, 25)
+	assert.False(t, grow)
+}
+
+func TestVolumeSizeMB(t *testing.T) {
+	// the exact size, not the rounded one
+	meta := map[string]interface{}{capacityKey: map[string]interface{}{
+		sizeKey: "1.5GB", sizeBytesKey: float64(1535 * 1024 * 1024)}}
+	assert.Equal(t, uint64(1535), volumeSizeMB(meta))
+	assert.Equal(t, uint64(0), volumeSizeMB(map[string]interface{}{}))
+	assert.Equal(t, uint64(0), volumeSizeMB(map[string]interface{}{capacityKey: map[string]interface{}{sizeKey: "1.5GB"}}))
+}
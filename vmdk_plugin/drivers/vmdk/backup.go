@@ -0,0 +1,165 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Backup and restore admin commands.
+//
+// "backup" mounts the volume (see adminMount()) and saves its files in a
+// backup repository (see utils/backup), with the volume metadata from Get.
+// "restore" creates a new volume with the options recorded in the backup,
+// and writes the files into it as the seed step of the create. A failed
+// restore removes the new volume.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/backup"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+const (
+	backupRepoOpt = "repo"   // backup repository dir
+	backupIDOpt   = "backup" // backup to restore
+
+	capacityKey  = "capacity" // volume size in Get, {"size": "10GB", "size-bytes": 10737418240, ...}
+	sizeKey      = "size"
+	sizeBytesKey = "size-bytes"
+)
+
+// Volume options restored as they were at backup time
+var restoredOpts = []string{"fstype", "diskformat", "vsan-policy-name", "attach-as", "access", mkfsOptsOpt}
+
+// BackupResult is returned by the "backup" admin command
+type BackupResult struct {
+	ID    string
+	Stats backup.Stats
+}
+
+// backupVolume backs up the files of a volume into the repository in repoDir
+func (d *VolumeDriver) backupVolume(name string, repoDir string) (*BackupResult, error) {
+	if repoDir == "" {
+		return nil, fmt.Errorf("No backup repository given")
+	}
+	repo, err := backup.Open(repoDir, true)
+	if err != nil {
+		return nil, err
+	}
+	mountpoint, name, err := d.adminMount(name, "backup", true)
+	if err != nil {
+		return nil, err
+	}
+	defer d.adminUnmount(name)
+
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"name": name, "repo": repoDir}).Info("Backing up volume ")
+	m, err := repo.Backup(mountpoint, name, meta)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Backup failed ")
+		return nil, err
+	}
+	log.WithFields(log.Fields{"name": name, "backup": m.ID, "files": m.Stats.Files,
+		"new bytes": m.Stats.NewBytes}).Info("Backup done ")
+	return &BackupResult{ID: m.ID, Stats: m.Stats}, nil
+}
+
+// restoreVolume creates the volume name from a backup in repoDir
+func (d *VolumeDriver) restoreVolume(name string, repoDir string, id string) error {
+	if repoDir == "" || id == "" {
+		return fmt.Errorf("No backup repository or backup ID given")
+	}
+	repo, err := backup.Open(repoDir, false)
+	if err != nil {
+		return err
+	}
+	m, err := repo.Load(id)
+	if err != nil {
+		return err
+	}
+	opts := restoreOpts(m)
+	if err = setProvenance(opts, "backup:"+id); err != nil {
+		return err
+	}
+	setFsLabel(name, opts)
+	mkfscmd, exists := fs.MkfsLookup()[opts["fstype"]]
+	if !exists {
+		return fmt.Errorf("Not found mkfs for %s", opts["fstype"])
+	}
+
+	log.WithFields(log.Fields{"name": name, "backup": id, "opts": opts}).Info("Restoring volume ")
+	return d.createSeededVolume(name, opts, mkfscmd, func(mountpoint string) error {
+		return repo.Restore(m, mountpoint)
+	})
+}
+
+// restoreOpts returns the create options of a volume restored from a
+// backup. The size is at least the size of the backed up filesystem, as
+// Get rounds the size down.
+func restoreOpts(m *backup.Manifest) map[string]string {
+	opts := make(map[string]string)
+	for _, key := range restoredOpts {
+		if value, exists := m.Meta[key].(string); exists {
+			opts[key] = value
+		}
+	}
+	if _, exists := opts["fstype"]; !exists {
+		opts["fstype"] = fs.FstypeDefault
+	}
+	if labels, exists := m.Meta[labelsKey].(map[string]interface{}); exists {
+		for key, value := range labels {
+			if value, ok := value.(string); ok {
+				opts[labelOptPrefix+key] = value
+			}
+		}
+	}
+
+	sizeMB := m.SizeMB
+	if capacity, exists := m.Meta[capacityKey].(map[string]interface{}); exists {
+		if size, ok := capacity[sizeKey].(string); ok && parseSizeMB(size) > sizeMB {
+			sizeMB = parseSizeMB(size)
+		}
+	}
+	if sizeMB != 0 {
+		opts[sizeKey] = strconv.FormatUint(sizeMB, 10) + "mb"
+	}
+	return opts
+}
+
+// parseSizeMB parses a size as returned by Get ("512KB", "100MB", "2GB")
+// in MB, rounded up. Returns 0 if the size is invalid.
+func parseSizeMB(size string) uint64 {
+	units := []struct {
+		suffix string
+		kb     uint64
+	}{{"KB", 1}, {"MB", 1024}, {"GB", 1024 * 1024}, {"TB", 1024 * 1024 * 1024}}
+	size = strings.ToUpper(size)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(size, unit.suffix), 10, 64)
+			if err != nil {
+				return 0
+			}
+			return (n*unit.kb + 1023) / 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Volume to volume copy admin command.
+//
+// "copy" copies the files of a volume into another one in the guest, so
+// the volumes may differ in filesystem type and size, unlike an ESX clone.
+// Both volumes are mounted through adminMount(), the source read-only and
+// the target read-write, and unmounted when done. A source attached
+// read-write (to this or another VM) may change during the copy, so it is
+// refused unless the copy is "live".
+//
+// The CLI polls "copystatus" for the progress, the space used in the target
+// filesystem against the space used in the source.
+//
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const (
+	copyTargetOpt = "target" // target volume of "copy"
+	copyLiveOpt   = "live"   // "true" to copy a source in use
+)
+
+// CopyProgress is returned by the "copystatus" admin command
+type CopyProgress struct {
+	Source string
+	Target string
+	Total  uint64 // bytes used in the source
+	Done   uint64 // bytes written to the target
+}
+
+// volumeCopies tracks running copies by target volume name, as given
+// to "copy"
+type volumeCopies struct {
+	mtx    sync.Mutex
+	copies map[string]*copyState
+}
+
+type copyState struct {
+	progress   CopyProgress
+	mountpoint string // target mountpoint
+	usedBefore uint64 // bytes used in the target before the copy
+}
+
+func newVolumeCopies() *volumeCopies {
+	return &volumeCopies{copies: make(map[string]*copyState)}
+}
+
+// get returns the progress of the copy to target
+func (c *volumeCopies) get(target string) (*CopyProgress, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	state, exists := c.copies[target]
+	if !exists {
+		return nil, fmt.Errorf("No copy to %s is running", target)
+	}
+	progress := state.progress
+	if used, _, err := fs.Usage(state.mountpoint); err == nil && used > state.usedBefore {
+		progress.Done = used - state.usedBefore
+	}
+	return &progress, nil
+}
+
+func (c *volumeCopies) add(target string, state *copyState) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.copies[target] = state
+}
+
+func (c *volumeCopies) remove(target string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.copies, target)
+}
+
+// copyVolume copies the files of volume source into volume target
+func (d *VolumeDriver) copyVolume(source string, target string, live bool) error {
+	if source == "" || target == "" {
+		return fmt.Errorf("Expected a source and a target volume")
+	}
+	if !live {
+		if err := d.checkCopySource(source); err != nil {
+			return err
+		}
+	}
+
+	srcMountpoint, srcName, err := d.adminMount(source, "copy", true)
+	if err != nil {
+		return err
+	}
+	defer d.adminUnmount(srcName)
+	dstMountpoint, dstName, err := d.adminMount(target, "copy", false)
+	if err != nil {
+		return err
+	}
+	defer d.adminUnmount(dstName)
+
+	state := &copyState{
+		progress:   CopyProgress{Source: srcName, Target: dstName},
+		mountpoint: dstMountpoint,
+	}
+	state.progress.Total, _, _ = fs.Usage(srcMountpoint)
+	state.usedBefore, _, _ = fs.Usage(dstMountpoint)
+	d.copies.add(target, state)
+	defer d.copies.remove(target)
+
+	log.WithFields(log.Fields{"source": srcName, "target": dstName, "live": live,
+		"bytes": state.progress.Total}).Info("Copying volume ")
+	if err = fs.CopyDir(srcMountpoint, dstMountpoint); err != nil {
+		log.WithFields(log.Fields{"source": srcName, "target": dstName, "error": err}).Error("Copy failed ")
+		return err
+	}
+	log.WithFields(log.Fields{"source": srcName, "target": dstName}).Info("Copy done ")
+	return nil
+}
+
+// checkCopySource refuses a source volume which may be written during the
+// copy, attached to a VM and not read-only
+func (d *VolumeDriver) checkCopySource(name string) error {
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		return err
+	}
+	if status, _ := meta[statusOpt].(string); status == statusDetached || plugin_utils.IsReadOnlyAccess(meta["access"]) {
+		return nil
+	}
+	return fmt.Errorf("Volume %s is attached read-write to VM %v, use --live to copy it anyway",
+		name, meta[attachedToVM])
+}
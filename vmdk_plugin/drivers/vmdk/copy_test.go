@@ -0,0 +1,50 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test copy progress tracking
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-copy-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := newVolumeCopies()
+	_, err = c.get("vol2")
+	assert.NotNil(t, err)
+
+	c.add("vol2", &copyState{
+		progress:   CopyProgress{Source: "vol1@ds", Target: "vol2@ds", Total: 1 << 20},
+		mountpoint: dir,
+	})
+	progress, err := c.get("vol2")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "vol1@ds", progress.Source)
+		assert.Equal(t, uint64(1<<20), progress.Total)
+	}
+	c.remove("vol2")
+	_, err = c.get("vol2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Create journal.
+//
+// VolumeDriver.Create is a sequence of ESX and guest operations
+// (create -> attach -> mkfs [-> seed] -> detach). If the plugin is killed
+// in the middle, the VMDK may be left attached to this VM, or created
+// without a filesystem. Each step of an in-flight create is recorded in a small
+// file under the plugin state dir, one file per volume, and the file is
+// removed once the create is complete (or rolled back).
+//
+// On plugin start the driver reads the leftover records and finishes or
+// rolls back the creates (see recoverCreates() in vmdk_driver.go).
+//
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+const (
+	journalDirName = "create-journal"
+	journalSuffix  = ".json"
+)
+
+// createStep is the last completed step of a volume create
+type createStep string
+
+const (
+	createStepRequested createStep = "requested" // create sent to ESX
+	createStepCreated   createStep = "created"   // VMDK exists on ESX
+	createStepAttached  createStep = "attached"  // VMDK attached to this VM
+	createStepFormatted createStep = "formatted" // filesystem created
+	createStepSeeding   createStep = "seeding"   // seed-from data being copied
+)
+
+// createRecord is the on-disk journal entry for one volume create
+type createRecord struct {
+	Name    string
+	Fstype  string
+	Step    createStep
+	Updated time.Time
+}
+
+// createJournal keeps records of in-flight creates in dir.
+// A nil *createJournal is valid and records nothing.
+type createJournal struct {
+	dir string
+}
+
+// newCreateJournal returns a journal kept in stateDir, creating the
+// directory if needed
+func newCreateJournal(stateDir string) (*createJournal, error) {
+	dir := filepath.Join(stateDir, journalDirName)
+	if err := fs.Mkdir(dir); err != nil {
+		return nil, err
+	}
+	return &createJournal{dir: dir}, nil
+}
+
+func (j *createJournal) recordPath(name string) string {
+	return filepath.Join(j.dir, name+journalSuffix)
+}
+
+// record saves the step reached by the create of volume name.
+// The record is written to a temp file and renamed, so a crash never
+// leaves a partially written record behind.
+func (j *createJournal) record(name string, fstype string, step createStep) {
+	if j == nil {
+		return
+	}
+	rec := createRecord{Name: name, Fstype: fstype, Step: step, Updated: time.Now()}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to encode create journal record ")
+		return
+	}
+
+	path := j.recordPath(name)
+	tmp := path + ".tmp"
+	err = writeFileSync(tmp, data)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "step": step, "error": err}).Warning("Failed to write create journal record ")
+		return
+	}
+	log.WithFields(log.Fields{"name": name, "step": step}).Debug("Create journal updated ")
+}
+
+// clear removes the record for volume name, the create is finished
+func (j *createJournal) clear(name string) {
+	if j == nil {
+		return
+	}
+	err := os.Remove(j.recordPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to clear create journal record ")
+	}
+}
+
+// pending returns the records of creates which were not finished
+func (j *createJournal) pending() []createRecord {
+	var records []createRecord
+	if j == nil {
+		return records
+	}
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": j.dir, "error": err}).Warning("Failed to read create journal ")
+		return records
+	}
+	for _, file := range files {
+		path := filepath.Join(j.dir, file.Name())
+		if !strings.HasSuffix(file.Name(), journalSuffix) {
+			// leftover of an interrupted record(), ignore it
+			os.Remove(path)
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warning("Failed to read create journal record ")
+			continue
+		}
+		var rec createRecord
+		if err = json.Unmarshal(data, &rec); err != nil || rec.Name == "" {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warning("Dropping corrupted create journal record ")
+			os.Remove(path)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// writeFileSync writes data to path and flushes it to disk
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
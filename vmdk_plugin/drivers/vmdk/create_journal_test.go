@@ -0,0 +1,71 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the create journal records kept in a temp state dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateJournal(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "vsphere-journal")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(stateDir)
+
+	j, err := newCreateJournal(stateDir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Empty(t, j.pending())
+
+	j.record("vol1", "ext4", createStepRequested)
+	j.record("vol1", "ext4", createStepAttached)
+	j.record("vol2@datastore1", "xfs", createStepCreated)
+
+	// garbage in the journal dir is dropped
+	ioutil.WriteFile(filepath.Join(j.dir, "bad"+journalSuffix), []byte("{"), 0600)
+	ioutil.WriteFile(filepath.Join(j.dir, "vol3"+journalSuffix+".tmp"), []byte("{}"), 0600)
+
+	steps := make(map[string]createStep)
+	for _, rec := range j.pending() {
+		steps[rec.Name] = rec.Step
+	}
+	assert.Equal(t, map[string]createStep{
+		"vol1":            createStepAttached,
+		"vol2@datastore1": createStepCreated,
+	}, steps)
+
+	j.clear("vol1")
+	j.clear("vol2@datastore1")
+	j.clear("unknown")
+	assert.Empty(t, j.pending())
+
+	files, _ := ioutil.ReadDir(j.dir)
+	assert.Empty(t, files)
+
+	// a nil journal records nothing
+	var none *createJournal
+	none.record("vol1", "ext4", createStepCreated)
+	none.clear("vol1")
+	assert.Empty(t, none.pending())
+}
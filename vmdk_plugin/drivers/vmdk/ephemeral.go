@@ -0,0 +1,426 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Ephemeral volumes.
+//
+// "-o ephemeral-of=<base>" on Create makes a volume of this docker host
+// only, with no VMDK: each mount presents the files of the base volume
+// through an overlayfs, writes go to a tmpfs and are discarded when the
+// last container using the volume stops. Many ephemeral volumes can share
+// one base volume, which is attached to this VM and mounted read-only once,
+// while any of them is mounted. Containers can't mount the base volume
+// itself meanwhile (see adminMounts).
+//
+// The ephemeral volumes are recorded in the plugin state dir, one file per
+// volume. Their mounts are under <mount root>/.ephemeral:
+//   volumes/<name>  overlay, the volume mountpoint
+//   scratch/<name>  tmpfs with the overlay upper and work dirs
+//   base/<base>     read-only mount of the base volume
+// Docker refcount discovery skips these mounts, on plugin start
+// recoverEphemerals() counts the containers using each mounted volume.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+const (
+	ephemeralOfOpt   = "ephemeral-of"   // base volume
+	ephemeralSizeOpt = "ephemeral-size" // tmpfs size limit, e.g. 1gb
+	ephemeralDirName = "ephemeral"      // records in the state dir
+	ephemeralSuffix  = ".json"
+)
+
+// ephemeralVolume is the record of an ephemeral volume
+type ephemeralVolume struct {
+	Name string
+	Base string // full name of the base volume
+	Size string // ephemeral-size option, may be empty
+}
+
+// ephemeralVolumes keeps the ephemeral volumes of this host, and their use.
+// refCounts and baseUsers are protected by the driver state lock.
+type ephemeralVolumes struct {
+	dir       string
+	mtx       sync.Mutex // protects volumes
+	volumes   map[string]*ephemeralVolume
+	refCounts map[string]uint // volume -> mounts by containers
+	baseUsers map[string]uint // base volume -> mounted ephemeral volumes
+}
+
+// newEphemeralVolumes returns the ephemeral volumes recorded in stateDir,
+// creating the directory if needed
+func newEphemeralVolumes(stateDir string) (*ephemeralVolumes, error) {
+	e := &ephemeralVolumes{
+		dir:       filepath.Join(stateDir, ephemeralDirName),
+		volumes:   make(map[string]*ephemeralVolume),
+		refCounts: make(map[string]uint),
+		baseUsers: make(map[string]uint),
+	}
+	if err := fs.Mkdir(e.dir); err != nil {
+		return e, err
+	}
+	files, err := ioutil.ReadDir(e.dir)
+	if err != nil {
+		return e, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ephemeralSuffix) {
+			continue
+		}
+		path := filepath.Join(e.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		var v ephemeralVolume
+		if err == nil {
+			err = json.Unmarshal(data, &v)
+		}
+		if err != nil || v.Name == "" || v.Base == "" {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warning("Skipping bad ephemeral volume record ")
+			continue
+		}
+		e.volumes[v.Name] = &v
+	}
+	return e, nil
+}
+
+// get returns the ephemeral volume name, nil if there is none
+func (e *ephemeralVolumes) get(name string) *ephemeralVolume {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.volumes[name]
+}
+
+// list returns the ephemeral volumes
+func (e *ephemeralVolumes) list() []*ephemeralVolume {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	volumes := make([]*ephemeralVolume, 0, len(e.volumes))
+	for _, v := range e.volumes {
+		volumes = append(volumes, v)
+	}
+	return volumes
+}
+
+// add records an ephemeral volume
+func (e *ephemeralVolumes) add(v *ephemeralVolume) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if _, exists := e.volumes[v.Name]; exists {
+		return fmt.Errorf("Volume %s already exists", v.Name)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.dir, v.Name+ephemeralSuffix)
+	if err = writeFileSync(path+".tmp", data); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to record ephemeral volume %s: %v", v.Name, err)
+	}
+	e.volumes[v.Name] = v
+	return nil
+}
+
+// remove drops the record of an ephemeral volume
+func (e *ephemeralVolumes) remove(name string) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	err := os.Remove(filepath.Join(e.dir, name+ephemeralSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(e.volumes, name)
+	return nil
+}
+
+func ephemeralPath(kind string, name string) string {
+	return filepath.Join(mountRoot, plugin_utils.EphemeralDir, kind, name)
+}
+
+// getEphemeralMountPoint returns the mountpoint of an ephemeral volume
+func getEphemeralMountPoint(name string) string {
+	return ephemeralPath("volumes", name)
+}
+
+// checkEphemeralOpts verifies the Create options of an ephemeral volume,
+// returns the tmpfs size in MB, 0 for the tmpfs default
+func checkEphemeralOpts(opts map[string]string) (uint64, error) {
+	for key := range opts {
+		if key != ephemeralOfOpt && key != ephemeralSizeOpt {
+			return 0, fmt.Errorf("Option %s is not supported with %s", key, ephemeralOfOpt)
+		}
+	}
+	size, exists := opts[ephemeralSizeOpt]
+	if !exists {
+		return 0, nil
+	}
+	sizeMB := parseSizeMB(size)
+	if sizeMB == 0 {
+		return 0, fmt.Errorf("Invalid value '%s' for option %s, expected a size such as 512mb or 2gb",
+			size, ephemeralSizeOpt)
+	}
+	return sizeMB, nil
+}
+
+// createEphemeral records an ephemeral volume of the base volume in opts
+func (d *VolumeDriver) createEphemeral(name string, opts map[string]string) error {
+	if _, err := checkEphemeralOpts(opts); err != nil {
+		return err
+	}
+	if _, err := d.ops.Get(name); err == nil {
+		return fmt.Errorf("Volume %s already exists", name)
+	}
+	base := opts[ephemeralOfOpt]
+	if d.ephemerals.get(base) != nil {
+		return fmt.Errorf("Base volume %s is an ephemeral volume", base)
+	}
+	volumeInfo, err := plugin_utils.GetVolumeInfo(base, "", d)
+	if err != nil {
+		return err
+	}
+	if volumeInfo.VolumeMeta == nil {
+		if _, err = d.ops.Get(volumeInfo.VolumeName); err != nil {
+			return err
+		}
+	}
+	v := &ephemeralVolume{Name: name, Base: volumeInfo.VolumeName, Size: opts[ephemeralSizeOpt]}
+	if err = d.ephemerals.add(v); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "base": v.Base}).Info("Ephemeral volume created ")
+	return nil
+}
+
+// removeEphemeral removes an ephemeral volume not in use
+func (d *VolumeDriver) removeEphemeral(name string) error {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+	if d.ephemerals.refCounts[name] != 0 {
+		return fmt.Errorf("Remove failure - volume is still mounted. volume=%s, refcount=%d",
+			name, d.ephemerals.refCounts[name])
+	}
+	return d.ephemerals.remove(name)
+}
+
+// ephemeralStatus returns the Get status of an ephemeral volume
+func ephemeralStatus(v *ephemeralVolume) map[string]interface{} {
+	status := map[string]interface{}{ephemeralOfOpt: v.Base}
+	if v.Size != "" {
+		status[ephemeralSizeOpt] = v.Size
+	}
+	return status
+}
+
+// mountEphemeral mounts an ephemeral volume for a container, called with
+// the state lock held
+func (d *VolumeDriver) mountEphemeral(v *ephemeralVolume) volume.Response {
+	mountpoint := getEphemeralMountPoint(v.Name)
+	if d.ephemerals.refCounts[v.Name] > 0 {
+		d.ephemerals.refCounts[v.Name]++
+		log.WithFields(log.Fields{"name": v.Name, "refcount": d.ephemerals.refCounts[v.Name]}).Info("Already mounted, skipping mount. ")
+		return volume.Response{Mountpoint: mountpoint}
+	}
+
+	err := d.acquireEphemeralBase(v.Base)
+	if err == nil {
+		err = mountOverlay(v, mountpoint)
+		if err != nil {
+			d.releaseEphemeralBase(v.Base)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": v.Name, "base": v.Base, "error": err}).Error("Failed to mount ")
+		return volume.Response{Err: err.Error()}
+	}
+	d.ephemerals.refCounts[v.Name] = 1
+	log.WithFields(log.Fields{"name": v.Name, "base": v.Base}).Info("Ephemeral volume mounted ")
+	return volume.Response{Mountpoint: mountpoint}
+}
+
+// mountOverlay mounts the overlay of an ephemeral volume over its base
+// mount, with the changes on a new tmpfs
+func mountOverlay(v *ephemeralVolume, mountpoint string) error {
+	sizeMB := parseSizeMB(v.Size)
+	scratch := ephemeralPath("scratch", v.Name)
+	upper := filepath.Join(scratch, "upper")
+	work := filepath.Join(scratch, "work")
+	for _, dir := range []string{scratch, mountpoint} {
+		if err := fs.Mkdir(dir); err != nil {
+			return err
+		}
+	}
+	if err := fs.MountTmpfs(scratch, sizeMB); err != nil {
+		return err
+	}
+	err := fs.Mkdir(upper)
+	if err == nil {
+		err = fs.Mkdir(work)
+	}
+	if err == nil {
+		err = fs.MountOverlay(mountpoint, ephemeralPath("base", v.Base), upper, work)
+	}
+	if err != nil {
+		fs.Unmount(scratch)
+	}
+	return err
+}
+
+// unmountEphemeral drops a container mount of an ephemeral volume, called
+// with the state lock held. The changes are discarded after the last one.
+func (d *VolumeDriver) unmountEphemeral(v *ephemeralVolume) volume.Response {
+	if d.ephemerals.refCounts[v.Name] > 1 {
+		d.ephemerals.refCounts[v.Name]--
+		return volume.Response{Err: ""}
+	}
+	delete(d.ephemerals.refCounts, v.Name)
+	if err := d.discardEphemeral(v); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	log.WithFields(log.Fields{"name": v.Name}).Info("Ephemeral volume discarded ")
+	return volume.Response{Err: ""}
+}
+
+// discardEphemeral unmounts the overlay and tmpfs of an ephemeral volume,
+// and releases its base
+func (d *VolumeDriver) discardEphemeral(v *ephemeralVolume) error {
+	if err := fs.Unmount(getEphemeralMountPoint(v.Name)); err != nil {
+		log.WithFields(log.Fields{"name": v.Name, "error": err}).Error("Failed to unmount ")
+		return err
+	}
+	if err := fs.Unmount(ephemeralPath("scratch", v.Name)); err != nil {
+		log.WithFields(log.Fields{"name": v.Name, "error": err}).Warning("Failed to unmount scratch tmpfs ")
+	}
+	d.releaseEphemeralBase(v.Base)
+	return nil
+}
+
+// acquireEphemeralBase mounts the base volume read-only for the first
+// mounted ephemeral volume using it
+func (d *VolumeDriver) acquireEphemeralBase(base string) error {
+	if d.ephemerals.baseUsers[base] > 0 {
+		d.ephemerals.baseUsers[base]++
+		return nil
+	}
+	if d.refCounts.GetInitSuccess() != true {
+		return fmt.Errorf("Volume usage is not known yet, retry later")
+	}
+	if cmd, exists := d.adminMounts[base]; exists {
+		return fmt.Errorf("Base volume %s is busy with %s, retry later", base, cmd)
+	}
+	if d.getRefCount(base) != 0 {
+		return fmt.Errorf("Base volume %s is mounted by a container, it can't be shared read-only", base)
+	}
+	meta, err := d.ops.Get(base)
+	if err != nil {
+		return err
+	}
+	fstype, exists := meta["fstype"].(string)
+	if !exists {
+		fstype = fs.FstypeDefault
+	}
+	mountpoint := ephemeralPath("base", base)
+	if _, device, err := d.mountVolumeAt(base, mountpoint, fstype, true, false); err != nil {
+		d.releaseAndDetach(base, device)
+		return err
+	}
+	d.adminMounts[base] = ephemeralOfOpt
+	d.ephemerals.baseUsers[base] = 1
+	log.WithFields(log.Fields{"base": base}).Info("Base volume mounted read-only ")
+	return nil
+}
+
+// releaseEphemeralBase unmounts and detaches the base volume after the
+// last mounted ephemeral volume using it
+func (d *VolumeDriver) releaseEphemeralBase(base string) {
+	if d.ephemerals.baseUsers[base] > 1 {
+		d.ephemerals.baseUsers[base]--
+		return
+	}
+	delete(d.ephemerals.baseUsers, base)
+	delete(d.adminMounts, base)
+	// a base still mounted under an overlay must stay attached
+	mountpoint := ephemeralPath("base", base)
+	device, _, errInfo := fs.GetMountInfo(mountpoint)
+	if err := fs.Unmount(mountpoint); err != nil {
+		log.WithFields(log.Fields{"base": base, "error": err}).Error("Failed to unmount base volume ")
+		return
+	}
+	if errInfo != nil {
+		device = ""
+	}
+	if err := d.releaseAndDetach(base, device); err != nil {
+		log.WithFields(log.Fields{"base": base, "error": err}).Error("Failed to detach base volume ")
+	}
+}
+
+// recoverEphemerals rebuilds the use of the ephemeral volumes after a
+// plugin restart. Mounted volumes which no container uses are discarded.
+func (d *VolumeDriver) recoverEphemerals() {
+	var unused []*ephemeralVolume
+	for _, v := range d.ephemerals.list() {
+		if _, _, err := fs.GetMountInfo(getEphemeralMountPoint(v.Name)); err != nil {
+			continue
+		}
+		containers, err := refcount.GetVolumeContainers(v.Name)
+		if err != nil {
+			// keep the volume, its unmount discards it
+			log.WithFields(log.Fields{"name": v.Name, "error": err}).Warning("Failed to get containers using ephemeral volume ")
+			containers = []string{""}
+		}
+		if len(containers) == 0 {
+			unused = append(unused, v)
+			continue
+		}
+		d.ephemerals.refCounts[v.Name] = uint(len(containers))
+		d.ephemerals.baseUsers[v.Base]++
+		d.adminMounts[v.Base] = ephemeralOfOpt
+		log.WithFields(log.Fields{"name": v.Name, "refcount": len(containers)}).Info("Ephemeral volume in use ")
+	}
+
+	// once the bases in use are known
+	for _, v := range unused {
+		log.WithFields(log.Fields{"name": v.Name}).Info("Discarding unused ephemeral volume ")
+		d.ephemerals.baseUsers[v.Base]++
+		d.discardEphemeral(v)
+	}
+	bases, _ := ioutil.ReadDir(ephemeralPath("base", ""))
+	for _, dir := range bases {
+		base := dir.Name()
+		if d.ephemerals.baseUsers[base] != 0 {
+			continue
+		}
+		if _, _, err := fs.GetMountInfo(ephemeralPath("base", base)); err == nil {
+			log.WithFields(log.Fields{"base": base}).Info("Releasing unused base volume ")
+			d.ephemerals.baseUsers[base] = 1
+			d.releaseEphemeralBase(base)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test ephemeral volume records and options
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeralVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-ephemeral-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	e, err := newEphemeralVolumes(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, e.add(&ephemeralVolume{Name: "test1", Base: "golden@datastore1", Size: "1gb"}))
+	assert.NotNil(t, e.add(&ephemeralVolume{Name: "test1", Base: "golden@datastore1"}))
+	assert.Nil(t, e.add(&ephemeralVolume{Name: "test2", Base: "golden@datastore1"}))
+
+	// records survive a plugin restart
+	e, err = newEphemeralVolumes(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 2, len(e.list()))
+	if v := e.get("test1"); assert.NotNil(t, v) {
+		assert.Equal(t, ephemeralVolume{Name: "test1", Base: "golden@datastore1", Size: "1gb"}, *v)
+	}
+
+	assert.Nil(t, e.remove("test1"))
+	assert.Nil(t, e.get("test1"))
+	e, _ = newEphemeralVolumes(dir)
+	assert.Equal(t, 1, len(e.list()))
+}
+
+func TestCheckEphemeralOpts(t *testing.T) {
+	size, err := checkEphemeralOpts(map[string]string{ephemeralOfOpt: "golden"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), size)
+	size, err = checkEphemeralOpts(map[string]string{ephemeralOfOpt: "golden", ephemeralSizeOpt: "2gb"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2048), size)
+
+	_, err = checkEphemeralOpts(map[string]string{ephemeralOfOpt: "golden", ephemeralSizeOpt: "big"})
+	assert.NotNil(t, err)
+	_, err = checkEphemeralOpts(map[string]string{ephemeralOfOpt: "golden", "size": "10gb"})
+	assert.NotNil(t, err)
+}
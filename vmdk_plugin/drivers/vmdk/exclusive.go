@@ -0,0 +1,66 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Exclusive volumes.
+//
+// A volume created with "-o exclusive=true" is mounted by one container at a
+// time on this host: processMount() refuses a mount while the refcount of
+// the volume is not 0. Docker only passes a random mount ID to the plugin,
+// so the containers holding the volume are looked up in Docker for the
+// error. The lookup is bounded by the Docker connection timeout, on older
+// Docker versions it waits for the container being started and fails.
+//
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+const exclusiveOpt = "exclusive" // "true" for one container at a time
+
+// checkExclusive refuses another mount of the volume name if it is
+// exclusive. requested is the volume name as given by Docker. Called with
+// the state lock held, for a volume mounted here.
+func (d *VolumeDriver) checkExclusive(name string, requested string, meta map[string]interface{}) error {
+	if meta == nil {
+		var err error
+		if meta, err = d.ops.Get(name); err != nil {
+			return err
+		}
+	}
+	if exclusive, _ := meta[exclusiveOpt].(string); exclusive != "true" {
+		return nil
+	}
+	containers, err := refcount.GetVolumeContainers(requested, name)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to get containers using volume ")
+	}
+	return exclusiveMountError(name, containers)
+}
+
+// exclusiveMountError returns the error for a refused mount of an exclusive
+// volume held by containers, which may be unknown
+func exclusiveMountError(name string, containers []string) error {
+	if len(containers) == 0 {
+		return fmt.Errorf("Volume %s is exclusive and already mounted by another container", name)
+	}
+	return fmt.Errorf("Volume %s is exclusive and already mounted by container %s", name,
+		strings.Join(containers, ", "))
+}
@@ -0,0 +1,30 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the error of a refused exclusive mount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExclusiveMountError(t *testing.T) {
+	err := exclusiveMountError("db@datastore1", []string{"4f2a9c1b7e3d"})
+	assert.Equal(t, "Volume db@datastore1 is exclusive and already mounted by container 4f2a9c1b7e3d", err.Error())
+	err = exclusiveMountError("db@datastore1", nil)
+	assert.Contains(t, err.Error(), "another container")
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Volume expiry.
+//
+// "-o ttl=72h" or "-o expires-at=2017-01-31T12:00:00Z" on Create stores the
+// expiry time in the volume metadata, together with the hostname of the
+// Docker host which created the volume. The expiry janitor (removeExpiredVolumes())
+// periodically looks for expired volumes and removes those which are not
+// mounted and not attached to any VM.
+//
+// Many Docker hosts share the same volumes, so to avoid races without any
+// election only the creating host removes a volume. A volume is logged as
+// expiring before it is removed, at least one check before removal even
+// if it is found already expired.
+//
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	ttlOpt         = "ttl"        // Create option, plugin side only
+	expiresAtOpt   = "expires-at" // expiry time, UTC in expiresAtFormat
+	statusOpt      = "status"     // ESX attach status in Get
+	statusDetached = "detached"
+	attachedToVM   = "attached to VM" // VM name in Get, if attached
+
+	expiresAtFormat = "2006-01-02T15:04:05Z"
+)
+
+// expiryJanitor removes expired volumes created by this host
+type expiryJanitor struct {
+	host     string
+	interval time.Duration
+	warning  time.Duration
+	warned   map[string]bool // volumes already logged as expiring
+}
+
+// setExpiry converts the ttl or expires-at Create option to an expires-at
+// option in expiresAtFormat. The creating host, which removes the volume,
+// is recorded by setProvenance().
+func setExpiry(opts map[string]string, now time.Time) error {
+	ttl, hasTTL := opts[ttlOpt]
+	expiresAt, hasExpiresAt := opts[expiresAtOpt]
+	if !hasTTL && !hasExpiresAt {
+		return nil
+	}
+	if hasTTL && hasExpiresAt {
+		return fmt.Errorf("Options %s and %s can not be used together", ttlOpt, expiresAtOpt)
+	}
+	delete(opts, ttlOpt)
+
+	var expires time.Time
+	if hasTTL {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Invalid value '%s' for option %s, expected a duration such as 72h", ttl, ttlOpt)
+		}
+		expires = now.Add(d)
+	} else {
+		var err error
+		expires, err = time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return fmt.Errorf("Invalid value '%s' for option %s, expected a time such as 2017-01-31T12:00:00Z", expiresAt, expiresAtOpt)
+		}
+		if !expires.After(now) {
+			return fmt.Errorf("Option %s is in the past: %s", expiresAtOpt, expiresAt)
+		}
+	}
+
+	opts[expiresAtOpt] = expires.UTC().Format(expiresAtFormat)
+	return nil
+}
+
+// newExpiryJanitor returns a janitor checking every interval, or nil if
+// expired volumes are not to be removed
+func newExpiryJanitor(checkMinutes int, warningMinutes int) *expiryJanitor {
+	if checkMinutes <= 0 {
+		return nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Failed to get hostname, expired volumes will not be removed ")
+		return nil
+	}
+	return &expiryJanitor{
+		host:     host,
+		interval: time.Duration(checkMinutes) * time.Minute,
+		warning:  time.Duration(warningMinutes) * time.Minute,
+		warned:   make(map[string]bool),
+	}
+}
+
+// runExpiryJanitor checks for expired volumes forever
+func (d *VolumeDriver) runExpiryJanitor(j *expiryJanitor) {
+	log.WithFields(log.Fields{"host": j.host, "interval": j.interval}).Info("Starting expiry janitor ")
+	for {
+		time.Sleep(j.interval)
+		d.removeExpiredVolumes(j, time.Now())
+	}
+}
+
+// removeExpiredVolumes logs volumes created by this host which expire
+// soon, and removes the expired ones already logged in an earlier check
+func (d *VolumeDriver) removeExpiredVolumes(j *expiryJanitor, now time.Time) {
+	volumes, err := d.ops.List()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Expiry janitor failed to list volumes ")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, vol := range volumes {
+		seen[vol.Name] = true
+		meta, err := d.ops.Get(vol.Name)
+		if err != nil {
+			continue
+		}
+		expiresAt, _ := meta[expiresAtOpt].(string)
+		host, _ := meta[createdHostOpt].(string)
+		if expiresAt == "" || host != j.host {
+			continue
+		}
+		expires, err := time.Parse(expiresAtFormat, expiresAt)
+		if err != nil {
+			log.WithFields(log.Fields{"name": vol.Name, "expires": expiresAt}).Warning("Ignoring invalid volume expiry time ")
+			continue
+		}
+		if now.Add(j.warning).Before(expires) {
+			continue
+		}
+		if !j.warned[vol.Name] {
+			j.warned[vol.Name] = true
+			log.WithFields(log.Fields{"name": vol.Name, "expires": expiresAt}).Warning("Volume expires soon and will be removed ")
+			continue
+		}
+		if now.Before(expires) {
+			continue
+		}
+		if d.removeExpiredVolume(vol.Name) {
+			delete(j.warned, vol.Name)
+		}
+	}
+	// forget volumes removed elsewhere
+	for name := range j.warned {
+		if !seen[name] {
+			delete(j.warned, name)
+		}
+	}
+}
+
+// removeExpiredVolume removes the volume if it is not in use.
+// Returns true if the volume was removed.
+func (d *VolumeDriver) removeExpiredVolume(name string) bool {
+	// hold off mounts while checking and removing
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+
+	if d.getRefCount(name) != 0 {
+		log.WithFields(log.Fields{"name": name}).Warning("Expired volume is mounted, not removing it ")
+		return false
+	}
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		return false
+	}
+	if status, _ := meta[statusOpt].(string); status != statusDetached {
+		log.WithFields(log.Fields{"name": name, "attached to VM": meta[attachedToVM]}).Warning("Expired volume is attached, not removing it ")
+		return false
+	}
+	log.WithFields(log.Fields{"name": name, "expires": meta[expiresAtOpt]}).Warning("Removing expired volume ")
+	resp := d.Remove(volume.Request{Name: name})
+	return resp.Err == ""
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test parsing of the volume expiry Create options
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetExpiry(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	opts := map[string]string{"size": "1gb"}
+	assert.Nil(t, setExpiry(opts, now))
+	assert.Equal(t, map[string]string{"size": "1gb"}, opts)
+
+	opts = map[string]string{ttlOpt: "72h"}
+	assert.Nil(t, setExpiry(opts, now))
+	assert.Equal(t, map[string]string{expiresAtOpt: "2017-01-04T12:00:00Z"}, opts)
+
+	opts = map[string]string{expiresAtOpt: "2017-01-31T13:00:00+01:00"}
+	assert.Nil(t, setExpiry(opts, now))
+	assert.Equal(t, "2017-01-31T12:00:00Z", opts[expiresAtOpt])
+
+	bad := []map[string]string{
+		{ttlOpt: "3d"},
+		{ttlOpt: "-1h"},
+		{expiresAtOpt: "tomorrow"},
+		{expiresAtOpt: "2016-12-31T12:00:00Z"},
+		{ttlOpt: "1h", expiresAtOpt: "2017-01-31T12:00:00Z"},
+	}
+	for _, opts := range bad {
+		assert.NotNil(t, setExpiry(opts, now), "%v", opts)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Filesystem check before the mount.
+//
+// After an ESX crash or a forced detach the filesystem of a volume may need
+// a check. The "fsck-policy" of the volume, or the FsckPolicy of the plugin
+// config for volumes without one, says what is done before the mount:
+//   never           - mount without a check
+//   auto            - the checker repairs what it safely can (e2fsck -p),
+//                     the mount fails if errors are left
+//   force           - as auto, filesystems marked clean are checked too
+//   refuse-on-error - check without repairing, the mount fails on errors
+// The checker comes from the filesystem profile (see fs.Profile). Read-only
+// volumes, XFS and btrfs are checked without repairing. XFS is checked for
+// refuse-on-error only: its log is replayed by the mount, and xfs_repair -n
+// reports errors for a filesystem with a dirty log, as left by a crash. The
+// result and the time of the last check are recorded in the volume metadata.
+//
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+const (
+	fsckPolicyOpt     = "fsck-policy"      // one of the config.Fsck* policies
+	fsckLastResultOpt = "fsck-last-result" // one of the fs.Fsck* results, or fsckErrors
+	fsckLastRunOpt    = "fsck-last-run"    // UTC in expiresAtFormat
+	fsckErrors        = "errors"           // the check found errors it didn't repair
+)
+
+// validFsckPolicy returns true for the known fsck policies
+func validFsckPolicy(policy string) bool {
+	switch policy {
+	case config.FsckNever, config.FsckAuto, config.FsckForce, config.FsckRefuseOnError:
+		return true
+	}
+	return false
+}
+
+// checkFsckPolicy validates the fsck-policy option
+func checkFsckPolicy(opts map[string]string) error {
+	if policy, exists := opts[fsckPolicyOpt]; exists && !validFsckPolicy(policy) {
+		return fmt.Errorf("Invalid value %s for option %s, expected one of %s, %s, %s or %s",
+			policy, fsckPolicyOpt, config.FsckNever, config.FsckAuto, config.FsckForce,
+			config.FsckRefuseOnError)
+	}
+	return nil
+}
+
+// fsckPolicyOf returns the fsck policy of the volume with meta, the plugin
+// one if the volume has none
+func (d *VolumeDriver) fsckPolicyOf(meta map[string]interface{}) string {
+	if policy, _ := meta[fsckPolicyOpt].(string); policy != "" {
+		return policy
+	}
+	return d.fsckPolicy
+}
+
+// mountRecovers returns true if the check of fstype is left to the mount,
+// which replays the log, under policy
+func mountRecovers(fstype string, policy string) bool {
+	p, exists := fs.GetProfile(fstype)
+	return exists && p.MountRecovers && policy != config.FsckRefuseOnError
+}
+
+// checkFilesystem checks the filesystem on the device of the volume name
+// before the mount as its fsck policy says, and records the result
+func (d *VolumeDriver) checkFilesystem(name string, fstype string, device string, isReadOnly bool, meta map[string]interface{}) error {
+	policy := d.fsckPolicyOf(meta)
+	if policy == config.FsckNever {
+		return nil
+	}
+	repair := (policy == config.FsckAuto || policy == config.FsckForce) && !isReadOnly
+	force := policy == config.FsckForce
+
+	fields := log.Fields{"name": name, "device": device, "fstype": fstype, "policy": policy}
+	var result string
+	var err error
+	if mountRecovers(fstype, policy) {
+		result = fs.FsckSkipped
+		log.WithFields(fields).Info("Filesystem check left to the log replay of the mount ")
+	} else {
+		log.WithFields(fields).Info("Checking filesystem ")
+		result, err = fs.Fsck(fstype, device, repair, force)
+	}
+	if err != nil {
+		result = fsckErrors
+		log.WithFields(fields).WithField("error", err).Error("Filesystem check failed ")
+	} else {
+		log.WithFields(fields).WithField("result", result).Info("Filesystem checked ")
+	}
+
+	state := map[string]string{
+		fsckLastResultOpt: result,
+		fsckLastRunOpt:    time.Now().UTC().Format(expiresAtFormat),
+	}
+	if setErr := d.ops.Set(name, state); setErr != nil {
+		log.WithFields(log.Fields{"name": name, "error": setErr}).Warning("Failed to record filesystem check ")
+	}
+	if err != nil {
+		return fmt.Errorf("Refusing to mount volume %s: %v", name, err)
+	}
+	return nil
+}
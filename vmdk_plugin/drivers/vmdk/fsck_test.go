@@ -0,0 +1,43 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the validation of the fsck-policy option and the checks left to the
+// mount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFsckPolicy(t *testing.T) {
+	for _, policy := range []string{"never", "auto", "force", "refuse-on-error"} {
+		assert.Nil(t, checkFsckPolicy(map[string]string{fsckPolicyOpt: policy}), policy)
+	}
+	for _, policy := range []string{"", "always", "Auto"} {
+		assert.NotNil(t, checkFsckPolicy(map[string]string{fsckPolicyOpt: policy}), policy)
+	}
+	assert.Nil(t, checkFsckPolicy(map[string]string{}))
+}
+
+func TestMountRecovers(t *testing.T) {
+	for _, policy := range []string{"auto", "force"} {
+		assert.True(t, mountRecovers("xfs", policy), policy)
+		assert.False(t, mountRecovers("ext4", policy), policy)
+	}
+	assert.False(t, mountRecovers("xfs", "refuse-on-error"))
+	assert.False(t, mountRecovers("zfs", "auto"))
+}
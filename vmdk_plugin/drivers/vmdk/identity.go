@@ -0,0 +1,102 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Device identity checks.
+//
+// Before mkfs or a mount the device found for an attached volume is checked
+// to be the disk ESX attached (see fs.VerifyDevice), so that a wrong disk
+// is never formatted. On mount the label of the filesystem is checked too.
+// The label the plugin gives the filesystem is kept in the volume metadata,
+// clones keep the one of their parent. Volumes created before it was kept
+// are expected to have their name, or the name of the volume they were
+// cloned from or moved from, as label. Filesystems without a label are
+// mounted.
+//
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const fsLabelOpt = "fs-label" // label of the filesystem the plugin created
+
+// setFsLabel records the label the filesystem of the volume name gets in
+// the Create options
+func setFsLabel(name string, opts map[string]string) {
+	if p, exists := fs.GetProfile(opts["fstype"]); exists {
+		opts[fsLabelOpt] = p.Label(name)
+	}
+}
+
+// fsLabel returns the label for the filesystem made on the volume name
+// after its create, the one recorded in meta if any
+func fsLabel(name string, meta map[string]interface{}) string {
+	if label, _ := meta[fsLabelOpt].(string); label != "" {
+		return label
+	}
+	return name
+}
+
+// expectedLabels returns the labels the filesystem of the volume name may
+// have, none if it can't be told
+func expectedLabels(name string, fstype string, meta map[string]interface{}) []string {
+	if label, _ := meta[fsLabelOpt].(string); label != "" {
+		return []string{label}
+	}
+	p, exists := fs.GetProfile(fstype)
+	if !exists {
+		return nil
+	}
+	names := []string{name}
+	for _, key := range []string{"clone-from", "moved-from"} {
+		if other, _ := meta[key].(string); other != "" && other != "None" {
+			names = append(names, other)
+		}
+	}
+	var labels []string
+	for _, n := range names {
+		labels = append(labels, p.Label(n), p.Label(plugin_utils.SplitVolName(n)[0]))
+	}
+	return labels
+}
+
+// verifyLabel checks that the filesystem on device is the one of the
+// volume name, by its label
+func verifyLabel(name string, fstype string, device string, meta map[string]interface{}) error {
+	expected := expectedLabels(name, fstype, meta)
+	if len(expected) == 0 {
+		return nil
+	}
+	label, err := fs.GetLabel(device)
+	if err != nil {
+		return err
+	}
+	if label == "" {
+		log.WithFields(log.Fields{"name": name, "device": device}).Warning("Filesystem has no label, not verifying it ")
+		return nil
+	}
+	for _, l := range expected {
+		if label == l {
+			return nil
+		}
+	}
+	return fmt.Errorf("Filesystem on %s has label %s, expected %s for volume %s, refusing to mount it",
+		device, label, expected[0], name)
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the filesystem labels expected for a volume
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedLabels(t *testing.T) {
+	opts := map[string]string{"fstype": "xfs"}
+	setFsLabel("database-volume@datastore1", opts)
+	assert.Equal(t, "database-vol", opts[fsLabelOpt])
+
+	meta := map[string]interface{}{fsLabelOpt: "golden"}
+	assert.Equal(t, []string{"golden"}, expectedLabels("clone1", "ext4", meta))
+
+	// a format=lazy volume created by its short name, mounted by its full
+	// name, gets the label it was created with
+	opts = map[string]string{"fstype": "ext4"}
+	setFsLabel("vol1", opts)
+	meta = map[string]interface{}{fsLabelOpt: opts[fsLabelOpt]}
+	label := fsLabel("vol1@datastore1", meta)
+	assert.Equal(t, "vol1", label)
+	assert.Equal(t, []string{label}, expectedLabels("vol1@datastore1", "ext4", meta))
+	assert.Equal(t, "vol1@datastore1", fsLabel("vol1@datastore1", map[string]interface{}{}))
+
+	// volumes created before the label was recorded
+	meta = map[string]interface{}{"clone-from": "None"}
+	assert.Equal(t, []string{"vol1@datastore1", "vol1"}, expectedLabels("vol1@datastore1", "ext4", meta))
+	meta = map[string]interface{}{"clone-from": "golden", "moved-from": "clone1@ds1"}
+	assert.Equal(t, []string{"clone1", "clone1", "golden", "golden", "clone1@ds1", "clone1"},
+		expectedLabels("clone1", "ext4", meta))
+	assert.Empty(t, expectedLabels("vol1", "zfs", map[string]interface{}{}))
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Inflate admin command.
+//
+// "inflate" has ESX convert a detached thin or zeroedthick volume to
+// eagerzeroedthick, for latency sensitive workloads. ESX refuses attached
+// volumes and thin volumes without enough free space on the datastore.
+// Docker mounts of the volume are refused here while it runs, the CLI polls
+// "inflatestatus" for the progress.
+//
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+// InflateProgress is returned by the "inflatestatus" admin command
+type InflateProgress struct {
+	Name    string
+	Percent int
+}
+
+// inflateVolume converts a volume to eagerzeroedthick
+func (d *VolumeDriver) inflateVolume(name string) error {
+	d.refCounts.StateMtx.Lock()
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err == nil {
+		name = volumeInfo.VolumeName
+		if other, exists := d.adminMounts[name]; exists {
+			err = fmt.Errorf("Volume %s is busy with %s", name, other)
+		} else if d.getRefCount(name) != 0 {
+			err = fmt.Errorf("Volume %s is mounted and can't be inflated", name)
+		} else {
+			d.adminMounts[name] = "inflate"
+		}
+	}
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.refCounts.StateMtx.Lock()
+		delete(d.adminMounts, name)
+		d.refCounts.StateMtx.Unlock()
+	}()
+
+	log.WithFields(log.Fields{"name": name}).Info("Inflating volume ")
+	if err = d.ops.Inflate(name); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Inflate failed ")
+		return err
+	}
+	log.WithFields(log.Fields{"name": name}).Info("Inflate done ")
+	return nil
+}
+
+// inflateStatus returns the progress of the inflate of a volume
+func (d *VolumeDriver) inflateStatus(name string) (*InflateProgress, error) {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := d.ops.InflateStatus()
+	if err != nil {
+		return nil, err
+	}
+	percent, exists := progress[volumeInfo.VolumeName]
+	if !exists {
+		return nil, fmt.Errorf("No inflate of %s is running", volumeInfo.VolumeName)
+	}
+	return &InflateProgress{Name: volumeInfo.VolumeName, Percent: percent}, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Move admin command.
+//
+// "move" has ESX relocate a detached volume with its metadata to another
+// datastore, where it is <volume>@<target>. Docker keeps the name it knows
+// the volume by, so the move is recorded and plugin_utils.GetVolumeInfo
+// resolves that name to the new one. The moves are kept in the plugin state
+// dir; creating a volume with a moved name drops its record. ESX keeps the
+// old full name in the volume metadata as "moved-from", the plugins on other
+// hosts record the move from there when they list the volumes or don't find
+// a volume by its old name. Docker mounts of the volume are refused here
+// while it runs, the CLI polls "movestatus" for the progress.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const (
+	moveTargetOpt = "target"     // datastore to move the volume to
+	movedFileName = "moved.json" // recorded moves in the state dir
+)
+
+// MoveProgress is returned by the "movestatus" admin command
+type MoveProgress struct {
+	Name    string
+	Percent int
+}
+
+// volumeMoves keeps the moves known to plugin_utils in a file
+type volumeMoves struct {
+	mtx  sync.Mutex // serializes saves
+	path string
+}
+
+// newVolumeMoves loads the moves recorded in stateDir into plugin_utils
+func newVolumeMoves(stateDir string) (*volumeMoves, error) {
+	m := &volumeMoves{path: filepath.Join(stateDir, movedFileName)}
+	data, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	var moves map[string]string
+	if err == nil {
+		err = json.Unmarshal(data, &moves)
+	}
+	if err != nil {
+		return m, err
+	}
+	for oldName, newName := range moves {
+		plugin_utils.SetVolumeMoved(oldName, newName)
+	}
+	return m, nil
+}
+
+// record has oldName resolve to newName from now on, an empty newName
+// drops the record of oldName
+func (m *volumeMoves) record(oldName string, newName string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	plugin_utils.SetVolumeMoved(oldName, newName)
+	data, err := json.Marshal(plugin_utils.MovedVolumes())
+	if err != nil {
+		return err
+	}
+	if err = writeFileSync(m.path+".tmp", data); err == nil {
+		err = os.Rename(m.path+".tmp", m.path)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to record volume moves: %v", err)
+	}
+	return nil
+}
+
+// forgetMove drops the record of a moved volume called name, before a new
+// volume takes the name over
+func (d *VolumeDriver) forgetMove(name string) {
+	if d.moves == nil || plugin_utils.MovedVolumeName(name) == name {
+		return
+	}
+	if err := d.moves.record(name, ""); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to forget volume move ")
+	}
+}
+
+// learnMoves records the moves of the listed volumes, made by this or
+// another host. A listed volume with the old name of a recorded move is a
+// new volume which took the name over, its record is dropped.
+func (d *VolumeDriver) learnMoves(volumes []vmdkops.VolumeData) {
+	if d.moves == nil {
+		return
+	}
+	listed := make(map[string]bool, len(volumes))
+	for _, vol := range volumes {
+		listed[vol.Name] = true
+	}
+	for oldName := range plugin_utils.MovedVolumes() {
+		if listed[oldName] {
+			d.forgetMove(oldName)
+		}
+	}
+	for _, vol := range volumes {
+		if vol.MovedFrom == "" || listed[vol.MovedFrom] ||
+			plugin_utils.MovedVolumeName(vol.MovedFrom) == vol.Name {
+			continue
+		}
+		if err := d.moves.record(vol.MovedFrom, vol.Name); err != nil {
+			log.WithFields(log.Fields{"name": vol.MovedFrom, "error": err}).Warning("Failed to record volume move ")
+		}
+	}
+}
+
+// findMove looks for the volume moved away from name, by another host,
+// and records the move. Returns the full name after the move, "" if no
+// single volume was moved from name.
+func (d *VolumeDriver) findMove(name string) string {
+	if d.moves == nil {
+		return ""
+	}
+	volumes, err := d.ops.List()
+	if err != nil {
+		return ""
+	}
+	d.learnMoves(volumes)
+	if moved := plugin_utils.MovedVolumeName(name); moved != name {
+		return moved
+	}
+	if plugin_utils.IsFullVolName(name) {
+		return ""
+	}
+	// Docker may know the volume by its short name
+	moved := ""
+	for _, vol := range volumes {
+		if vol.MovedFrom == "" || plugin_utils.SplitVolName(vol.MovedFrom)[0] != name {
+			continue
+		}
+		if moved != "" {
+			return ""
+		}
+		moved = vol.Name
+	}
+	if moved == "" || d.moves.record(name, moved) != nil {
+		return ""
+	}
+	return moved
+}
+
+// moveVolume relocates a volume to the target datastore
+func (d *VolumeDriver) moveVolume(name string, target string) error {
+	if target == "" {
+		return fmt.Errorf("Expected a target datastore")
+	}
+	d.refCounts.StateMtx.Lock()
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	fullName := ""
+	if err == nil {
+		fullName = volumeInfo.VolumeName
+		if other, exists := d.adminMounts[fullName]; exists {
+			err = fmt.Errorf("Volume %s is busy with %s", fullName, other)
+		} else if d.getRefCount(fullName) != 0 {
+			err = fmt.Errorf("Volume %s is mounted and can't be moved", fullName)
+		} else {
+			d.adminMounts[fullName] = "move"
+		}
+	}
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.refCounts.StateMtx.Lock()
+		delete(d.adminMounts, fullName)
+		d.refCounts.StateMtx.Unlock()
+	}()
+
+	log.WithFields(log.Fields{"name": fullName, "target": target}).Info("Moving volume ")
+	if err = d.ops.Move(fullName, target); err != nil {
+		log.WithFields(log.Fields{"name": fullName, "error": err}).Error("Move failed ")
+		return err
+	}
+	newName := plugin_utils.JoinVolName(plugin_utils.SplitVolName(fullName)[0], target)
+	log.WithFields(log.Fields{"name": fullName, "new name": newName}).Info("Move done ")
+
+	if d.moves != nil {
+		err = d.moves.record(fullName, newName)
+		if err == nil && name != fullName {
+			// the name Docker may know the volume by
+			err = d.moves.record(name, newName)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Volume %s moved to %s, but %v", fullName, newName, err)
+	}
+	return nil
+}
+
+// moveStatus returns the progress of the move of a volume
+func (d *VolumeDriver) moveStatus(name string) (*MoveProgress, error) {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return nil, err
+	}
+	progress, err := d.ops.MoveStatus()
+	if err != nil {
+		return nil, err
+	}
+	percent, exists := progress[volumeInfo.VolumeName]
+	if !exists {
+		return nil, fmt.Errorf("No move of %s is running", volumeInfo.VolumeName)
+	}
+	return &MoveProgress{Name: volumeInfo.VolumeName, Percent: percent}, nil
+}
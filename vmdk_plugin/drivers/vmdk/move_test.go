@@ -0,0 +1,108 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the records of moved volumes and their name resolution
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+func TestVolumeMoves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-move-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := newVolumeMoves(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, m.record("vol1@datastore1", "vol1@datastore2"))
+	assert.Nil(t, m.record("vol1", "vol1@datastore2"))
+	assert.Equal(t, "vol1@datastore2", plugin_utils.MovedVolumeName("vol1"))
+	assert.Equal(t, "vol1@datastore2", plugin_utils.MovedVolumeName("vol1@datastore1"))
+	assert.Equal(t, "vol2", plugin_utils.MovedVolumeName("vol2"))
+
+	// moved again, all the old names follow
+	assert.Nil(t, m.record("vol1@datastore2", "vol1@datastore3"))
+	assert.Equal(t, "vol1@datastore3", plugin_utils.MovedVolumeName("vol1"))
+	assert.Equal(t, "vol1@datastore3", plugin_utils.MovedVolumeName("vol1@datastore1"))
+
+	// moved back, the name it has now must not be redirected
+	assert.Nil(t, m.record("vol1@datastore3", "vol1@datastore1"))
+	assert.Equal(t, "vol1@datastore1", plugin_utils.MovedVolumeName("vol1@datastore1"))
+	assert.Equal(t, "vol1@datastore1", plugin_utils.MovedVolumeName("vol1@datastore3"))
+
+	// records survive a plugin restart
+	for oldName := range plugin_utils.MovedVolumes() {
+		plugin_utils.SetVolumeMoved(oldName, "")
+	}
+	_, err = newVolumeMoves(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "vol1@datastore1", plugin_utils.MovedVolumeName("vol1"))
+
+	assert.Nil(t, m.record("vol1", ""))
+	assert.Equal(t, "vol1", plugin_utils.MovedVolumeName("vol1"))
+	for oldName := range plugin_utils.MovedVolumes() {
+		plugin_utils.SetVolumeMoved(oldName, "")
+	}
+}
+
+// listCmd lists the volumes in list, as ESX does
+type listCmd struct {
+	list string
+}
+
+func (c listCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	return []byte(c.list), nil
+}
+
+// Test that the moves made by another host are found in the list of volumes
+func TestFindMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-move-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	d := &VolumeDriver{ops: vmdkops.VmdkOps{Cmd: listCmd{`[
+		{"Name": "vol1@datastore2", "MovedFrom": "vol1@datastore1"},
+		{"Name": "vol2@datastore1", "MovedFrom": ""}]`}}}
+	d.moves, err = newVolumeMoves(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "vol1@datastore2", d.findMove("vol1"))
+	assert.Equal(t, "vol1@datastore2", plugin_utils.MovedVolumeName("vol1@datastore1"))
+	assert.Equal(t, "", d.findMove("vol2"))
+
+	// a new volume with the old name takes it over
+	d.learnMoves([]vmdkops.VolumeData{{Name: "vol1@datastore1"},
+		{Name: "vol1@datastore2", MovedFrom: "vol1@datastore1"}})
+	assert.Equal(t, "vol1@datastore1", plugin_utils.MovedVolumeName("vol1@datastore1"))
+	for oldName := range plugin_utils.MovedVolumes() {
+		plugin_utils.SetVolumeMoved(oldName, "")
+	}
+}
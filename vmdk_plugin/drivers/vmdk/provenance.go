@@ -0,0 +1,75 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Creation provenance.
+//
+// Every volume created by the plugin records the Docker host, the plugin
+// version and what the volume was created from in its metadata. ESX adds
+// the creation time and the VM, and returns all of it in Get and List, so
+// leaked volumes can be traced back. The creation time is the Docker
+// CreatedAt of the volume.
+//
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	createdHostOpt     = "created-host"      // hostname of the creating Docker host
+	createdByPluginOpt = "created-by-plugin" // plugin version
+	createdFromOpt     = "created-from"      // clone:<volume>, seed:<source> or backup:<id>
+	createdKey         = "created"           // creation time in Get, UTC in time.ANSIC
+)
+
+// setProvenance records the creating host, the plugin version and the
+// source of the volume, if any, in the Create options
+func setProvenance(opts map[string]string, source string) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Failed to get hostname for the volume metadata: %v", err)
+	}
+	opts[createdHostOpt] = host
+	opts[createdByPluginOpt] = version
+	if source != "" {
+		opts[createdFromOpt] = source
+	}
+	return nil
+}
+
+// createSource returns the created-from value for the Create options
+func createSource(opts map[string]string) string {
+	if parent, exists := opts["clone-from"]; exists {
+		return "clone:" + parent
+	}
+	if source, exists := opts[seedOpt]; exists {
+		return "seed:" + source
+	}
+	return ""
+}
+
+// createdAt converts the creation time ESX keeps for a volume to the
+// RFC 3339 time Docker expects, "" if it is missing or invalid
+func createdAt(created interface{}) string {
+	value, _ := created.(string)
+	t, err := time.Parse(time.ANSIC, value)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
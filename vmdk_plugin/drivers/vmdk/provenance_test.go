@@ -0,0 +1,55 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the creation provenance options and CreatedAt
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetProvenance(t *testing.T) {
+	host, _ := os.Hostname()
+
+	opts := map[string]string{"size": "1gb"}
+	assert.Nil(t, setProvenance(opts, createSource(opts)))
+	assert.Equal(t, map[string]string{
+		"size":             "1gb",
+		createdHostOpt:     host,
+		createdByPluginOpt: version,
+	}, opts)
+
+	opts = map[string]string{"clone-from": "golden"}
+	assert.Nil(t, setProvenance(opts, createSource(opts)))
+	assert.Equal(t, "clone:golden", opts[createdFromOpt])
+
+	opts = map[string]string{seedOpt: "/seeds/data.tar.gz"}
+	assert.Nil(t, setProvenance(opts, createSource(opts)))
+	assert.Equal(t, "seed:/seeds/data.tar.gz", opts[createdFromOpt])
+
+	opts = map[string]string{}
+	assert.Nil(t, setProvenance(opts, "backup:20170101T120000Z"))
+	assert.Equal(t, "backup:20170101T120000Z", opts[createdFromOpt])
+}
+
+func TestCreatedAt(t *testing.T) {
+	assert.Equal(t, "2017-01-31T09:05:01Z", createdAt("Tue Jan 31 09:05:01 2017"))
+	assert.Equal(t, "2017-01-03T12:00:00Z", createdAt("Tue Jan  3 12:00:00 2017"))
+	assert.Equal(t, "", createdAt("yesterday"))
+	assert.Equal(t, "", createdAt(nil))
+}
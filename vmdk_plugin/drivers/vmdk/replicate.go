@@ -0,0 +1,106 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Volume replication to another datastore.
+//
+// "-o replicate-to=<datastore>" on Create (or the "replicate" admin command
+// later) has the plugin which has the volume mounted refresh a copy of the
+// volume on the other datastore every ReplicationMinutes. Each cycle takes a
+// snapshot of the volume, the filesystem frozen (see snapshot.go), then ESX
+// copies the snapshot over the replica and removes the snapshot. The time
+// of the last refresh and the last error are kept in the volume metadata,
+// ESX reports them with the replica lag in Get.
+//
+// If the volume datastore is lost, "promote" turns the replica into a
+// volume of the same name on the replica datastore.
+//
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	replicateToOpt         = "replicate-to"       // replica datastore
+	replicaLastSyncOpt     = "replica-last-sync"  // UTC in expiresAtFormat
+	replicaLastErrorOpt    = "replica-last-error" // empty after a good refresh
+	replicationGroupPrefix = "repl-"              // + volume name + "-"
+)
+
+// setReplicateTo changes the replica datastore of a volume, an empty
+// datastore stops replication. An existing replica is kept.
+func (d *VolumeDriver) setReplicateTo(name string, datastore string) error {
+	opts := map[string]string{
+		replicateToOpt:      datastore,
+		replicaLastErrorOpt: "",
+		replicaLastSyncOpt:  "",
+	}
+	return d.ops.Set(name, opts)
+}
+
+// runReplicator refreshes the replicas of the volumes mounted here every
+// interval, forever
+func (d *VolumeDriver) runReplicator(interval time.Duration) {
+	log.WithFields(log.Fields{"interval": interval}).Info("Starting replicator ")
+	for {
+		time.Sleep(interval)
+		for _, name := range d.mountedVolumes() {
+			meta, err := d.ops.Get(name)
+			if err != nil {
+				continue
+			}
+			if target, _ := meta[replicateToOpt].(string); target != "" {
+				d.replicateVolume(name, target, time.Now())
+			}
+		}
+	}
+}
+
+// replicateVolume refreshes the replica of a volume on target, and records
+// the result in the volume metadata
+func (d *VolumeDriver) replicateVolume(name string, target string, now time.Time) {
+	group := newSnapshotGroupID(replicationGroupPrefix+strings.SplitN(name, "@", 2)[0]+"-", now)
+	log.WithFields(log.Fields{"name": name, "target": target, "group": group}).Info("Replicating volume ")
+	err := d.takeSnapshot(group, []string{name})
+	if err == nil {
+		err = d.ops.Replicate(name, group)
+	}
+
+	state := map[string]string{replicaLastErrorOpt: ""}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "target": target, "error": err}).Error("Replication failed ")
+		state[replicaLastErrorOpt] = err.Error()
+	} else {
+		state[replicaLastSyncOpt] = now.UTC().Format(expiresAtFormat)
+	}
+	if err = d.ops.Set(name, state); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save replication state ")
+	}
+}
+
+// promoteReplica turns the replica of a volume into a volume, name is
+// volume@datastore with the replica datastore
+func (d *VolumeDriver) promoteReplica(name string) error {
+	if !strings.Contains(name, "@") {
+		return fmt.Errorf("Expected the volume name with the replica datastore, volume@datastore")
+	}
+	log.WithFields(log.Fields{"name": name}).Warning("Promoting replica to volume ")
+	return d.ops.Promote(name)
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test replica refreshes and promotion requests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
+)
+
+// fakeCmd records the commands sent to ESX, and the options of the last
+// one of each command in opts if set. It replies with replies[cmd], null if
+// there's none, and fails the commands with err.
+type fakeCmd struct {
+	runs    *[]string
+	err     error
+	replies map[string]string
+	opts    map[string]map[string]string
+}
+
+func (c fakeCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	*c.runs = append(*c.runs, cmd+" "+name)
+	if c.opts != nil {
+		c.opts[cmd] = opts
+	}
+	if reply, exists := c.replies[cmd]; exists {
+		return []byte(reply), c.err
+	}
+	return []byte("null"), c.err
+}
+
+// mountedDriver returns a driver sending its commands to cmd, with the
+// volumes mounted refcount times, and fakes freezeFs and thawFs to record
+// the mountpoints frozen in frozen. Call the returned func when done.
+func mountedDriver(cmd fakeCmd, mounted map[string]uint, frozen *[]string) (*VolumeDriver, func()) {
+	d := &VolumeDriver{ops: vmdkops.VmdkOps{Cmd: cmd},
+		refCounts:   refcount.NewRefCountsMap(),
+		adminMounts: make(map[string]string)}
+	d.refCounts.InitCounts(mounted)
+	freezeFs = func(mountpoint string) error {
+		*frozen = append(*frozen, mountpoint)
+		return nil
+	}
+	thawFs = func(mountpoint string) error {
+		return nil
+	}
+	return d, func() {
+		freezeFs = fs.Freeze
+		thawFs = fs.Thaw
+	}
+}
+
+func TestPromoteReplica(t *testing.T) {
+	var runs []string
+	cmd := fakeCmd{runs: &runs}
+	d := &VolumeDriver{ops: vmdkops.VmdkOps{Cmd: cmd}}
+
+	// the replica datastore must be given
+	assert.NotNil(t, d.promoteReplica("vol1"))
+	assert.Empty(t, runs)
+
+	assert.Nil(t, d.promoteReplica("vol1@datastore2"))
+	assert.Equal(t, []string{"promote vol1@datastore2"}, runs)
+
+	// ESX errors are returned
+	cmd.err = fmt.Errorf("No replica of volume vol1 on datastore2")
+	d.ops = vmdkops.VmdkOps{Cmd: cmd}
+	assert.Equal(t, cmd.err, d.promoteReplica("vol1@datastore2"))
+	assert.Equal(t, []string{"promote vol1@datastore2", "promote vol1@datastore2"}, runs)
+}
+
+// Test that a refresh snapshots the mounted volume frozen, then has ESX
+// copy the snapshot over the replica
+func TestReplicateVolume(t *testing.T) {
+	var runs, frozen []string
+	cmd := fakeCmd{runs: &runs, opts: make(map[string]map[string]string)}
+	d, done := mountedDriver(cmd, map[string]uint{"vol1@datastore1": 1}, &frozen)
+	defer done()
+
+	now := time.Date(2017, 3, 4, 14, 0, 0, 0, time.UTC)
+	d.replicateVolume("vol1@datastore1", "datastore2", now)
+	group := "repl-vol1-20170304-140000.000"
+	assert.Equal(t, []string{"snapshot " + group, "snapshot " + group,
+		"replicate vol1@datastore1", "set vol1@datastore1"}, runs)
+	assert.Equal(t, []string{getMountPoint("vol1@datastore1")}, frozen)
+	// the images are copied after the filesystem is thawed
+	assert.Equal(t, "true", cmd.opts["snapshot"]["copy"])
+	assert.Equal(t, group, cmd.opts["replicate"]["group"])
+	assert.Equal(t, map[string]string{replicaLastErrorOpt: "",
+		replicaLastSyncOpt: "2017-03-04T14:00:00Z"}, cmd.opts["set"])
+	assert.Equal(t, uint(1), d.getRefCount("vol1@datastore1"))
+
+	// a failed refresh is recorded, the last sync is kept
+	runs = runs[:0]
+	cmd.err = fmt.Errorf("Datastore datastore2 not found")
+	d.ops = vmdkops.VmdkOps{Cmd: cmd}
+	d.replicateVolume("vol1@datastore1", "datastore2", now)
+	assert.Equal(t, []string{"snapshot " + group, "set vol1@datastore1"}, runs)
+	assert.Equal(t, map[string]string{replicaLastErrorOpt: cmd.err.Error()}, cmd.opts["set"])
+	assert.Equal(t, uint(1), d.getRefCount("vol1@datastore1"))
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Seeding new volumes with data.
+//
+// "-o seed-from=<path>" on Create fills the new filesystem with the content
+// of a directory or tarball on the Docker host. The plugin runs as root, so
+// the source must be under one of the SeedRoots in the plugin config, and
+// seeding is disabled if there are none.
+//
+// Seeding is a create step after mkfs, while the volume is still attached
+// to this VM: the filesystem is mounted on a temp mountpoint, the data is
+// copied in (see fs.Seed()), then the filesystem is unmounted. A failed
+// seed removes the volume, as a failed mkfs does.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+)
+
+const (
+	seedOpt           = "seed-from" // Create option, plugin side only
+	seedMountpointPfx = "vsphere-seed-"
+)
+
+// seedFunc fills a new filesystem mounted at mountpoint
+type seedFunc func(mountpoint string) error
+
+// Tarball suffixes accepted for seed-from
+var seedTarSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz"}
+
+// checkSeedSource verifies that source is a directory or a tarball under
+// one of roots. Returns the source with symlinks resolved.
+func checkSeedSource(source string, roots []string) (string, error) {
+	if len(roots) == 0 {
+		return "", fmt.Errorf("Option %s is disabled, no SeedRoots in the plugin configuration", seedOpt)
+	}
+	if !filepath.IsAbs(source) {
+		return "", fmt.Errorf("Option %s needs an absolute path, got %s", seedOpt, source)
+	}
+	path, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s source %s: %v", seedOpt, source, err)
+	}
+	allowed := false
+	for _, root := range roots {
+		if root, err = filepath.EvalSymlinks(root); err == nil && isUnder(path, root) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("Source %s of %s is not under the allowed roots %v", source, seedOpt, roots)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s source %s: %v", seedOpt, source, err)
+	}
+	if stat.IsDir() {
+		return path, nil
+	}
+	if stat.Mode().IsRegular() {
+		for _, suffix := range seedTarSuffixes {
+			if strings.HasSuffix(path, suffix) {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Source %s of %s is not a directory or a tarball (%s)",
+		source, seedOpt, strings.Join(seedTarSuffixes, ", "))
+}
+
+// isUnder returns true if path is root or inside it
+func isUnder(path string, root string) bool {
+	if path == root || root == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// seedVolume mounts the filesystem on device at a temp mountpoint and
+// seeds it
+func (d *VolumeDriver) seedVolume(name string, fstype string, device string, seed seedFunc) error {
+	mountpoint, err := ioutil.TempDir("", seedMountpointPfx)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountpoint)
+
+	if err = fs.Mount(mountpoint, fstype, device, false); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"name": name}).Info("Seeding volume ")
+	errSeed := seed(mountpoint)
+	errUnmount := fs.Unmount(mountpoint)
+	if errSeed != nil {
+		return errSeed
+	}
+	return errUnmount
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the checks of seed-from sources against the allowed roots
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSeedSource(t *testing.T) {
+	top, err := ioutil.TempDir("", "vsphere-seed-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(top)
+
+	root := filepath.Join(top, "seeds")
+	other := filepath.Join(top, "other")
+	os.MkdirAll(filepath.Join(root, "data"), 0755)
+	os.MkdirAll(other, 0755)
+	ioutil.WriteFile(filepath.Join(root, "data.tar.gz"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(root, "data.txt"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(other, "data.tar"), []byte{}, 0644)
+	os.Symlink(filepath.Join(other, "data.tar"), filepath.Join(root, "escape.tar"))
+	os.Symlink(filepath.Join(root, "data"), filepath.Join(other, "link"))
+	roots := []string{root}
+
+	for _, good := range []string{"data", "data.tar.gz", "data/../data.tar.gz"} {
+		path, err := checkSeedSource(filepath.Join(root, good), roots)
+		assert.Nil(t, err, good)
+		assert.Equal(t, filepath.Clean(filepath.Join(root, good)), path)
+	}
+	// symlinks are resolved before checking the roots
+	path, err := checkSeedSource(filepath.Join(other, "link"), roots)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "data"), path)
+
+	bad := []string{
+		filepath.Join(root, "data.txt"),
+		filepath.Join(root, "missing"),
+		filepath.Join(root, "escape.tar"),
+		filepath.Join(root, "../other/data.tar"),
+		filepath.Join(top, "seeds-not"),
+		"seeds/data",
+	}
+	for _, source := range bad {
+		_, err := checkSeedSource(source, roots)
+		assert.NotNil(t, err, source)
+	}
+	_, err = checkSeedSource(filepath.Join(root, "data"), nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,230 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Consistency group snapshots.
+//
+// "snapshot" takes snapshots of several volumes at the same point in time,
+// for applications spreading their data over volumes (e.g. data and log).
+// The filesystems of the volumes mounted on this host are frozen (FIFREEZE)
+// while ESX takes a point-in-time image of all the volumes in one request:
+// a VM snapshot for volumes attached as "persistent" disks, the volume disk
+// itself for volumes no running VM writes. Then the filesystems are thawed
+// and ESX copies the images. The snapshots are recorded under a group ID,
+// and "revert" puts all the volumes of a group back to their snapshots
+// together.
+//
+// Volumes mounted on other hosts are not frozen, their snapshot is only
+// crash consistent. Docker requests wait while the filesystems are frozen,
+// so no volume is unmounted frozen.
+//
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const (
+	snapshotVolumesOpt  = "volumes" // comma separated volumes to snapshot
+	snapshotGroupPrefix = "cg-"
+	snapshotGroupFormat = "20060102-150405.000"
+)
+
+// freezeFs and thawFs freeze and thaw the filesystem at a mountpoint,
+// fake in tests
+var (
+	freezeFs = fs.Freeze
+	thawFs   = fs.Thaw
+)
+
+// newSnapshotGroupID returns a group ID for a snapshot taken at now
+func newSnapshotGroupID(prefix string, now time.Time) string {
+	return prefix + now.UTC().Format(snapshotGroupFormat)
+}
+
+// snapshotVolumes takes a consistency group snapshot of volumes.
+// Returns the group ID.
+func (d *VolumeDriver) snapshotVolumes(volumes []string) (string, error) {
+	group := newSnapshotGroupID(snapshotGroupPrefix, time.Now())
+	if err := d.takeSnapshot(group, volumes); err != nil {
+		return "", err
+	}
+	return group, nil
+}
+
+// takeSnapshot snapshots volumes as group. ESX takes a point-in-time image
+// of the volumes with the ones mounted here frozen and StateMtx held, then
+// copies the images with both released. The volumes stay pinned during the
+// copy: the mounted ones hold a reference, the others can't be mounted.
+func (d *VolumeDriver) takeSnapshot(group string, volumes []string) error {
+	d.refCounts.StateMtx.Lock()
+	names, pinned, err := d.snapshotImages(group, volumes)
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		d.refCounts.StateMtx.Lock()
+		for _, name := range names {
+			if pinned[name] {
+				d.unpinVolume(name)
+			} else {
+				delete(d.adminMounts, name)
+			}
+		}
+		d.refCounts.StateMtx.Unlock()
+	}()
+
+	log.WithFields(log.Fields{"group": group}).Info("Copying snapshot ")
+	if err = d.ops.CopySnapshot(group); err != nil {
+		log.WithFields(log.Fields{"group": group, "error": err}).Error("Snapshot failed ")
+		return err
+	}
+	return nil
+}
+
+// snapshotImages freezes the volumes mounted here and has ESX take the
+// point-in-time images of volumes as group. Returns the volume names, and
+// the ones pinned mounted; the others are marked busy in adminMounts.
+// Called with StateMtx held.
+func (d *VolumeDriver) snapshotImages(group string, volumes []string) ([]string, map[string]bool, error) {
+	if d.refCounts.GetInitSuccess() != true {
+		return nil, nil, fmt.Errorf("Volume usage is not known yet, retry later")
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, vol := range volumes {
+		if vol == "" {
+			continue
+		}
+		volumeInfo, err := plugin_utils.GetVolumeInfo(vol, "", d)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := volumeInfo.VolumeName
+		if seen[name] {
+			continue
+		}
+		if other, exists := d.adminMounts[name]; exists && d.getRefCount(name) == 0 {
+			return nil, nil, fmt.Errorf("Volume %s is busy with %s", name, other)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("No volumes given for snapshot")
+	}
+
+	var frozen []string
+	defer func() {
+		for i := len(frozen) - 1; i >= 0; i-- {
+			if err := thawFs(frozen[i]); err != nil {
+				log.WithFields(log.Fields{"group": group, "error": err}).Error("Failed to thaw ")
+			}
+		}
+	}()
+	pinned := make(map[string]bool)
+	for _, name := range names {
+		if d.getRefCount(name) == 0 {
+			continue
+		}
+		pinned[name] = true
+		mountpoint := getMountPoint(name)
+		if err := freezeFs(mountpoint); err != nil {
+			log.WithFields(log.Fields{"name": name, "group": group, "error": err}).Error("Snapshot failed ")
+			return nil, nil, err
+		}
+		frozen = append(frozen, mountpoint)
+	}
+
+	log.WithFields(log.Fields{"group": group, "volumes": names, "frozen": len(frozen)}).Info("Taking snapshot ")
+	if err := d.ops.Snapshot(group, names); err != nil {
+		log.WithFields(log.Fields{"group": group, "error": err}).Error("Snapshot failed ")
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if pinned[name] {
+			d.pinVolume(name)
+		} else {
+			d.adminMounts[name] = "snapshot"
+		}
+	}
+	return names, pinned, nil
+}
+
+// listSnapshots returns the snapshot groups
+func (d *VolumeDriver) listSnapshots() ([]vmdkops.SnapshotGroup, error) {
+	return d.ops.ListSnapshots()
+}
+
+// revertSnapshot puts the volumes of a snapshot group back to their
+// snapshots. None of the volumes may be in use, ESX checks other hosts.
+// The volumes can't be mounted here until the revert is done.
+func (d *VolumeDriver) revertSnapshot(group string) error {
+	groups, err := d.ops.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Group != group {
+			continue
+		}
+		if err = d.markReverting(g.Volumes); err != nil {
+			return err
+		}
+		defer func() {
+			d.refCounts.StateMtx.Lock()
+			for _, name := range g.Volumes {
+				delete(d.adminMounts, name)
+			}
+			d.refCounts.StateMtx.Unlock()
+		}()
+
+		log.WithFields(log.Fields{"group": group, "volumes": strings.Join(g.Volumes, ",")}).Info("Reverting to snapshot ")
+		return d.ops.Revert(group)
+	}
+	return fmt.Errorf("Snapshot group %s not found", group)
+}
+
+// markReverting marks the volumes busy with a revert, if none is in use
+func (d *VolumeDriver) markReverting(names []string) error {
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+	for _, name := range names {
+		if other, exists := d.adminMounts[name]; exists {
+			return fmt.Errorf("Volume %s is busy with %s", name, other)
+		}
+		if d.getRefCount(name) != 0 {
+			return fmt.Errorf("Volume %s is in use and can't be reverted", name)
+		}
+	}
+	for _, name := range names {
+		d.adminMounts[name] = "revert"
+	}
+	return nil
+}
+
+// removeSnapshot removes the snapshots of a group
+func (d *VolumeDriver) removeSnapshot(group string) error {
+	log.WithFields(log.Fields{"group": group}).Info("Removing snapshot ")
+	return d.ops.RemoveSnapshot(group)
+}
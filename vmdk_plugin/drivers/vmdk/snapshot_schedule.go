@@ -0,0 +1,220 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Scheduled snapshots.
+//
+// "-o snapshot-schedule=hourly;keep=24" on Create (or the "schedule" admin
+// command later) stores a snapshot schedule in the volume metadata. The
+// schedule is run by the plugin which has the volume mounted, so a volume
+// not in use gets no snapshots. Each run takes a one volume snapshot group
+// (see snapshot.go), the filesystem frozen, and removes the oldest
+// scheduled snapshots beyond the keep count.
+//
+// The time of the last and next run and the last error are kept in the
+// volume metadata, ESX reports them with the schedule state in Get.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	snapshotScheduleOpt  = "snapshot-schedule"   // <interval>[;keep=<count>]
+	snapshotLastRunOpt   = "snapshot-last-run"   // UTC in expiresAtFormat
+	snapshotNextRunOpt   = "snapshot-next-run"   // UTC in expiresAtFormat
+	snapshotLastErrorOpt = "snapshot-last-error" // empty after a good run
+
+	scheduledGroupPrefix = "sched-" // + volume name + "-"
+	defaultSnapshotKeep  = 7
+)
+
+var snapshotIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Same as kv.SNAPSHOT_SCHEDULE_PATTERN on ESX
+var snapshotSchedulePattern = regexp.MustCompile(`^(hourly|daily|weekly|([1-9][0-9]*)([mh]))(;keep=([1-9][0-9]*))?$`)
+
+// snapshotSchedule is a parsed snapshot-schedule option
+type snapshotSchedule struct {
+	interval time.Duration
+	keep     int
+}
+
+// parseSnapshotSchedule parses "<interval>[;keep=<count>]", the interval is
+// hourly, daily, weekly, <n>m or <n>h
+func parseSnapshotSchedule(value string) (snapshotSchedule, error) {
+	match := snapshotSchedulePattern.FindStringSubmatch(value)
+	if match == nil {
+		return snapshotSchedule{}, fmt.Errorf("Invalid value '%s' for option %s, expected hourly, daily, weekly, <n>m or <n>h, optionally followed by ;keep=<count>",
+			value, snapshotScheduleOpt)
+	}
+	schedule := snapshotSchedule{interval: snapshotIntervals[match[1]], keep: defaultSnapshotKeep}
+	if match[2] != "" {
+		n, _ := strconv.Atoi(match[2])
+		schedule.interval = time.Duration(n) * time.Minute
+		if match[3] == "h" {
+			schedule.interval = time.Duration(n) * time.Hour
+		}
+	}
+	if match[5] != "" {
+		schedule.keep, _ = strconv.Atoi(match[5])
+	}
+	return schedule, nil
+}
+
+// checkSnapshotSchedule verifies the snapshot-schedule Create option
+func checkSnapshotSchedule(opts map[string]string) error {
+	if value, exists := opts[snapshotScheduleOpt]; exists {
+		_, err := parseSnapshotSchedule(value)
+		return err
+	}
+	return nil
+}
+
+// setSnapshotSchedule changes the snapshot schedule of a volume, an empty
+// schedule removes it. The schedule state starts over.
+func (d *VolumeDriver) setSnapshotSchedule(name string, value string) error {
+	if value != "" {
+		if _, err := parseSnapshotSchedule(value); err != nil {
+			return err
+		}
+	}
+	opts := map[string]string{
+		snapshotScheduleOpt:  value,
+		snapshotNextRunOpt:   "",
+		snapshotLastErrorOpt: "",
+	}
+	if value == "" {
+		opts[snapshotLastRunOpt] = ""
+	}
+	return d.ops.Set(name, opts)
+}
+
+// runSnapshotScheduler checks the snapshot schedules of the volumes
+// mounted here every interval, forever
+func (d *VolumeDriver) runSnapshotScheduler(interval time.Duration) {
+	log.WithFields(log.Fields{"interval": interval}).Info("Starting snapshot scheduler ")
+	for {
+		time.Sleep(interval)
+		d.runSnapshotSchedules(time.Now())
+	}
+}
+
+// runSnapshotSchedules runs the snapshot schedules due of the volumes
+// mounted here
+func (d *VolumeDriver) runSnapshotSchedules(now time.Time) {
+	for _, name := range d.mountedVolumes() {
+		meta, err := d.ops.Get(name)
+		if err != nil {
+			continue
+		}
+		value, _ := meta[snapshotScheduleOpt].(string)
+		if value == "" {
+			continue
+		}
+		next, _ := meta[snapshotNextRunOpt].(string)
+		d.runSnapshotSchedule(name, value, next, now)
+	}
+}
+
+// mountedVolumes returns the volumes mounted here
+func (d *VolumeDriver) mountedVolumes() []string {
+	var names []string
+	d.refCounts.StateMtx.Lock()
+	defer d.refCounts.StateMtx.Unlock()
+	if d.refCounts.GetInitSuccess() {
+		for _, name := range d.VolumesInRefMap() {
+			if d.getRefCount(name) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// runSnapshotSchedule takes a scheduled snapshot of the volume if it is due
+// at now, and records the schedule state in the volume metadata
+func (d *VolumeDriver) runSnapshotSchedule(name string, value string, next string, now time.Time) {
+	state := map[string]string{snapshotLastRunOpt: now.UTC().Format(expiresAtFormat)}
+	schedule, err := parseSnapshotSchedule(value)
+	if err == nil {
+		nextRun, errNext := time.Parse(expiresAtFormat, next)
+		if errNext == nil && now.Before(nextRun) {
+			return
+		}
+		state[snapshotNextRunOpt] = nextSnapshotRun(nextRun, schedule.interval, now).Format(expiresAtFormat)
+		err = d.takeScheduledSnapshot(name, schedule, now)
+	}
+	state[snapshotLastErrorOpt] = ""
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Scheduled snapshot failed ")
+		state[snapshotLastErrorOpt] = err.Error()
+	}
+	if err = d.ops.Set(name, state); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save snapshot schedule state ")
+	}
+}
+
+// nextSnapshotRun returns the run after the one due at due, keeping the
+// schedule steady. Missed runs are skipped, the next run is after now.
+func nextSnapshotRun(due time.Time, interval time.Duration, now time.Time) time.Time {
+	if due.IsZero() || due.Add(interval).Before(now) {
+		return now.Add(interval).UTC()
+	}
+	return due.Add(interval).UTC()
+}
+
+// takeScheduledSnapshot snapshots the volume and removes the oldest
+// scheduled snapshots beyond schedule.keep
+func (d *VolumeDriver) takeScheduledSnapshot(name string, schedule snapshotSchedule, now time.Time) error {
+	prefix := scheduledGroupPrefix + strings.SplitN(name, "@", 2)[0] + "-"
+	group := newSnapshotGroupID(prefix, now)
+	log.WithFields(log.Fields{"name": name, "group": group}).Info("Taking scheduled snapshot ")
+	if err := d.takeSnapshot(group, []string{name}); err != nil {
+		return err
+	}
+
+	groups, err := d.ops.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	var scheduled []string
+	for _, g := range groups {
+		if strings.HasPrefix(g.Group, prefix) && len(g.Volumes) == 1 && g.Volumes[0] == name {
+			scheduled = append(scheduled, g.Group)
+		}
+	}
+	// group IDs sort by time
+	sort.Strings(scheduled)
+	for len(scheduled) > schedule.keep {
+		if err = d.removeSnapshot(scheduled[0]); err != nil {
+			return fmt.Errorf("Failed to remove old snapshot %s: %v", scheduled[0], err)
+		}
+		scheduled = scheduled[1:]
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test snapshot schedule parsing, run times and runs against a fake ESX
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSnapshotSchedule(t *testing.T) {
+	good := map[string]snapshotSchedule{
+		"hourly;keep=24": {time.Hour, 24},
+		"daily":          {24 * time.Hour, defaultSnapshotKeep},
+		"weekly;keep=4":  {7 * 24 * time.Hour, 4},
+		"30m":            {30 * time.Minute, defaultSnapshotKeep},
+		"12h;keep=2":     {12 * time.Hour, 2},
+	}
+	for value, expected := range good {
+		schedule, err := parseSnapshotSchedule(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, schedule, value)
+	}
+	for _, value := range []string{"", "monthly", "0m", "10s", "hourly;keep=0", "hourly;keep=", "hourly,keep=2", "1d"} {
+		_, err := parseSnapshotSchedule(value)
+		assert.NotNil(t, err, value)
+	}
+
+	assert.Nil(t, checkSnapshotSchedule(map[string]string{"size": "1gb"}))
+	assert.NotNil(t, checkSnapshotSchedule(map[string]string{snapshotScheduleOpt: "often"}))
+}
+
+func TestNextSnapshotRun(t *testing.T) {
+	now := time.Date(2017, 1, 31, 12, 3, 0, 0, time.UTC)
+	due := time.Date(2017, 1, 31, 12, 0, 0, 0, time.UTC)
+	// on time runs keep the schedule
+	assert.Equal(t, due.Add(time.Hour), nextSnapshotRun(due, time.Hour, now))
+	// first run, or missed runs, start over from now
+	assert.Equal(t, now.Add(time.Hour), nextSnapshotRun(time.Time{}, time.Hour, now))
+	assert.Equal(t, now.Add(time.Hour), nextSnapshotRun(due.Add(-2*time.Hour), time.Hour, now))
+}
+
+// Test a scheduled snapshot of a mounted volume, the oldest snapshots
+// beyond keep are removed
+func TestRunSnapshotSchedule(t *testing.T) {
+	var runs, frozen []string
+	cmd := fakeCmd{runs: &runs, opts: make(map[string]map[string]string),
+		replies: map[string]string{"snapshots": `[
+		{"Group": "sched-vol1-20170304-120000.000", "Volumes": ["vol1@datastore1"]},
+		{"Group": "sched-vol1-20170304-130000.000", "Volumes": ["vol1@datastore1"]},
+		{"Group": "sched-vol1-20170304-140000.000", "Volumes": ["vol1@datastore1"]},
+		{"Group": "cg-20170304-110000.000", "Volumes": ["vol1@datastore1"]}]`}}
+	d, done := mountedDriver(cmd, map[string]uint{"vol1@datastore1": 1}, &frozen)
+	defer done()
+
+	now := time.Date(2017, 3, 4, 14, 0, 0, 0, time.UTC)
+	d.runSnapshotSchedule("vol1@datastore1", "hourly;keep=2", "", now)
+	assert.Equal(t, []string{
+		"snapshot sched-vol1-20170304-140000.000",
+		"snapshot sched-vol1-20170304-140000.000",
+		"snapshots ",
+		"rmsnapshot sched-vol1-20170304-120000.000",
+		"set vol1@datastore1"}, runs)
+	assert.Equal(t, []string{getMountPoint("vol1@datastore1")}, frozen)
+	assert.Equal(t, "", cmd.opts["set"][snapshotLastErrorOpt])
+	assert.Equal(t, "2017-03-04T15:00:00Z", cmd.opts["set"][snapshotNextRunOpt])
+	// the pin is dropped, the volume stays mounted
+	assert.Equal(t, uint(1), d.getRefCount("vol1@datastore1"))
+	assert.Empty(t, d.adminMounts)
+
+	// not due yet
+	runs = runs[:0]
+	d.runSnapshotSchedule("vol1@datastore1", "hourly;keep=2", "2017-03-04T15:00:00Z", now)
+	assert.Empty(t, runs)
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test snapshot group IDs
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSnapshotGroupID(t *testing.T) {
+	now := time.Date(2017, 3, 4, 5, 6, 7, 890000000, time.FixedZone("PST", -8*3600))
+	group := newSnapshotGroupID(snapshotGroupPrefix, now)
+	assert.Equal(t, "cg-20170304-130607.890", group)
+	// group IDs accepted by ESX, see groupRequest() in vmdk_ops.py
+	assert.True(t, regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]*$`).MatchString(group))
+	assert.NotEqual(t, group, newSnapshotGroupID(snapshotGroupPrefix, now.Add(time.Millisecond)))
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+//
+// Background trim.
+//
+// Thin volumes don't shrink on the datastore unless the guest discards the
+// blocks freed in their filesystem. Every TrimMinutes, plus a random delay
+// of up to TrimJitterMinutes so that the Docker hosts sharing a datastore
+// don't trim at once, the plugin runs FITRIM on the volumes mounted here.
+// Volumes created with "-o trim=false" and read-only volumes are skipped.
+// The time of the last trim and the bytes trimmed are kept in the volume
+// metadata, ESX reports them in Get.
+//
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
+)
+
+const (
+	trimOpt          = "trim"            // "false" to never trim the volume
+	trimLastRunOpt   = "trim-last-run"   // UTC in expiresAtFormat
+	trimLastBytesOpt = "trim-last-bytes" // bytes trimmed by the last trim
+)
+
+// checkTrim validates the trim option
+func checkTrim(opts map[string]string) error {
+	if value, exists := opts[trimOpt]; exists && value != "true" && value != "false" {
+		return fmt.Errorf("Invalid value %s for option %s, expected true or false", value, trimOpt)
+	}
+	return nil
+}
+
+// trimEnabled returns true if the volume with meta is to be trimmed
+func trimEnabled(meta map[string]interface{}) bool {
+	if value, _ := meta[trimOpt].(string); value == "false" {
+		return false
+	}
+	return !plugin_utils.IsReadOnlyAccess(meta["access"])
+}
+
+// trimDelay returns the time to the next trim, interval plus up to jitter
+func trimDelay(interval time.Duration, jitter time.Duration, rnd *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rnd.Int63n(int64(jitter)))
+}
+
+// runTrimmer trims the volumes mounted here, forever
+func (d *VolumeDriver) runTrimmer(interval time.Duration, jitter time.Duration) {
+	log.WithFields(log.Fields{"interval": interval, "jitter": jitter}).Info("Starting trimmer ")
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		time.Sleep(trimDelay(interval, jitter, rnd))
+		for _, name := range d.mountedVolumes() {
+			meta, err := d.ops.Get(name)
+			if err != nil || !trimEnabled(meta) {
+				continue
+			}
+			d.trimVolume(name, meta, time.Now())
+		}
+	}
+}
+
+// trimVolume trims the filesystem of the mounted volume name, and records
+// the trim in the volume metadata. The volume is pinned mounted while it is
+// trimmed, with StateMtx released.
+func (d *VolumeDriver) trimVolume(name string, meta map[string]interface{}, now time.Time) {
+	d.refCounts.StateMtx.Lock()
+	mountpoint, err := d.trimMountpoint(name, meta)
+	if err != nil || mountpoint == "" {
+		d.refCounts.StateMtx.Unlock()
+		if err != nil {
+			log.WithFields(log.Fields{"name": name, "error": err}).Warning("Trim failed ")
+		}
+		return
+	}
+	d.pinVolume(name)
+	d.refCounts.StateMtx.Unlock()
+	trimmed, err := fs.Trim(mountpoint)
+	d.refCounts.StateMtx.Lock()
+	d.unpinVolume(name)
+	d.refCounts.StateMtx.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Trim failed ")
+		return
+	}
+	log.WithFields(log.Fields{"name": name, "bytes": trimmed}).Info("Volume trimmed ")
+	state := map[string]string{
+		trimLastRunOpt:   now.UTC().Format(expiresAtFormat),
+		trimLastBytesOpt: strconv.FormatUint(trimmed, 10),
+	}
+	if err = d.ops.Set(name, state); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save trim state ")
+	}
+}
+
+// trimMountpoint returns the mountpoint of the volume to trim, "" if it was
+// unmounted since the check, or an error if the filesystem mounted there
+// isn't the one of the volume. Called with StateMtx held.
+func (d *VolumeDriver) trimMountpoint(name string, meta map[string]interface{}) (string, error) {
+	if d.getRefCount(name) == 0 {
+		return "", nil
+	}
+	mountpoint := getMountPoint(name)
+	device, fstype, err := fs.GetMountInfo(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	if err = verifyLabel(name, fstype, device, meta); err != nil {
+		return "", err
+	}
+	return mountpoint, nil
+}
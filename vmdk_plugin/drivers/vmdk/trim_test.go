@@ -0,0 +1,50 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+// Test the trim option and the trim schedule
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTrim(t *testing.T) {
+	assert.Nil(t, checkTrim(map[string]string{}))
+	assert.Nil(t, checkTrim(map[string]string{trimOpt: "true"}))
+	assert.Nil(t, checkTrim(map[string]string{trimOpt: "false"}))
+	assert.NotNil(t, checkTrim(map[string]string{trimOpt: "no"}))
+}
+
+func TestTrimEnabled(t *testing.T) {
+	assert.True(t, trimEnabled(map[string]interface{}{}))
+	assert.True(t, trimEnabled(map[string]interface{}{trimOpt: "true", "access": "read-write"}))
+	assert.False(t, trimEnabled(map[string]interface{}{trimOpt: "false"}))
+	assert.False(t, trimEnabled(map[string]interface{}{"access": "read-only"}))
+	assert.False(t, trimEnabled(map[string]interface{}{"access": "read-only-many"}))
+}
+
+func TestTrimDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	assert.Equal(t, time.Hour, trimDelay(time.Hour, 0, rnd))
+	assert.Equal(t, time.Hour, trimDelay(time.Hour, -time.Minute, rnd))
+	for i := 0; i < 100; i++ {
+		delay := trimDelay(time.Hour, 10*time.Minute, rnd)
+		assert.True(t, delay >= time.Hour && delay < time.Hour+10*time.Minute, delay.String())
+	}
+}
@@ -27,22 +27,30 @@ package vmdk
 import (
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/utils/refcount"
 )
 
 const (
-	devWaitTimeout   = 1 * time.Second
-	sleepBeforeMount = 1 * time.Second
-	watchPath        = "/dev/disk/by-path"
-	version          = "vSphere Volume Driver v0.4"
+	devWaitTimeout = 1 * time.Second
+	version        = "vSphere Volume Driver v0.4"
+
+	// Lazy filesystem creation, see "format" volume option
+	formatOpt    = "format"
+	formatLazy   = "lazy"
+	formattedOpt = "formatted"
+
+	mkfsOptsOpt = "mkfs-opts" // mkfs flags, checked against the filesystem profile
 )
 
 // VolumeDriver - VMDK driver struct
@@ -51,12 +59,20 @@ type VolumeDriver struct {
 	ops           vmdkops.VmdkOps
 	refCounts     *refcount.RefCountsMap
 	mountIDtoName map[string]string // map of mountID -> full volume name
+	journal       *createJournal    // records in-flight creates, may be nil
+	async         *asyncCreates     // creates running in the background
+	seedRoots     []string          // allowed seed-from sources
+	adminMounts   map[string]string // volume -> admin command holding a mount, or the volume
+	copies        *volumeCopies     // running copy admin commands
+	ephemerals    *ephemeralVolumes // ephemeral volumes of this host
+	moves         *volumeMoves      // volumes moved to another datastore
+	fsckPolicy    string            // for volumes without a fsck-policy
 }
 
 var mountRoot string
 
 // NewVolumeDriver creates Driver which to real ESX (useMockEsx=False) or a mock
-func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName string) *VolumeDriver {
+func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName string, c config.Config) *VolumeDriver {
 	var d *VolumeDriver
 
 	vmdkops.EsxPort = port
@@ -81,6 +97,49 @@ func NewVolumeDriver(port int, useMockEsx bool, mountDir string, driverName stri
 	}
 
 	d.mountIDtoName = make(map[string]string)
+	d.adminMounts = make(map[string]string)
+	d.copies = newVolumeCopies()
+	d.seedRoots = c.SeedRoots
+	d.fsckPolicy = c.FsckPolicy
+	if !validFsckPolicy(d.fsckPolicy) {
+		log.WithFields(log.Fields{"policy": d.fsckPolicy}).Warning("Invalid FsckPolicy, filesystems are not checked ")
+		d.fsckPolicy = config.FsckNever
+	}
+
+	journal, err := newCreateJournal(c.StateDir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": c.StateDir, "error": err}).Warning("Failed to open create journal, continuing without it ")
+	}
+	d.journal = journal
+	d.async = newAsyncCreates()
+	d.ephemerals, err = newEphemeralVolumes(c.StateDir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": c.StateDir, "error": err}).Warning("Failed to read ephemeral volumes ")
+	}
+	d.recoverEphemerals()
+	d.moves, err = newVolumeMoves(c.StateDir)
+	if err != nil {
+		log.WithFields(log.Fields{"dir": c.StateDir, "error": err}).Warning("Failed to read volume moves ")
+	}
+	d.recoverCreates(c.CreateRecovery)
+	go d.asyncCreateWorker()
+	if janitor := newExpiryJanitor(c.ExpiryCheckMinutes, c.ExpiryWarningMinutes); janitor != nil {
+		go d.runExpiryJanitor(janitor)
+	}
+	if c.SnapshotCheckMinutes > 0 {
+		go d.runSnapshotScheduler(time.Duration(c.SnapshotCheckMinutes) * time.Minute)
+	}
+	if c.ReplicationMinutes > 0 {
+		go d.runReplicator(time.Duration(c.ReplicationMinutes) * time.Minute)
+	}
+	if c.AutogrowCheckMinutes > 0 {
+		go d.runAutogrowMonitor(time.Duration(c.AutogrowCheckMinutes) * time.Minute)
+	}
+	if c.TrimMinutes > 0 {
+		go d.runTrimmer(time.Duration(c.TrimMinutes)*time.Minute,
+			time.Duration(c.TrimJitterMinutes)*time.Minute)
+	}
+
 	d.refCounts.Init(d, mountDir, driverName)
 
 	log.WithFields(log.Fields{
@@ -125,6 +184,25 @@ func (d *VolumeDriver) decrRefCount(vol string) (uint, error) {
 	return d.refCounts.Decr(vol)
 }
 
+// pinVolume keeps a mounted volume mounted and attached while an admin
+// command uses it with StateMtx released, the unmount of the last container
+// is left to unpinVolume. Called with StateMtx held.
+func (d *VolumeDriver) pinVolume(name string) {
+	d.incrRefCount(name)
+}
+
+// unpinVolume drops the reference taken by pinVolume, and unmounts the
+// volume if no container uses it anymore. Called with StateMtx held.
+func (d *VolumeDriver) unpinVolume(name string) {
+	refcnt, err := d.decrRefCount(name)
+	if err != nil || refcnt > 0 {
+		return
+	}
+	if err = d.UnmountVolume(name); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to unmount ")
+	}
+}
+
 // Returns the given volume mountpoint
 func getMountPoint(volName string) string {
 	return filepath.Join(mountRoot, volName)
@@ -132,6 +210,17 @@ func getMountPoint(volName string) string {
 
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
+	if v := d.ephemerals.get(r.Name); v != nil {
+		return volume.Response{Volume: &volume.Volume{Name: r.Name,
+			Mountpoint: getEphemeralMountPoint(r.Name),
+			Status:     ephemeralStatus(v)}}
+	}
+	// Volumes still being created are not known to ESX yet
+	if status := d.async.status(r.Name); status != nil {
+		return volume.Response{Volume: &volume.Volume{Name: r.Name,
+			Mountpoint: getMountPoint(r.Name),
+			Status:     status}}
+	}
 	status, err := d.GetVolume(r.Name)
 	if err != nil {
 		return volume.Response{Err: err.Error()}
@@ -139,6 +228,7 @@ func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 	mountpoint := getMountPoint(r.Name)
 	return volume.Response{Volume: &volume.Volume{Name: r.Name,
 		Mountpoint: mountpoint,
+		CreatedAt:  createdAt(status[createdKey]),
 		Status:     status}}
 }
 
@@ -148,85 +238,227 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
+	d.learnMoves(volumes)
 	responseVolumes := make([]*volume.Volume, 0, len(volumes))
 	for _, vol := range volumes {
 		mountpoint := getMountPoint(vol.Name)
-		responseVol := volume.Volume{Name: vol.Name, Mountpoint: mountpoint}
+		responseVol := volume.Volume{Name: vol.Name, Mountpoint: mountpoint,
+			CreatedAt: createdAt(vol.Created)}
+		// ESX returns user labels as volume attributes, and the creation
+		// provenance as in Get
+		if len(vol.Attributes) != 0 || len(vol.Provenance) != 0 {
+			responseVol.Status = make(map[string]interface{})
+			for key, value := range vol.Provenance {
+				responseVol.Status[key] = value
+			}
+			if len(vol.Attributes) != 0 {
+				responseVol.Status[labelsKey] = vol.Attributes
+			}
+		}
 		responseVolumes = append(responseVolumes, &responseVol)
 	}
+	for _, v := range d.ephemerals.list() {
+		responseVolumes = append(responseVolumes, &volume.Volume{Name: v.Name,
+			Mountpoint: getEphemeralMountPoint(v.Name)})
+	}
 	return volume.Response{Volumes: responseVolumes}
 }
 
 // GetVolume - return volume meta-data.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
-	return d.ops.Get(name)
+	volumeMeta, err := d.ops.Get(plugin_utils.MovedVolumeName(name))
+	if err != nil && plugin_utils.MovedVolumeName(name) == name {
+		// the volume may have been moved by another host
+		if moved := d.findMove(name); moved != "" {
+			return d.ops.Get(moved)
+		}
+	}
+	return volumeMeta, err
 }
 
 // MountVolume - Request attach and them mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
 // Returns mount point and  error (or nil)
 func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
-	mountpoint := getMountPoint(name)
+	mountpoint, _, err := d.mountVolume(name, fstype, isReadOnly, false)
+	return mountpoint, err
+}
+
+// mountVolume does the job for MountVolume. With formatIfBlank the
+// filesystem is created first if the device has no signature on it, this
+// is the first mount of a volume created with "format=lazy".
+func (d *VolumeDriver) mountVolume(name string, fstype string, isReadOnly bool, formatIfBlank bool) (string, string, error) {
+	return d.mountVolumeAt(name, getMountPoint(name), fstype, isReadOnly, formatIfBlank)
+}
 
+// mountVolumeAt attaches the volume and mounts it at mountpoint. Returns
+// the mountpoint and, once it is verified to be the volume, the device, for
+// releaseAndDetach if the mount fails.
+func (d *VolumeDriver) mountVolumeAt(name string, mountpoint string, fstype string, isReadOnly bool, formatIfBlank bool) (string, string, error) {
 	// First, make sure  that mountpoint exists.
 	err := fs.Mkdir(mountpoint)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": name, "dir": mountpoint},
 		).Error("Failed to make directory for volume mount ")
-		return mountpoint, err
+		return mountpoint, "", err
 	}
 
-	watcher, skipInotify := fs.DevAttachWaitPrep(name, watchPath)
+	watcher := fs.DevAttachWaitPrep(name)
+	defer watcher.Close()
 
 	// Have ESX attach the disk
 	dev, err := d.ops.Attach(name, nil)
 	if err != nil {
-		return mountpoint, err
+		return mountpoint, "", err
 	}
 
 	if d.useMockEsx {
-		return mountpoint, fs.Mount(mountpoint, fstype, string(dev[:]), false)
+		return mountpoint, "", fs.Mount(mountpoint, fstype, string(dev[:]), false)
 	}
 
 	device, err := fs.GetDevicePath(dev)
 	if err != nil {
-		return mountpoint, err
+		return mountpoint, "", err
 	}
 
-	if skipInotify {
-		time.Sleep(sleepBeforeMount)
-		return mountpoint, fs.Mount(mountpoint, fstype, device, false)
+	// May time out waiting for the attach to complete,
+	// attempt the mount anyway.
+	device = fs.DevAttachWait(watcher, name, device)
+	if err = fs.VerifyDevice(dev, device); err != nil {
+		return mountpoint, "", err
 	}
 
-	fs.DevAttachWait(watcher, name, device)
+	meta, err := d.ops.Get(name)
+	if err != nil {
+		return mountpoint, device, err
+	}
 
-	// May have timed out waiting for the attach to complete,
-	// attempt the mount anyway.
-	return mountpoint, fs.Mount(mountpoint, fstype, device, isReadOnly)
+	if formatIfBlank {
+		if err = d.formatIfBlank(name, fstype, device, meta); err != nil {
+			return mountpoint, device, err
+		}
+	}
+
+	if err = verifyLabel(name, fstype, device, meta); err != nil {
+		return mountpoint, device, err
+	}
+
+	if err = d.checkFilesystem(name, fstype, device, isReadOnly, meta); err != nil {
+		return mountpoint, device, err
+	}
+
+	return mountpoint, device, fs.Mount(mountpoint, fstype, device, isReadOnly)
+}
+
+// formatIfBlank creates the filesystem on the device of a "format=lazy"
+// volume, unless blkid finds something on it already, and records in the
+// volume metadata that the volume is formatted
+func (d *VolumeDriver) formatIfBlank(name string, fstype string, device string, meta map[string]interface{}) error {
+	blank, err := fs.IsBlankDevice(device)
+	if err != nil {
+		return err
+	}
+	if blank {
+		mkfscmd, exists := fs.MkfsLookup()[fstype]
+		if !exists {
+			return fmt.Errorf("Not found mkfs for %s", fstype)
+		}
+		mkfsOpts, _ := meta[mkfsOptsOpt].(string)
+		log.WithFields(log.Fields{"name": name, "fstype": fstype,
+			"device": device}).Info("Creating filesystem on first mount ")
+		// the label recorded at create, name may be the full name by now
+		if err = fs.Mkfs(mkfscmd, fsLabel(name, meta), device, mkfsOpts); err != nil {
+			return err
+		}
+	} else {
+		log.WithFields(log.Fields{"name": name,
+			"device": device}).Info("Device already has a filesystem, skipping mkfs ")
+	}
+
+	d.markFormatted(name)
+	return nil
+}
+
+// markFormatted records in the volume metadata that the volume has its
+// filesystem. If this fails the next mount retries it, and finds the
+// filesystem.
+func (d *VolumeDriver) markFormatted(name string) {
+	err := d.ops.Set(name, map[string]string{formattedOpt: "true"})
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to mark volume as formatted ")
+	}
 }
 
-// UnmountVolume - Unmounts the volume and then requests detach
+// UnmountVolume - Unmounts the volume, removes its device from this VM
+// and then requests detach
 func (d *VolumeDriver) UnmountVolume(name string) error {
 	mountpoint := getMountPoint(name)
+	device, _, errInfo := fs.GetMountInfo(mountpoint)
 	err := fs.Unmount(mountpoint)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
+		return d.ops.Detach(name, nil)
 	}
-	return d.ops.Detach(name, nil)
+	if errInfo != nil {
+		device = ""
+	}
+	return d.releaseAndDetach(name, device)
+}
+
+// releaseAndDetach removes the device of an unmounted volume from this VM
+// and detaches the volume. The detach goes ahead if the device isn't
+// removed, or isn't known (""). If the detach fails the device is brought
+// back.
+func (d *VolumeDriver) releaseAndDetach(name string, device string) error {
+	released := false
+	if device != "" {
+		if err := fs.ReleaseDevice(device); err != nil {
+			log.WithFields(log.Fields{"name": name, "device": device,
+				"error": err}).Warning("Failed to release device before detach ")
+		} else {
+			released = true
+		}
+	}
+	errDetach := d.ops.Detach(name, nil)
+	if errDetach != nil && released {
+		if err := fs.RescanScsiHosts(); err != nil {
+			log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to restore device after failed detach ")
+		}
+	}
+	return errDetach
 }
 
 // private function that does the job of mounting volume in conjunction with refcounting
 func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
+	if err := d.async.checkReady(r.Name); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Volume is not ready ")
+		return volume.Response{Err: err.Error()}
+	}
+
 	volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
 	if err != nil {
 		log.Errorf("Unable to get volume info for volume %s. err:%v", r.Name, err)
 		return volume.Response{Err: err.Error()}
 	}
+	requestedName := r.Name
 	r.Name = volumeInfo.VolumeName
+
+	// Containers must not get the read-only mount of an admin command
+	if cmd, exists := d.adminMounts[r.Name]; exists {
+		msg := fmt.Sprintf("Volume %s is busy with %s, retry later", r.Name, cmd)
+		log.WithFields(log.Fields{"name": r.Name}).Error(msg)
+		return volume.Response{Err: msg}
+	}
+	if d.getRefCount(r.Name) > 0 {
+		if err = d.checkExclusive(r.Name, requestedName, volumeInfo.VolumeMeta); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Mount refused ")
+			return volume.Response{Err: err.Error()}
+		}
+	}
 	d.mountIDtoName[r.ID] = r.Name
 
 	// If the volume is already mounted , just increase the refcount.
@@ -266,7 +498,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		msg := fmt.Sprintf("Invalid access type for %s, assuming read-write access.", r.Name)
 		log.WithFields(log.Fields{"name": r.Name, "error": msg}).Error("")
 		isReadOnly = false
-	} else if value == "read-only" {
+	} else if plugin_utils.IsReadOnlyAccess(value) {
 		isReadOnly = true
 	}
 
@@ -281,7 +513,11 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	}
 	fstype = value
 
-	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false)
+	// Volumes created with format=lazy get their filesystem on first mount
+	formatted, exists := volumeMeta[formattedOpt].(string)
+	formatIfBlank := exists && formatted == "false"
+
+	mountpoint, device, err := d.mountVolume(r.Name, fstype, isReadOnly, formatIfBlank)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
@@ -290,7 +526,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		refcnt, _ := d.decrRefCount(r.Name)
 		if refcnt == 0 {
 			log.Infof("Detaching %s - it is not used anymore", r.Name)
-			d.ops.Detach(r.Name, nil) // try to detach before failing the request for volume
+			d.releaseAndDetach(r.Name, device) // try to detach before failing the request for volume
 		}
 		return volume.Response{Err: err.Error()}
 	}
@@ -308,13 +544,58 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	if r.Options == nil {
 		r.Options = make(map[string]string)
 	}
+	if _, exists := r.Options[ephemeralOfOpt]; exists {
+		if err := d.createEphemeral(r.Name, r.Options); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{Err: ""}
+	}
+	async, err := isAsyncCreate(r.Options)
+	if err == nil {
+		err = setExpiry(r.Options, time.Now())
+	}
+	if err == nil {
+		err = checkSnapshotSchedule(r.Options)
+	}
+	if err == nil {
+		err = checkAutogrow(r.Options)
+	}
+	if err == nil {
+		err = checkFsckPolicy(r.Options)
+	}
+	if err == nil {
+		err = checkTrim(r.Options)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+		return volume.Response{Err: err.Error()}
+	}
+
+	if source, exists := r.Options[seedOpt]; exists {
+		r.Options[seedOpt], err = d.checkSeed(source, r.Options)
+		if err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+			return volume.Response{Err: err.Error()}
+		}
+	}
+	if err = setProvenance(r.Options, createSource(r.Options)); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+		return volume.Response{Err: err.Error()}
+	}
+
 	// If cloning a existent volume, create and return
 	if _, result := r.Options["clone-from"]; result == true {
+		if async {
+			return volume.Response{Err: "Option " + asyncCreateOpt + " is not supported with clone-from"}
+		}
 		errClone := d.ops.Create(r.Name, r.Options)
 		if errClone != nil {
 			log.WithFields(log.Fields{"name": r.Name, "error": errClone}).Error("Clone volume failed ")
 			return volume.Response{Err: errClone.Error()}
 		}
+		// the clone takes over the name of a moved volume
+		d.forgetMove(r.Name)
 		return volume.Response{Err: ""}
 	}
 
@@ -323,6 +604,14 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		r.Options["fstype"] = fs.FstypeDefault
 	}
 
+	// Verify the filesystem is supported, with the mkfs-opts given
+	_, err = fs.CheckMkfsOpts(r.Options["fstype"], r.Options[mkfsOptsOpt])
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+		return volume.Response{Err: err.Error()}
+	}
+	setFsLabel(r.Name, r.Options)
+
 	// Get existent filesystem tools
 	supportedFs := fs.MkfsLookup()
 
@@ -331,97 +620,272 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 	if result == false {
 		msg := "Not found mkfs for " + r.Options["fstype"]
 		msg += "\nSupported filesystems found: "
-		validfs := ""
+		validfs := make([]string, 0, len(supportedFs))
 		for fs := range supportedFs {
-			if validfs != "" {
-				validfs += ", " + fs
-			} else {
-				validfs += fs
-			}
+			validfs = append(validfs, fs)
 		}
+		sort.Strings(validfs)
 		log.WithFields(log.Fields{"name": r.Name,
 			"fstype": r.Options["fstype"]}).Error("Not found ")
-		return volume.Response{Err: msg + validfs}
+		return volume.Response{Err: msg + strings.Join(validfs, ", ")}
+	}
+
+	if async {
+		err = d.async.add(r.Name, r.Options, mkfscmd)
+		if err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Create volume failed ")
+			return volume.Response{Err: err.Error()}
+		}
+		log.WithFields(log.Fields{"name": r.Name,
+			"fstype": r.Options["fstype"]}).Info("Volume create queued ")
+		return volume.Response{Err: ""}
+	}
+
+	err = d.createVolume(r.Name, r.Options, mkfscmd)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	return volume.Response{Err: ""}
+}
+
+// checkSeed validates the seed-from option, returns the source to seed from
+func (d *VolumeDriver) checkSeed(source string, opts map[string]string) (string, error) {
+	if _, clone := opts["clone-from"]; clone {
+		return "", fmt.Errorf("Option %s is not supported with clone-from", seedOpt)
+	}
+	if opts[formatOpt] == formatLazy {
+		return "", fmt.Errorf("Option %s is not supported with %s=%s", seedOpt, formatOpt, formatLazy)
+	}
+	return checkSeedSource(source, d.seedRoots)
+}
+
+// createVolume creates the VMDK on ESX and the filesystem on it, and
+// seeds the filesystem if asked to.
+// On failure the volume is removed, unless only the final detach failed.
+func (d *VolumeDriver) createVolume(name string, opts map[string]string, mkfscmd string) error {
+	var seed seedFunc
+	// seeding is done by the plugin, ESX does not know the option
+	if source, exists := opts[seedOpt]; exists {
+		delete(opts, seedOpt)
+		seed = func(mountpoint string) error {
+			return fs.Seed(source, mountpoint)
+		}
 	}
+	return d.createSeededVolume(name, opts, mkfscmd, seed)
+}
+
+// createSeededVolume does the job for createVolume, seed is called with
+// the new filesystem mounted unless it is nil
+func (d *VolumeDriver) createSeededVolume(name string, opts map[string]string, mkfscmd string, seed seedFunc) error {
+	fstype := opts["fstype"]
 
-	errCreate := d.ops.Create(r.Name, r.Options)
+	d.recordStep(name, fstype, createStepRequested)
+	errCreate := d.ops.Create(name, opts)
 	if errCreate != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
-		return volume.Response{Err: errCreate.Error()}
+		log.WithFields(log.Fields{"name": name, "error": errCreate}).Error("Create volume failed ")
+		d.journal.clear(name)
+		return errCreate
+	}
+	d.recordStep(name, fstype, createStepCreated)
+
+	if opts[formatOpt] == formatLazy {
+		d.forgetMove(name)
+		d.journal.clear(name)
+		log.WithFields(log.Fields{"name": name,
+			"fstype": fstype}).Info("Volume created, filesystem will be created on first mount ")
+		return nil
 	}
 
 	// Handle filesystem creation
-	log.WithFields(log.Fields{"name": r.Name,
-		"fstype": r.Options["fstype"]}).Info("Attaching volume and creating filesystem ")
+	log.WithFields(log.Fields{"name": name,
+		"fstype": fstype}).Info("Attaching volume and creating filesystem ")
+
+	device, errFormat := d.formatVolume(name, fstype, mkfscmd, opts[mkfsOptsOpt])
+	if errFormat != nil {
+		log.WithFields(log.Fields{"name": name,
+			"error": errFormat}).Error("Create filesystem failed, removing the volume ")
+		d.removeFailedVolume(name)
+		return errFormat
+	}
+
+	if seed != nil {
+		d.recordStep(name, fstype, createStepSeeding)
+		errSeed := d.seedVolume(name, fstype, device, seed)
+		if errSeed != nil {
+			log.WithFields(log.Fields{"name": name,
+				"error": errSeed}).Error("Seed volume failed, removing the volume ")
+			d.detachFailedVolume(name, device)
+			d.removeFailedVolume(name)
+			return errSeed
+		}
+	}
+
+	// the new volume, kept even if the detach fails, takes over the name
+	// of a moved one
+	d.forgetMove(name)
+	errDetach := d.releaseAndDetach(name, device)
+	if errDetach != nil {
+		log.WithFields(log.Fields{"name": name, "error": errDetach}).Error("Detach volume failed ")
+		return errDetach
+	}
+	// ESX attaches read-only-many volumes persistent until they're formatted
+	if plugin_utils.IsReadOnlyManyAccess(opts["access"]) {
+		d.markFormatted(name)
+	}
+	d.journal.clear(name)
+
+	log.WithFields(log.Fields{"name": name,
+		"fstype": fstype}).Info("Volume and filesystem created ")
+	return nil
+}
+
+// recordStep saves create progress in the journal, and for async
+// creates makes it visible in Get
+func (d *VolumeDriver) recordStep(name string, fstype string, step createStep) {
+	d.journal.record(name, fstype, step)
+	d.async.setStep(name, step)
+}
 
-	watcher, skipInotify := fs.DevAttachWaitPrep(r.Name, watchPath)
+// formatVolume attaches the volume to this VM and creates the filesystem
+// on it. On success the volume is left attached and its device path is
+// returned, on failure an attempt is made to detach it. Progress is
+// recorded in the create journal.
+func (d *VolumeDriver) formatVolume(name string, fstype string, mkfscmd string, mkfsOpts string) (string, error) {
+	watcher := fs.DevAttachWaitPrep(name)
+	defer watcher.Close()
 
-	dev, errAttach := d.ops.Attach(r.Name, nil)
+	dev, errAttach := d.ops.Attach(name, nil)
 	if errAttach != nil {
-		log.WithFields(log.Fields{"name": r.Name,
-			"error": errAttach}).Error("Attach volume failed, removing the volume ")
+		log.WithFields(log.Fields{"name": name, "error": errAttach}).Error("Attach volume failed ")
 		// An internal error for the attach may have the volume attached to this client,
-		// detach before removing below.
-		d.ops.Detach(r.Name, nil)
-		errRemove := d.ops.Remove(r.Name, nil)
-		if errRemove != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": errRemove}).Warning("Remove volume failed ")
-		}
-		return volume.Response{Err: errAttach.Error()}
+		// detach before returning.
+		d.ops.Detach(name, nil)
+		return "", errAttach
 	}
+	d.recordStep(name, fstype, createStepAttached)
 
 	device, errGetDevicePath := fs.GetDevicePath(dev)
 	if errGetDevicePath != nil {
-		log.WithFields(log.Fields{"name": r.Name,
-			"error": errGetDevicePath}).Error("Could not find attached device, removing the volume ")
-		errDetach := d.ops.Detach(r.Name, nil)
-		if errDetach != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Warning("Detach volume failed ")
-		}
-		errRemove := d.ops.Remove(r.Name, nil)
-		if errRemove != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": errRemove}).Warning("Remove volume failed ")
-		}
-		return volume.Response{Err: errGetDevicePath.Error()}
+		log.WithFields(log.Fields{"name": name,
+			"error": errGetDevicePath}).Error("Could not find attached device ")
+		d.detachFailedVolume(name, "")
+		return "", errGetDevicePath
+	}
+
+	// Wait for the attach to complete, may timeout
+	// in which case we continue creating the file system.
+	device = fs.DevAttachWait(watcher, name, device)
+	if errVerify := fs.VerifyDevice(dev, device); errVerify != nil {
+		log.WithFields(log.Fields{"name": name, "error": errVerify}).Error("Attached device is not the volume ")
+		// not the volume, its device is left alone
+		d.detachFailedVolume(name, "")
+		return "", errVerify
+	}
+	errMkfs := fs.Mkfs(mkfscmd, name, device, mkfsOpts)
+	if errMkfs != nil {
+		d.detachFailedVolume(name, device)
+		return "", errMkfs
 	}
+	d.recordStep(name, fstype, createStepFormatted)
+	return device, nil
+}
 
-	if skipInotify {
-		time.Sleep(sleepBeforeMount)
-	} else {
-		// Wait for the attach to complete, may timeout
-		// in which case we continue creating the file system.
-		fs.DevAttachWait(watcher, r.Name, device)
+// detachFailedVolume detaches a volume after a failed create step, with
+// releaseAndDetach if its device is known
+func (d *VolumeDriver) detachFailedVolume(name string, device string) {
+	errDetach := d.releaseAndDetach(name, device)
+	if errDetach != nil {
+		log.WithFields(log.Fields{"name": name, "error": errDetach}).Warning("Detach volume failed ")
 	}
-	errMkfs := fs.Mkfs(mkfscmd, r.Name, device)
-	if errMkfs != nil {
-		log.WithFields(log.Fields{"name": r.Name,
-			"error": errMkfs}).Error("Create filesystem failed, removing the volume ")
-		errDetach := d.ops.Detach(r.Name, nil)
-		if errDetach != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Warning("Detach volume failed ")
+}
+
+// removeFailedVolume removes a volume whose create failed. The journal
+// record is kept if the remove fails, so it is retried on plugin restart.
+func (d *VolumeDriver) removeFailedVolume(name string) {
+	errRemove := d.ops.Remove(name, nil)
+	if errRemove != nil {
+		log.WithFields(log.Fields{"name": name, "error": errRemove}).Warning("Remove volume failed ")
+		return
+	}
+	d.journal.clear(name)
+}
+
+// recoverCreates finishes or rolls back the creates interrupted by a plugin
+// crash or restart, as found in the create journal. Volumes left attached
+// are detached, then depending on policy the filesystem is (re)created or
+// the volume is removed.
+func (d *VolumeDriver) recoverCreates(policy string) {
+	for _, rec := range d.journal.pending() {
+		fields := log.Fields{"name": rec.Name, "step": rec.Step, "policy": policy}
+		log.WithFields(fields).Warning("Recovering interrupted volume create ")
+
+		if _, err := d.ops.Get(rec.Name); err != nil {
+			// Create never made it to ESX, nothing to clean up.
+			log.WithFields(fields).Info("Volume not found, dropping create journal record ")
+			d.journal.clear(rec.Name)
+			continue
 		}
-		errRemove := d.ops.Remove(r.Name, nil)
-		if errRemove != nil {
-			log.WithFields(log.Fields{"name": r.Name, "error": errRemove}).Warning("Remove volume failed ")
+
+		// The volume may still be attached to this VM, the detach failure
+		// is expected if it is not.
+		if err := d.ops.Detach(rec.Name, nil); err != nil {
+			log.WithFields(fields).Debugf("Detach during recovery failed: %v", err)
 		}
-		return volume.Response{Err: errMkfs.Error()}
-	}
 
-	errDetach := d.ops.Detach(r.Name, nil)
-	if errDetach != nil {
-		log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Error("Detach volume failed ")
-		return volume.Response{Err: errDetach.Error()}
-	}
+		if rec.Step == createStepFormatted {
+			log.WithFields(fields).Info("Volume and filesystem created ")
+			d.journal.clear(rec.Name)
+			continue
+		}
 
-	log.WithFields(log.Fields{"name": r.Name,
-		"fstype": r.Options["fstype"]}).Info("Volume and filesystem created ")
-	return volume.Response{Err: ""}
+		// A partly seeded volume is of no use, whatever the policy
+		if policy == config.CreateRecoveryMkfs && rec.Step != createStepSeeding {
+			mkfscmd, exists := fs.MkfsLookup()[rec.Fstype]
+			var err error
+			if exists {
+				var meta map[string]interface{}
+				if meta, err = d.ops.Get(rec.Name); err == nil {
+					mkfsOpts, _ := meta[mkfsOptsOpt].(string)
+					_, err = d.formatVolume(rec.Name, rec.Fstype, mkfscmd, mkfsOpts)
+				}
+			}
+			if exists && err == nil {
+				if err := d.ops.Detach(rec.Name, nil); err == nil {
+					log.WithFields(fields).Info("Volume and filesystem created ")
+					d.journal.clear(rec.Name)
+					continue
+				}
+			}
+			log.WithFields(fields).Error("Failed to create filesystem during recovery, removing the volume ")
+		}
+		d.removeFailedVolume(rec.Name)
+	}
 }
 
 // Remove - removes individual volume. Docker would call it only if is not using it anymore
 func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Removing volume ")
 
+	if d.ephemerals.get(r.Name) != nil {
+		if err := d.removeEphemeral(r.Name); err != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to remove volume ")
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{Err: ""}
+	}
+
+	// A failed async create may have left nothing on ESX to remove
+	failed := d.async.status(r.Name) != nil
+	if err := d.async.forget(r.Name); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to remove volume ")
+		return volume.Response{Err: err.Error()}
+	}
+	if failed {
+		if _, err := d.ops.Get(r.Name); err != nil {
+			return volume.Response{Err: ""}
+		}
+	}
+
 	// Docker is supposed to block 'remove' command if the volume is used. Verify.
 	if d.getRefCount(r.Name) != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
@@ -430,19 +894,23 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 		return volume.Response{Err: msg}
 	}
 
-	err := d.ops.Remove(r.Name, r.Options)
+	err := d.ops.Remove(plugin_utils.MovedVolumeName(r.Name), r.Options)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err},
 		).Error("Failed to remove volume ")
 		return volume.Response{Err: err.Error()}
 	}
+	d.forgetMove(r.Name)
 
 	return volume.Response{Err: ""}
 }
 
 // Path - give docker a reminder of the volume mount path
 func (d *VolumeDriver) Path(r volume.Request) volume.Response {
+	if d.ephemerals.get(r.Name) != nil {
+		return volume.Response{Mountpoint: getEphemeralMountPoint(r.Name)}
+	}
 	return volume.Response{Mountpoint: getMountPoint(r.Name)}
 }
 
@@ -461,6 +929,10 @@ func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
+	if v := d.ephemerals.get(r.Name); v != nil {
+		return d.mountEphemeral(v)
+	}
+
 	// checked by refcounting thread until refmap initialized
 	// useless after that
 	d.refCounts.MarkDirty()
@@ -477,6 +949,10 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 	d.refCounts.StateMtx.Lock()
 	defer d.refCounts.StateMtx.Unlock()
 
+	if v := d.ephemerals.get(r.Name); v != nil {
+		return d.unmountEphemeral(v)
+	}
+
 	if d.refCounts.GetInitSuccess() != true {
 		// if refcounting hasn't been succesful,
 		// no refcounting, no unmount. All unmounts are delayed
@@ -68,6 +68,8 @@ func (mockCmd MockVmdkCmd) Run(cmd string, name string, opts map[string]string)
 		return getBlockDeviceForName(name)
 	case "detach":
 		return nil, nil
+	case "set":
+		return nil, get(name)
 	case "remove":
 		err := remove(name)
 		return nil, err
@@ -146,7 +148,7 @@ func createBlockDevice(label string, opts map[string]string) error {
 	if result == false {
 		return fmt.Errorf("Not found mkfs for %s", opts["fstype"])
 	}
-	return fs.Mkfs(mkfscmd, label, device)
+	return fs.Mkfs(mkfscmd, label, device, opts["mkfs-opts"])
 }
 
 func getBlockDeviceForName(name string) ([]byte, error) {
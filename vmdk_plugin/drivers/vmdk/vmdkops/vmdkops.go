@@ -18,6 +18,9 @@ package vmdkops
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 )
 
@@ -43,6 +46,16 @@ type VmdkOps struct {
 type VolumeData struct {
 	Name       string
 	Attributes map[string]string
+	Created    string            // creation time, as "created" in Get
+	Provenance map[string]string // who created the volume from what
+	MovedFrom  string            // full name before a move, "" if not moved
+}
+
+// SnapshotGroup is a set of volume snapshots taken together
+type SnapshotGroup struct {
+	Group   string
+	Created string
+	Volumes []string
 }
 
 // Create a volume
@@ -76,6 +89,13 @@ func (v VmdkOps) Detach(name string, opts map[string]string) error {
 	return err
 }
 
+// Set changes volume options kept in the volume metadata
+func (v VmdkOps) Set(name string, opts map[string]string) error {
+	log.Debugf("vmdkOps.Set name=%s opts=%v", name, opts)
+	_, err := v.Cmd.Run("set", name, opts)
+	return err
+}
+
 // List all volumes
 func (v VmdkOps) List() ([]VolumeData, error) {
 	log.Debugf("vmdkOps.List")
@@ -109,3 +129,121 @@ func (v VmdkOps) Get(name string) (map[string]interface{}, error) {
 	}
 	return statusMap, nil
 }
+
+// Snapshot takes point-in-time images of volumes (full names) in one
+// request, as group. CopySnapshot makes the snapshots of them.
+func (v VmdkOps) Snapshot(group string, volumes []string) error {
+	log.Debugf("vmdkOps.Snapshot group=%s volumes=%v", group, volumes)
+	_, err := v.Cmd.Run("snapshot", group, map[string]string{"volumes": strings.Join(volumes, ",")})
+	return err
+}
+
+// CopySnapshot copies the point-in-time images Snapshot took of the volumes
+// of group into the snapshots
+func (v VmdkOps) CopySnapshot(group string) error {
+	log.Debugf("vmdkOps.CopySnapshot group=%s", group)
+	_, err := v.Cmd.Run("snapshot", group, map[string]string{"copy": "true"})
+	return err
+}
+
+// Revert the volumes of a snapshot group to the snapshots
+func (v VmdkOps) Revert(group string) error {
+	log.Debugf("vmdkOps.Revert group=%s", group)
+	_, err := v.Cmd.Run("revert", group, make(map[string]string))
+	return err
+}
+
+// RemoveSnapshot removes the snapshots of a group
+func (v VmdkOps) RemoveSnapshot(group string) error {
+	log.Debugf("vmdkOps.RemoveSnapshot group=%s", group)
+	_, err := v.Cmd.Run("rmsnapshot", group, make(map[string]string))
+	return err
+}
+
+// Replicate refreshes the replica of a volume from its snapshot in group,
+// the group is removed
+func (v VmdkOps) Replicate(name string, group string) error {
+	log.Debugf("vmdkOps.Replicate name=%s group=%s", name, group)
+	_, err := v.Cmd.Run("replicate", name, map[string]string{"group": group})
+	return err
+}
+
+// Promote turns the replica of a volume into a volume
+func (v VmdkOps) Promote(name string) error {
+	log.Debugf("vmdkOps.Promote name=%s", name)
+	_, err := v.Cmd.Run("promote", name, make(map[string]string))
+	return err
+}
+
+// Extend grows a volume to sizeMB
+func (v VmdkOps) Extend(name string, sizeMB uint64) error {
+	log.Debugf("vmdkOps.Extend name=%s size=%dmb", name, sizeMB)
+	opts := map[string]string{"size": strconv.FormatUint(sizeMB, 10) + "mb"}
+	_, err := v.Cmd.Run("extend", name, opts)
+	return err
+}
+
+// Inflate converts a volume to eagerzeroedthick
+func (v VmdkOps) Inflate(name string) error {
+	log.Debugf("vmdkOps.Inflate name=%s", name)
+	_, err := v.Cmd.Run("inflate", name, make(map[string]string))
+	return err
+}
+
+// InflateStatus returns the progress in percent of running inflates, by
+// full volume name
+func (v VmdkOps) InflateStatus() (map[string]int, error) {
+	log.Debugf("vmdkOps.InflateStatus")
+	str, err := v.Cmd.Run("inflatestatus", "", make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]int
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Move relocates a volume to the target datastore, its full name changes
+// to name@target
+func (v VmdkOps) Move(name string, target string) error {
+	log.Debugf("vmdkOps.Move name=%s target=%s", name, target)
+	_, err := v.Cmd.Run("move", name, map[string]string{"target": target})
+	return err
+}
+
+// MoveStatus returns the progress in percent of running moves, by full
+// volume name before the move
+func (v VmdkOps) MoveStatus() (map[string]int, error) {
+	log.Debugf("vmdkOps.MoveStatus")
+	str, err := v.Cmd.Run("movestatus", "", make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]int
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListSnapshots returns the snapshot groups
+func (v VmdkOps) ListSnapshots() ([]SnapshotGroup, error) {
+	log.Debugf("vmdkOps.ListSnapshots")
+	str, err := v.Cmd.Run("snapshots", "", make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []SnapshotGroup
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
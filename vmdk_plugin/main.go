@@ -98,7 +98,8 @@ func logInit(logLevel *string, logFile *string, configFile *string) bool {
 }
 
 // main for docker-volume-vsphere
-// Parses flags, initializes and mounts refcounters and finally services Docker requests
+// Parses flags, initializes and mounts refcounters and finally services Docker requests.
+// If a command is given after the flags, runs it as plugin CLI instead.
 func main() {
 	var driver volume.Driver
 
@@ -121,14 +122,31 @@ func main() {
 	port := flag.Int("port", defaultPort, "Default port to connect to ESX service")
 	useMockEsx := flag.Bool("mock_esx", false, "Mock the ESX service")
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [args]]\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "Commands (sent to the running plugin):")
+		printAdminUsage(os.Stderr)
+	}
 	flag.Parse()
 
+	// Arguments left after the flags are a plugin CLI command,
+	// to be sent to the running plugin
+	if flag.NArg() > 0 {
+		name := *driverName
+		if name == "" {
+			name = vsphereDriver
+		}
+		os.Exit(runAdminCommand(fullSocketAddress(name), flag.Args()))
+	}
+
 	logInit(logLevel, nil, configFile)
 
 	// Load the configuration if one was provided.
 	c, err := config.Load(*configFile)
 	if err != nil {
 		log.Warningf("Failed to load config file %s: %v", *configFile, err)
+		config.SetDefaults(&c)
 	}
 
 	// If no driver provided on the command line, use the one in the
@@ -147,7 +165,7 @@ func main() {
 		"config":    *configFile,
 	}).Info("Starting plugin ")
 
-	// The vSphere driver doesn't depend on the config file for options
+	// The vSphere driver only takes optional settings from the config file
 	if *driverName == photonDriver && err == nil {
 		if *targetURL == "" {
 			*targetURL = c.Target
@@ -178,7 +196,7 @@ func main() {
 		}
 		log.WithFields(log.Fields{"port": *port}).Info("Plugin options - ")
 
-		driver = vmdk.NewVolumeDriver(*port, *useMockEsx, mountRoot, *driverName)
+		driver = vmdk.NewVolumeDriver(*port, *useMockEsx, mountRoot, *driverName, c)
 	} else {
 		log.Warning("Unknown driver or invalid/missing driver options, exiting - ", *driverName)
 		os.Exit(1)
@@ -199,6 +217,7 @@ func main() {
 	}()
 
 	handler := volume.NewHandler(driver)
+	registerAdminHandler(handler, driver)
 
 	log.WithFields(log.Fields{
 		"address": fullSocketAddress(*driverName),
@@ -0,0 +1,538 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// File level backups of mounted volumes, kept in a repository directory
+// (local disk or NFS mount).
+//
+// Repository layout:
+//   <repo>/chunks/<xx>/<sha256>  file data, in chunks named by checksum
+//   <repo>/backups/<id>.json     one manifest per backup
+//
+// File data is split in fixed size chunks. A chunk is stored once, however
+// many files and backups it is used by, and is verified against its
+// checksum on restore. All-zero chunks are not stored at all, they are
+// restored as holes. The manifest lists the files with their ownership,
+// permissions, xattrs (which include POSIX ACLs) and chunks, plus the
+// volume metadata, so a restore can recreate the volume as it was.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	chunkSize    = 1024 * 1024
+	chunksDir    = "chunks"
+	backupsDir   = "backups"
+	manifestExt  = ".json"
+	idTimeFormat = "20060102T150405Z"
+	holeChunk    = "" // chunk ID of an all-zero chunk, not stored
+)
+
+// Repo is a backup repository directory
+type Repo struct {
+	dir string
+}
+
+// Manifest describes one backup
+type Manifest struct {
+	ID      string
+	Volume  string
+	Created time.Time
+	// Volume metadata, as returned by the driver Get
+	Meta map[string]interface{}
+	// Size of the backed up filesystem
+	SizeMB uint64
+	Files  []File
+	Stats  Stats
+}
+
+// Stats of a backup
+type Stats struct {
+	Files     int
+	Bytes     int64
+	NewChunks int
+	NewBytes  int64
+}
+
+// File is a file, directory or other inode in a backup
+type File struct {
+	Path     string // relative to the filesystem root
+	Mode     os.FileMode
+	UID      int
+	GID      int
+	ModTime  time.Time
+	Size     int64             `json:",omitempty"`
+	Link     string            `json:",omitempty"` // symlink target
+	HardLink string            `json:",omitempty"` // earlier path of the same inode
+	Rdev     uint64            `json:",omitempty"` // device number of device nodes
+	Chunks   []string          `json:",omitempty"` // checksum of each chunk
+	Xattrs   map[string][]byte `json:",omitempty"`
+}
+
+// Open returns the repository in dir. With create the repository is
+// created if it does not exist.
+func Open(dir string, create bool) (*Repo, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("Backup repository must be an absolute path, got %s", dir)
+	}
+	r := &Repo{dir: dir}
+	for _, sub := range []string{chunksDir, backupsDir} {
+		path := filepath.Join(dir, sub)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		} else if !os.IsNotExist(err) || !create {
+			return nil, fmt.Errorf("Not a backup repository: %s (%v)", dir, err)
+		}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Backup backs up the filesystem mounted at root, and saves the manifest
+// with the volume name and metadata
+func (r *Repo) Backup(root string, volume string, meta map[string]interface{}) (*Manifest, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(root, &statfs); err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Volume:  volume,
+		Created: time.Now().UTC(),
+		Meta:    meta,
+		SizeMB:  (statfs.Blocks*uint64(statfs.Bsize) + (1<<20 - 1)) >> 20,
+	}
+	baseID := strings.Replace(volume, "/", "_", -1) + "-" + m.Created.Format(idTimeFormat)
+
+	inodes := make(map[uint64]string) // inode -> first path, for hard links
+	buf := make([]byte, chunkSize)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		f := File{
+			Path:    rel,
+			Mode:    info.Mode(),
+			UID:     int(stat.Uid),
+			GID:     int(stat.Gid),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if f.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0:
+			f.Rdev = uint64(stat.Rdev)
+		case info.Mode().IsRegular():
+			if first, exists := inodes[stat.Ino]; exists && stat.Nlink > 1 {
+				f.HardLink = first
+				break
+			}
+			inodes[stat.Ino] = rel
+			f.Size = info.Size()
+			if f.Chunks, err = r.putFile(path, buf, &m.Stats); err != nil {
+				return err
+			}
+			m.Stats.Bytes += f.Size
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			if f.Xattrs, err = getXattrs(path); err != nil {
+				return err
+			}
+		}
+		m.Files = append(m.Files, f)
+		m.Stats.Files++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs have one second resolution, later backups in the same second
+	// get a suffix
+	for n := 1; ; n++ {
+		m.ID = baseID
+		if n > 1 {
+			m.ID = fmt.Sprintf("%s-%d", baseID, n)
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		err = writeFileExclusive(r.manifestPath(m.ID), data)
+		if err == nil {
+			return m, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// Load returns the manifest of a backup
+func (r *Repo) Load(id string) (*Manifest, error) {
+	if strings.ContainsRune(id, filepath.Separator) {
+		return nil, fmt.Errorf("Invalid backup ID %s", id)
+	}
+	data, err := ioutil.ReadFile(r.manifestPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read backup %s: %v", id, err)
+	}
+	var m Manifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Invalid manifest for backup %s: %v", id, err)
+	}
+	return &m, nil
+}
+
+// Restore writes the files of a backup into the filesystem mounted at root.
+// Symlinks are created last, and no file is created through a symlink, so
+// that a manifest can't have files written outside of root.
+func (r *Repo) Restore(m *Manifest, root string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	var links []File
+	for _, f := range m.Files {
+		if f.Mode&os.ModeSymlink != 0 {
+			links = append(links, f)
+			continue
+		}
+		if err = r.restoreEntry(m, f, root, realRoot, buf); err != nil {
+			return err
+		}
+	}
+	for _, f := range links {
+		if err = r.restoreEntry(m, f, root, realRoot, buf); err != nil {
+			return err
+		}
+	}
+	// Creating files changed the directory times, set them last
+	for i := len(m.Files) - 1; i >= 0; i-- {
+		f := m.Files[i]
+		if f.Mode.IsDir() {
+			os.Chtimes(filepath.Join(root, f.Path), f.ModTime, f.ModTime)
+		}
+	}
+	return nil
+}
+
+// restoreEntry restores the file f of the backup m under root, after
+// checking that it stays under root (realRoot with symlinks resolved)
+func (r *Repo) restoreEntry(m *Manifest, f File, root string, realRoot string, buf []byte) error {
+	path := filepath.Join(root, f.Path)
+	if err := checkUnder(path, root, realRoot); err != nil {
+		return fmt.Errorf("Invalid path %s in backup %s: %v", f.Path, m.ID, err)
+	}
+	if f.HardLink != "" {
+		if err := checkUnder(filepath.Join(root, f.HardLink), root, realRoot); err != nil {
+			return fmt.Errorf("Invalid hard link %s in backup %s: %v", f.HardLink, m.ID, err)
+		}
+	}
+	if err := r.restoreFile(f, path, root, buf); err != nil {
+		return fmt.Errorf("Failed to restore %s: %v", f.Path, err)
+	}
+	return nil
+}
+
+// checkUnder returns an error if path isn't under root, lexically or once
+// the symlinks in its parent directories are resolved (realRoot is root
+// with symlinks resolved)
+func checkUnder(path string, root string, realRoot string) error {
+	if !isUnder(path, root) {
+		return fmt.Errorf("outside of %s", root)
+	}
+	if path == root {
+		return nil
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !isUnder(parent, realRoot) {
+		return fmt.Errorf("parent directory is %s, outside of %s", parent, root)
+	}
+	return nil
+}
+
+// putFile stores the data of a file, returns the list of its chunks
+func (r *Repo) putFile(path string, buf []byte, stats *Stats) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var chunks []string
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			id, err := r.putChunk(buf[:n], stats)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// putChunk stores a chunk unless the repository has it already,
+// returns the chunk ID
+func (r *Repo) putChunk(data []byte, stats *Stats) (string, error) {
+	if isZero(data) {
+		return holeChunk, nil
+	}
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	path := r.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", err
+	}
+	stats.NewChunks++
+	stats.NewBytes += int64(len(data))
+	return id, nil
+}
+
+// getChunk reads a chunk into buf and verifies its checksum
+func (r *Repo) getChunk(id string, buf []byte) ([]byte, error) {
+	file, err := os.Open(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf[:n])
+	if hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("Chunk %s is corrupt", id)
+	}
+	return buf[:n], nil
+}
+
+// restoreFile recreates one file, directory or other inode at path
+func (r *Repo) restoreFile(f File, path string, root string, buf []byte) error {
+	mode := f.Mode
+	switch {
+	case f.HardLink != "":
+		return os.Link(filepath.Join(root, f.HardLink), path)
+	case mode.IsDir():
+		// the root and lost+found exist already on a new filesystem
+		if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		if err := os.Symlink(f.Link, path); err != nil {
+			return err
+		}
+		return os.Lchown(path, f.UID, f.GID)
+	case mode&os.ModeNamedPipe != 0:
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return err
+		}
+	case mode&os.ModeDevice != 0:
+		devType := uint32(syscall.S_IFBLK)
+		if mode&os.ModeCharDevice != 0 {
+			devType = syscall.S_IFCHR
+		}
+		if err := syscall.Mknod(path, devType|0600, int(f.Rdev)); err != nil {
+			return err
+		}
+	default:
+		if err := r.restoreData(f, path, buf); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Lchown(path, f.UID, f.GID); err != nil {
+		return err
+	}
+	// chmod after chown, chown clears the setuid and setgid bits
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	for name, value := range f.Xattrs {
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return fmt.Errorf("Failed to set xattr %s: %v", name, err)
+		}
+	}
+	return os.Chtimes(path, f.ModTime, f.ModTime)
+}
+
+// restoreData writes the chunks of a regular file, leaving holes for
+// all-zero chunks
+func (r *Repo) restoreData(f File, path string, buf []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	for _, id := range f.Chunks {
+		if id == holeChunk {
+			if _, err = file.Seek(chunkSize, os.SEEK_CUR); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := r.getChunk(id, buf)
+		if err != nil {
+			return err
+		}
+		if _, err = file.Write(data); err != nil {
+			return err
+		}
+	}
+	// sets the size of files ending with a hole
+	return file.Truncate(f.Size)
+}
+
+func (r *Repo) chunkPath(id string) string {
+	return filepath.Join(r.dir, chunksDir, id[:2], id)
+}
+
+func (r *Repo) manifestPath(id string) string {
+	return filepath.Join(r.dir, backupsDir, id+manifestExt)
+}
+
+// getXattrs returns the extended attributes of a file, nil if it has none
+// or the filesystem does not support them
+func getXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, name, value); err != nil {
+			return nil, err
+		}
+		xattrs[name] = value[:size]
+	}
+	return xattrs, nil
+}
+
+// writeFileAtomic writes data to path through a temp file, so readers
+// never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeFileExclusive writes data to path through a temp file, failing
+// (os.IsExist) if path exists
+func writeFileExclusive(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	// unlike rename, link doesn't replace path
+	return os.Link(tmp.Name(), path)
+}
+
+func isZero(data []byte) bool {
+	var zero [4096]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > len(zero) {
+			n = len(zero)
+		}
+		if !bytes.Equal(data[:n], zero[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// isUnder returns true if path is root or inside it
+func isUnder(path string, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
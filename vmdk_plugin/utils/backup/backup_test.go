@@ -0,0 +1,155 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package backup
+
+// Back up a directory tree into a temp repository and restore it
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupRestore(t *testing.T) {
+	top, err := ioutil.TempDir("", "vsphere-backup-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(top)
+	src := filepath.Join(top, "src")
+	dst := filepath.Join(top, "dst")
+	os.MkdirAll(filepath.Join(src, "dir"), 0750)
+	os.MkdirAll(dst, 0755)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), chunkSize/8) // 2 equal chunks
+	ioutil.WriteFile(filepath.Join(src, "dir", "file"), data, 0640)
+	ioutil.WriteFile(filepath.Join(src, "copy"), data, 0600)
+	os.Link(filepath.Join(src, "copy"), filepath.Join(src, "link"))
+	os.Symlink("dir/file", filepath.Join(src, "symlink"))
+	sparse, _ := os.Create(filepath.Join(src, "sparse"))
+	sparse.WriteAt([]byte("end"), 3*chunkSize)
+	sparse.Close()
+	hasXattr := syscall.Setxattr(filepath.Join(src, "copy"), "user.test", []byte("value"), 0) == nil
+
+	repo, err := Open(filepath.Join(top, "repo"), true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	meta := map[string]interface{}{"fstype": "ext4"}
+	m, err := repo.Backup(src, "vol1@datastore1", meta)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// one chunk for both data files, one for the end of sparse
+	assert.Equal(t, 2, m.Stats.NewChunks)
+	assert.Equal(t, 7, m.Stats.Files)
+
+	// a second backup only adds the manifest, with another ID even in the
+	// same second
+	m2, err := repo.Backup(src, "vol1@datastore1", meta)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, m2.Stats.NewChunks)
+	m3, err := repo.Backup(src, "vol1@datastore1", meta)
+	assert.Nil(t, err)
+	assert.NotEqual(t, m.ID, m2.ID)
+	assert.NotEqual(t, m2.ID, m3.ID)
+	if m.Created.Unix() == m2.Created.Unix() {
+		assert.Equal(t, m.ID+"-2", m2.ID)
+	}
+
+	loaded, err := repo.Load(m.ID)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "ext4", loaded.Meta["fstype"])
+	if !assert.Nil(t, repo.Restore(loaded, dst)) {
+		return
+	}
+
+	restored, _ := ioutil.ReadFile(filepath.Join(dst, "dir", "file"))
+	assert.Equal(t, data, restored)
+	info, _ := os.Stat(filepath.Join(dst, "dir", "file"))
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	target, _ := os.Readlink(filepath.Join(dst, "symlink"))
+	assert.Equal(t, "dir/file", target)
+	info, _ = os.Stat(filepath.Join(dst, "link"))
+	assert.Equal(t, uint64(2), uint64(info.Sys().(*syscall.Stat_t).Nlink))
+	info, _ = os.Stat(filepath.Join(dst, "sparse"))
+	assert.Equal(t, int64(3*chunkSize+3), info.Size())
+	assert.True(t, info.Sys().(*syscall.Stat_t).Blocks*512 < 3*chunkSize)
+	if hasXattr {
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(filepath.Join(dst, "copy"), "user.test", value)
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value[:n]))
+	}
+
+	// a corrupt chunk fails the restore
+	for _, f := range m.Files {
+		if f.Path == "copy" {
+			ioutil.WriteFile(repo.chunkPath(f.Chunks[0]), []byte("bad"), 0600)
+		}
+	}
+	os.MkdirAll(filepath.Join(top, "dst2"), 0755)
+	assert.NotNil(t, repo.Restore(loaded, filepath.Join(top, "dst2")))
+
+	_, err = Open(filepath.Join(top, "missing"), false)
+	assert.NotNil(t, err)
+}
+
+func TestRestoreOutsideRoot(t *testing.T) {
+	top, err := ioutil.TempDir("", "vsphere-backup-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(top)
+	dst := filepath.Join(top, "dst")
+	outside := filepath.Join(top, "outside")
+	os.MkdirAll(dst, 0755)
+	os.MkdirAll(outside, 0755)
+	repo, err := Open(filepath.Join(top, "repo"), true)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// a symlink to a directory outside, followed by a file under it
+	m := &Manifest{ID: "evil", Files: []File{
+		{Path: ".", Mode: os.ModeDir | 0755},
+		{Path: "link", Mode: os.ModeSymlink | 0777, Link: outside},
+		{Path: "link/file", Mode: 0644},
+	}}
+	assert.NotNil(t, repo.Restore(m, dst))
+	_, err = os.Lstat(filepath.Join(outside, "file"))
+	assert.True(t, os.IsNotExist(err))
+
+	// the symlink exists already
+	os.Symlink(outside, filepath.Join(dst, "link2"))
+	m.Files = []File{{Path: "link2/file", Mode: 0644}}
+	assert.NotNil(t, repo.Restore(m, dst))
+	m.Files = []File{{Path: "dir", Mode: os.ModeDir | 0755}, {Path: "dir/hard", Mode: 0644, HardLink: "link2/secret"}}
+	assert.NotNil(t, repo.Restore(m, dst))
+	_, err = os.Lstat(filepath.Join(outside, "file"))
+	assert.True(t, os.IsNotExist(err))
+
+	m.Files = []File{{Path: "../file", Mode: 0644}}
+	assert.NotNil(t, repo.Restore(m, dst))
+}
@@ -29,23 +29,75 @@ const (
 	DefaultConfigPath = "/etc/docker-volume-vsphere.conf"
 	// DefaultLogPath is the default location of log (trace) file
 	DefaultLogPath = "/var/log/docker-volume-vsphere.log"
+	// DefaultStateDir is the default location of plugin state (journals etc.)
+	DefaultStateDir = "/var/lib/docker-volume-vsphere"
+
+	// CreateRecoveryRemove removes volumes whose create was interrupted
+	CreateRecoveryRemove = "remove"
+	// CreateRecoveryMkfs finishes interrupted creates by (re)creating the filesystem
+	CreateRecoveryMkfs = "mkfs"
+
+	// FsckNever mounts volumes without checking their filesystem
+	FsckNever = "never"
+	// FsckAuto has the checker repair what it safely can before the mount
+	FsckAuto = "auto"
+	// FsckForce is FsckAuto, checking filesystems marked clean too
+	FsckForce = "force"
+	// FsckRefuseOnError checks without repairing, and refuses to mount on errors
+	FsckRefuseOnError = "refuse-on-error"
 
 	// Local constants
-	defaultMaxLogSizeMb  = 100
-	defaultMaxLogAgeDays = 28
-	defaultLogLevel      = "info"
+	defaultMaxLogSizeMb         = 100
+	defaultMaxLogAgeDays        = 28
+	defaultLogLevel             = "info"
+	defaultCreateRecovery       = CreateRecoveryRemove
+	defaultExpiryCheckMinutes   = 10
+	defaultExpiryWarningMinutes = 60
+	defaultSnapshotCheckMinutes = 5
+	defaultReplicationMinutes   = 60
+	defaultAutogrowCheckMinutes = 1
+	defaultFsckPolicy           = FsckNever
+	defaultTrimMinutes          = 24 * 60
+	defaultTrimJitterMinutes    = 60
 )
 
 // Config stores the configuration for the plugin
 type Config struct {
-	Driver        string `json:",omitempty"`
-	LogPath       string `json:",omitempty"`
-	MaxLogSizeMb  int    `json:",omitempty"`
-	MaxLogAgeDays int    `json:",omitempty"`
-	LogLevel      string `json:",omitempty"`
-	Target        string `json:",omitempty"`
-	Project       string `json:",omitempty"`
-	Host          string `json:",omitempty"`
+	Driver         string `json:",omitempty"`
+	LogPath        string `json:",omitempty"`
+	MaxLogSizeMb   int    `json:",omitempty"`
+	MaxLogAgeDays  int    `json:",omitempty"`
+	LogLevel       string `json:",omitempty"`
+	Target         string `json:",omitempty"`
+	Project        string `json:",omitempty"`
+	Host           string `json:",omitempty"`
+	StateDir       string `json:",omitempty"`
+	CreateRecovery string `json:",omitempty"`
+	// Expired volumes are looked for every ExpiryCheckMinutes, a negative
+	// value disables removal of expired volumes
+	ExpiryCheckMinutes int `json:",omitempty"`
+	// Expiring volumes are logged ExpiryWarningMinutes before removal
+	ExpiryWarningMinutes int `json:",omitempty"`
+	// Directories under which seed-from sources are allowed, seeding is
+	// disabled if empty
+	SeedRoots []string `json:",omitempty"`
+	// Snapshot schedules of the volumes mounted here are checked every
+	// SnapshotCheckMinutes, a negative value disables scheduled snapshots
+	SnapshotCheckMinutes int `json:",omitempty"`
+	// Volumes mounted here with replicate-to are replicated every
+	// ReplicationMinutes, a negative value disables replication
+	ReplicationMinutes int `json:",omitempty"`
+	// Usage of the volumes mounted here with autogrow is checked every
+	// AutogrowCheckMinutes, a negative value disables autogrow
+	AutogrowCheckMinutes int `json:",omitempty"`
+	// Filesystems of volumes without a fsck-policy of their own are checked
+	// before the mount as FsckPolicy says
+	FsckPolicy string `json:",omitempty"`
+	// The volumes mounted here are trimmed every TrimMinutes, plus a random
+	// delay of up to TrimJitterMinutes. Negative values disable trim, or
+	// the jitter.
+	TrimMinutes       int `json:",omitempty"`
+	TrimJitterMinutes int `json:",omitempty"`
 }
 
 // Load the configuration from a file and return a Config.
@@ -76,4 +128,34 @@ func SetDefaults(config *Config) {
 	if config.LogLevel == "" {
 		config.LogLevel = defaultLogLevel
 	}
+	if config.StateDir == "" {
+		config.StateDir = DefaultStateDir
+	}
+	if config.CreateRecovery == "" {
+		config.CreateRecovery = defaultCreateRecovery
+	}
+	if config.ExpiryCheckMinutes == 0 {
+		config.ExpiryCheckMinutes = defaultExpiryCheckMinutes
+	}
+	if config.ExpiryWarningMinutes == 0 {
+		config.ExpiryWarningMinutes = defaultExpiryWarningMinutes
+	}
+	if config.SnapshotCheckMinutes == 0 {
+		config.SnapshotCheckMinutes = defaultSnapshotCheckMinutes
+	}
+	if config.ReplicationMinutes == 0 {
+		config.ReplicationMinutes = defaultReplicationMinutes
+	}
+	if config.AutogrowCheckMinutes == 0 {
+		config.AutogrowCheckMinutes = defaultAutogrowCheckMinutes
+	}
+	if config.FsckPolicy == "" {
+		config.FsckPolicy = defaultFsckPolicy
+	}
+	if config.TrimMinutes == 0 {
+		config.TrimMinutes = defaultTrimMinutes
+	}
+	if config.TrimJitterMinutes == 0 {
+		config.TrimJitterMinutes = defaultTrimJitterMinutes
+	}
 }
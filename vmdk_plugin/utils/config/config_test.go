@@ -28,4 +28,13 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, conf.MaxLogSizeMb, 100)
 	assert.Equal(t, conf.MaxLogAgeDays, 28)
 	assert.Equal(t, conf.LogPath, "/var/log/docker-volume-vsphere.log")
+	assert.Equal(t, conf.StateDir, "/var/lib/docker-volume-vsphere")
+	assert.Equal(t, conf.CreateRecovery, "remove")
+	assert.Equal(t, conf.ExpiryCheckMinutes, 10)
+	assert.Equal(t, conf.ExpiryWarningMinutes, 60)
+	assert.Equal(t, conf.SnapshotCheckMinutes, 5)
+	assert.Equal(t, conf.ReplicationMinutes, 60)
+	assert.Equal(t, conf.FsckPolicy, "never")
+	assert.Equal(t, conf.TrimMinutes, 1440)
+	assert.Equal(t, conf.TrimJitterMinutes, 60)
 }
@@ -0,0 +1,218 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Resolution of the device path of an attached disk. The attach reply has
+// the PCI slot number of the controller and the unit of the disk on it.
+// The slot number is the ACPI slot number of the controller, or of the PCIe
+// root port the controller is behind. The guest shows it in
+// /sys/bus/pci/slots when a hotplug driver claimed the slot, and else as
+// the "sun" of the ACPI node of the PCI device. A SCSI disk whose
+// controller isn't found is looked for on the PVSCSI hosts, and last by
+// its WWN. Disks on NVMe controllers are namespaces of the controller.
+
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	sysScsiHosts   = "/sys/class/scsi_host"
+	pvscsiProcName = "vmw_pvscsi" // proc_name of PVSCSI hosts
+	pciClassBridge = "0x0604"     // class of PCI bridges, the PCIe root ports
+	pciClassStore  = "0x01"       // class of mass storage controllers
+	byPathDir      = "/dev/disk/by-path"
+
+	// ControllerNVMe is the controller type of disks on vNVMe controllers
+	ControllerNVMe = "nvme"
+)
+
+// sysfs is where in sysfs the device of a disk is looked for, fake in tests
+type sysfs struct {
+	pciSlots  string // PCI slots
+	pciDevs   string // PCI devices, links to their device directories
+	scsiHosts string // SCSI hosts
+	block     string // block devices
+}
+
+var hostSysfs = sysfs{pciSlots: sysPciSlots, pciDevs: sysPciDevs,
+	scsiHosts: sysScsiHosts, block: sysBlock}
+
+// GetDevicePath - return device path or error
+func GetDevicePath(str []byte) (string, error) {
+	var volDev VolumeDevSpec
+	err := json.Unmarshal(str, &volDev)
+	if err != nil {
+		return "", err
+	}
+	device, via, err := hostSysfs.devicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"unit": volDev.Unit, "slot": volDev.ControllerPciSlotNumber,
+			"controller": volDev.ControllerType, "error": err}).Warning("Get device path failed ")
+		return "", err
+	}
+	log.WithFields(log.Fields{"device": device, "via": via}).Debug("Device path resolved ")
+	return device, nil
+}
+
+// devicePath returns the device path of the disk of the attach reply, and
+// how it was found
+func (sys sysfs) devicePath(volDev VolumeDevSpec) (string, string, error) {
+	pciAddr, via := sys.controllerAddr(volDev.ControllerPciSlotNumber)
+	if volDev.ControllerType == ControllerNVMe {
+		if pciAddr == "" || volDev.Namespace == "" {
+			return "", "", fmt.Errorf("Device not found, no NVMe controller in PCI slot %s",
+				volDev.ControllerPciSlotNumber)
+		}
+		return nvmeByPath(pciAddr, volDev.Namespace), via, nil
+	}
+	if pciAddr != "" {
+		return scsiByPath(pciAddr, volDev.Unit), via, nil
+	}
+	if pciAddr = sys.pvscsiHostAddr(volDev.Unit, volDev.DiskUUID); pciAddr != "" {
+		return scsiByPath(pciAddr, volDev.Unit), "SCSI hosts", nil
+	}
+	if volDev.DiskUUID != "" {
+		return makeDevicePathWithID(volDev.DiskUUID), "WWN", nil
+	}
+	return "", "", fmt.Errorf("Device not found")
+}
+
+// scsiByPath returns the by-path link of the disk at unit on the PVSCSI
+// controller at pciAddr
+func scsiByPath(pciAddr string, unit string) string {
+	return fmt.Sprintf("%s/pci-%s-scsi-0:0:%s:0", byPathDir, pciAddr, unit)
+}
+
+// nvmeByPath returns the by-path link of the namespace ns of the NVMe
+// controller at pciAddr
+func nvmeByPath(pciAddr string, ns string) string {
+	return fmt.Sprintf("%s/pci-%s-nvme-%s", byPathDir, pciAddr, ns)
+}
+
+// controllerAddr returns the PCI address of the controller in the slot,
+// and how it was found. "" if it wasn't.
+func (sys sysfs) controllerAddr(slot string) (string, string) {
+	if slot == "" {
+		return "", ""
+	}
+	if addr, err := ioutil.ReadFile(filepath.Join(sys.pciSlots, slot, "address")); err == nil {
+		// the address of a slot has no function, the controller is function 0
+		return strings.TrimSpace(string(addr)) + ".0", "PCI slot"
+	}
+	if addr := sys.pciAddrBySun(slot); addr != "" {
+		return addr, "PCI devices"
+	}
+	return "", ""
+}
+
+// pciAddrBySun returns the PCI address of the storage controller with the
+// ACPI slot number slot, or behind the root port with it. "" if there's none.
+func (sys sysfs) pciAddrBySun(slot string) string {
+	devs, err := ioutil.ReadDir(sys.pciDevs)
+	if err != nil {
+		return ""
+	}
+	for _, dev := range devs {
+		sun, err := ioutil.ReadFile(filepath.Join(sys.pciDevs, dev.Name(), "firmware_node", "sun"))
+		if err != nil || strings.TrimSpace(string(sun)) != slot {
+			continue
+		}
+		class := sys.pciClass(dev.Name())
+		if strings.HasPrefix(class, pciClassStore) {
+			return dev.Name()
+		}
+		if strings.HasPrefix(class, pciClassBridge) {
+			return sys.storeBehind(dev.Name(), devs)
+		}
+	}
+	return ""
+}
+
+// storeBehind returns the PCI address of the storage controller right
+// behind the bridge, "" if there's none
+func (sys sysfs) storeBehind(bridge string, devs []os.FileInfo) string {
+	for _, dev := range devs {
+		devDir, err := filepath.EvalSymlinks(filepath.Join(sys.pciDevs, dev.Name()))
+		if err != nil || filepath.Base(filepath.Dir(devDir)) != bridge {
+			continue
+		}
+		if strings.HasPrefix(sys.pciClass(dev.Name()), pciClassStore) {
+			return dev.Name()
+		}
+	}
+	return ""
+}
+
+// pciClass returns the class of the PCI device, "0x<class><subclass><interface>"
+func (sys sysfs) pciClass(addr string) string {
+	class, err := ioutil.ReadFile(filepath.Join(sys.pciDevs, addr, "class"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(class))
+}
+
+// pvscsiHostAddr returns the PCI address of the PVSCSI host with a disk at
+// unit, the disk with the WWN of uuid if several hosts have one. "" if no
+// single host is found.
+func (sys sysfs) pvscsiHostAddr(unit string, uuid string) string {
+	hosts, err := ioutil.ReadDir(sys.scsiHosts)
+	if err != nil {
+		return ""
+	}
+	var found []string
+	for _, host := range hosts {
+		procName, err := ioutil.ReadFile(filepath.Join(sys.scsiHosts, host.Name(), "proc_name"))
+		if err != nil || strings.TrimSpace(string(procName)) != pvscsiProcName {
+			continue
+		}
+		// .../<PCI address>/host<n>
+		hostDir, err := filepath.EvalSymlinks(filepath.Join(sys.scsiHosts, host.Name(), "device"))
+		if err != nil {
+			continue
+		}
+		n := strings.TrimPrefix(host.Name(), "host")
+		target := fmt.Sprintf("target%s:0:%s", n, unit)
+		lun := fmt.Sprintf("%s:0:%s:0", n, unit)
+		blocks, err := ioutil.ReadDir(filepath.Join(hostDir, target, lun, "block"))
+		if err != nil || len(blocks) == 0 {
+			continue
+		}
+		pciAddr := filepath.Base(filepath.Dir(hostDir))
+		if uuid != "" {
+			id, _ := deviceDiskID(sys.block, "", blocks[0].Name())
+			if id == normalizeDiskID(uuid) {
+				return pciAddr
+			}
+			if id != "" {
+				continue
+			}
+		}
+		found = append(found, pciAddr)
+	}
+	if len(found) != 1 {
+		return ""
+	}
+	return found[0]
+}
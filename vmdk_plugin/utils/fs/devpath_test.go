@@ -0,0 +1,131 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Test the resolution of device paths from attach replies, in a fake sysfs
+// with a PVSCSI controller behind the root port in slot 160, an LSI Logic
+// controller in slot 16, a vNVMe controller behind the root port in slot
+// 192 and a PVSCSI controller in no slot.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPciRoot = "devices/pci0000:00"
+
+// fakeSysfs makes the fake sysfs in dir
+func fakeSysfs(t *testing.T, dir string) sysfs {
+	sys := sysfs{pciSlots: filepath.Join(dir, "slots"), pciDevs: filepath.Join(dir, "bus"),
+		scsiHosts: filepath.Join(dir, "scsi_host"), block: filepath.Join(dir, "block")}
+	for _, d := range []string{sys.pciSlots, sys.pciDevs, sys.scsiHosts, sys.block} {
+		assert.Nil(t, os.MkdirAll(d, 0755))
+	}
+	pciDev := func(path string, class string, sun string) {
+		devDir := filepath.Join(dir, testPciRoot, path)
+		assert.Nil(t, os.MkdirAll(devDir, 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(devDir, "class"), []byte(class+"\n"), 0644))
+		if sun != "" {
+			assert.Nil(t, os.MkdirAll(filepath.Join(devDir, "firmware_node"), 0755))
+			assert.Nil(t, ioutil.WriteFile(filepath.Join(devDir, "firmware_node", "sun"), []byte(sun+"\n"), 0644))
+		}
+		assert.Nil(t, os.Symlink(devDir, filepath.Join(sys.pciDevs, filepath.Base(path))))
+	}
+	pciDev("0000:00:10.0", "0x010000", "16")
+	pciDev("0000:00:15.0", "0x060400", "160")
+	pciDev("0000:00:15.0/0000:03:00.0", "0x010700", "")
+	pciDev("0000:00:16.0", "0x060400", "192")
+	pciDev("0000:00:16.0/0000:0b:00.0", "0x010802", "")
+	pciDev("0000:00:17.0", "0x060400", "")
+	pciDev("0000:00:17.0/0000:13:00.0", "0x010700", "")
+
+	scsiHost := func(ctrl string, host string, proc string) {
+		hostDir := filepath.Join(dir, testPciRoot, ctrl, host)
+		assert.Nil(t, os.MkdirAll(filepath.Join(sys.scsiHosts, host), 0755))
+		assert.Nil(t, os.MkdirAll(hostDir, 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(sys.scsiHosts, host, "proc_name"), []byte(proc+"\n"), 0644))
+		assert.Nil(t, os.Symlink(hostDir, filepath.Join(sys.scsiHosts, host, "device")))
+	}
+	scsiHost("0000:00:10.0", "host0", "mptspi")
+	scsiHost("0000:00:15.0/0000:03:00.0", "host2", pvscsiProcName)
+	scsiHost("0000:00:17.0/0000:13:00.0", "host3", pvscsiProcName)
+	return sys
+}
+
+// scsiDiskAt adds the disk dev with wwn at unit 1 of the host, on the
+// controller ctrl
+func scsiDiskAt(t *testing.T, dir string, sys sysfs, ctrl string, host string, n string, dev string, wwn string) {
+	devDir := filepath.Join(dir, testPciRoot, ctrl, host, "target"+n+":0:1", n+":0:1:0", "block", dev)
+	assert.Nil(t, os.MkdirAll(filepath.Join(devDir, "device"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(devDir, sysDevWwid), []byte("naa."+wwn+"\n"), 0644))
+	assert.Nil(t, os.Symlink(devDir, filepath.Join(sys.block, dev)))
+}
+
+func TestDevicePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-devpath-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	sys := fakeSysfs(t, dir)
+
+	check := func(volDev VolumeDevSpec, device string, via string) {
+		d, v, err := sys.devicePath(volDev)
+		assert.Nil(t, err)
+		assert.Equal(t, device, d)
+		assert.Equal(t, via, v)
+	}
+	pvscsi := VolumeDevSpec{Unit: "1", ControllerPciSlotNumber: "160"}
+
+	// the root port, and the LSI Logic controller on bus 0
+	check(pvscsi, "/dev/disk/by-path/pci-0000:03:00.0-scsi-0:0:1:0", "PCI devices")
+	check(VolumeDevSpec{Unit: "1", ControllerPciSlotNumber: "16"},
+		"/dev/disk/by-path/pci-0000:00:10.0-scsi-0:0:1:0", "PCI devices")
+
+	// the slot, over the PCI devices
+	assert.Nil(t, os.MkdirAll(filepath.Join(sys.pciSlots, "160"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sys.pciSlots, "160", "address"), []byte("0000:03:00\n"), 0644))
+	check(pvscsi, "/dev/disk/by-path/pci-0000:03:00.0-scsi-0:0:1:0", "PCI slot")
+
+	// NVMe
+	nvme := VolumeDevSpec{Unit: "1", ControllerPciSlotNumber: "192", ControllerType: ControllerNVMe, Namespace: "2"}
+	check(nvme, "/dev/disk/by-path/pci-0000:0b:00.0-nvme-2", "PCI devices")
+	nvme.Namespace = ""
+	_, _, err = sys.devicePath(nvme)
+	assert.NotNil(t, err)
+
+	// slot not found, the disk is on one of the PVSCSI hosts or has a WWN
+	unknown := VolumeDevSpec{Unit: "1", ControllerPciSlotNumber: "224"}
+	_, _, err = sys.devicePath(unknown)
+	assert.NotNil(t, err)
+	unknown.DiskUUID = testDiskUUID
+	check(unknown, makeDevicePathWithID(testDiskUUID), "WWN")
+
+	scsiDiskAt(t, dir, sys, "0000:00:17.0/0000:13:00.0", "host3", "3", "sdc", otherDiskWWN)
+	unknown.DiskUUID = ""
+	check(unknown, "/dev/disk/by-path/pci-0000:13:00.0-scsi-0:0:1:0", "SCSI hosts")
+
+	scsiDiskAt(t, dir, sys, "0000:00:15.0/0000:03:00.0", "host2", "2", "sdb", testDiskWWN)
+	_, _, err = sys.devicePath(unknown)
+	assert.NotNil(t, err)
+	unknown.DiskUUID = testDiskUUID
+	check(unknown, "/dev/disk/by-path/pci-0000:03:00.0-scsi-0:0:1:0", "SCSI hosts")
+}
@@ -19,11 +19,8 @@
 package fs
 
 import (
-	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"golang.org/x/exp/inotify"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -31,18 +28,35 @@ import (
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
 	sysPciDevs      = "/sys/bus/pci/devices"   // All PCI devices on the host
 	sysPciSlots     = "/sys/bus/pci/slots"     // PCI slots on the host
-	pciAddrLen      = 10                       // Length of PCI dev addr
 	diskPathByDevID = "/dev/disk/by-id/wwn-0x" // Path for devices named by ID
 	scsiHostPath    = "/sys/class/scsi_host/"  // Path for scsi hosts
 	devWaitTimeout  = 10 * time.Second         // give it plenty of time to sense the attached disk
 	bdevPath        = "/sys/block/"
 	deleteFile      = "/device/delete"
-	watchPath       = "/dev/disk/by-id"
+	blkidNotFound   = 2 // blkid exit code, no signature found on the device
+	rescanFile      = "/device/rescan"
+	procMounts      = "/proc/mounts"
+
+	// ioctls on a mountpoint, from linux/fs.h
+	ioctlFreeze = 0xC0045877 // FIFREEZE, _IOWR('X', 119, int)
+	ioctlThaw   = 0xC0045878 // FITHAW, _IOWR('X', 120, int)
+	ioctlTrim   = 0xC0185879 // FITRIM, _IOWR('X', 121, struct fstrim_range)
+
+	// ioctl on a block device, from linux/fs.h
+	ioctlFlushBufs = 0x1261 // BLKFLSBUF, _IO(0x12, 97)
+)
+
+// Results of Fsck
+const (
+	FsckClean    = "clean"    // no errors found
+	FsckRepaired = "repaired" // errors found and repaired
+	FsckSkipped  = "skipped"  // no checker for the filesystem
 )
 
 // FstypeDefault contains the default FS when not specified by the user
@@ -55,109 +69,206 @@ var BinSearchPath = []string{"/bin", "/sbin", "/usr/bin", "/usr/sbin"}
 type VolumeDevSpec struct {
 	Unit                    string
 	ControllerPciSlotNumber string
+	ControllerType          string // pvscsi (or empty) or nvme
+	Namespace               string // namespace ID of the disk on an NVMe controller
+	DiskUUID                string // see VerifyDevice
 }
 
-// DevAttachWaitPrep create the watcher.
-func DevAttachWaitPrep(name string, devPath string) (*inotify.Watcher, bool) {
-	watcher, errWatcher := inotify.NewWatcher()
-
-	if errWatcher != nil {
-		log.WithFields(log.Fields{"Name": name}).Error("Failed to create watcher. Skipping inotify ")
-		return nil, true
+// Mkdir creates a directory at the specified path
+func Mkdir(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
 	}
 
-	err := watcher.Watch(devPath)
+	if stat != nil && !stat.IsDir() {
+		return fmt.Errorf("%v already exist and it's not a directory", path)
+	}
+	return nil
+}
 
+// Mkfs creates a filesystem at the specified device, with mkfscmd found
+// by MkfsLookup. The label is cut to what the filesystem takes, mkfsOpts
+// are checked against its profile.
+func Mkfs(mkfscmd string, label string, device string, mkfsOpts string) error {
+	fstype, p, exists := profileOfMkfs(mkfscmd)
+	if !exists {
+		return fmt.Errorf("Not found filesystem profile for %s", mkfscmd)
+	}
+	opts, err := CheckMkfsOpts(fstype, mkfsOpts)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"Name": name, "path": devPath, "err": err.Error(),
-		}).Error("Failed to watch. Skipping inotify ")
-		return nil, true
+		return err
 	}
-
-	return watcher, false
+	args := append([]string{}, p.MkfsArgs...)
+	args = append(args, p.LabelFlag, p.Label(label))
+	args = append(args, opts...)
+	out, err := exec.Command(mkfscmd, append(args, device)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to create filesystem on %s: %s. Output = %s",
+			device, err, out)
+	}
+	return nil
 }
 
-// DevAttachWait waits for attach operation to be completed
-func DevAttachWait(watcher *inotify.Watcher, name string, device string) {
-loop:
-	for {
-		select {
-		case ev := <-watcher.Event:
-			log.Debug("event: ", ev)
-			if ev.Name == device {
-				// Log when the device is discovered
-				log.WithFields(
-					log.Fields{"device": device, "event": ev},
-				).Info("Scan complete ")
-				break loop
-			}
-		case err := <-watcher.Error:
-			log.WithFields(
-				log.Fields{"device": device, "error": err},
-			).Error("Hit error during watch ")
-			break loop
-		case <-time.After(devWaitTimeout):
-			log.WithFields(
-				log.Fields{"timeout": devWaitTimeout, "device": device},
-			).Warning("Exceeded timeout while waiting for device attach to complete")
-			break loop
+// IsBlankDevice returns true if blkid finds no filesystem (or other)
+// signature on the device
+func IsBlankDevice(device string) (bool, error) {
+	out, err := exec.Command("blkid", "-p", device).CombinedOutput()
+	if err == nil {
+		return false, nil
+	}
+	// blkid exits with 2 when nothing was found on the device
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNotFound {
+			return true, nil
 		}
 	}
-	watcher.Close()
+	return false, fmt.Errorf("Failed to probe device %s: %s. Output = %s", device, err, out)
 }
 
-// Mkdir creates a directory at the specified path
-func Mkdir(path string) error {
-	stat, err := os.Lstat(path)
-	if os.IsNotExist(err) {
-		if err := os.MkdirAll(path, 0755); err != nil {
-			return err
+// Fsck checks the filesystem on the unmounted device with the checker of
+// its profile. With repair the checker fixes what it safely can, force has
+// it check a filesystem marked clean too. Returns one of the Fsck results,
+// or an error with the checker output if errors are left.
+func Fsck(fstype string, device string, repair bool, force bool) (string, error) {
+	p, exists := profiles[fstype]
+	if !exists || p.Check == nil {
+		return FsckSkipped, nil
+	}
+	cmd := p.Check(device, repair, force)
+	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	if err == nil {
+		return FsckClean, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && repair && status.ExitStatus() <= p.CheckRepaired {
+			return FsckRepaired, nil
 		}
-	} else if err != nil {
+	}
+	return "", fmt.Errorf("Filesystem check of %s found errors: %s. Output = %s", device, err, out)
+}
+
+// Seed copies the content of a directory, or extracts a (compressed)
+// tarball, into the mounted filesystem at mountpoint. Ownership,
+// permissions, xattrs, ACLs and sparse files are preserved.
+func Seed(source string, mountpoint string) error {
+	stat, err := os.Stat(source)
+	if err != nil {
 		return err
 	}
+	if stat.IsDir() {
+		return CopyDir(source, mountpoint)
+	}
+	// GNU tar detects the compression of the archive on its own
+	out, err := exec.Command("tar", "-x", "-f", source, "-C", mountpoint,
+		"--same-owner", "--numeric-owner", "--same-permissions",
+		"--xattrs", "--xattrs-include=*", "--acls").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to seed filesystem from %s: %s. Output = %s",
+			source, err, out)
+	}
+	return nil
+}
 
-	if stat != nil && !stat.IsDir() {
-		return fmt.Errorf("%v already exist and it's not a directory", path)
+// CopyDir copies the content of the directory source into target.
+// Ownership, permissions, xattrs, ACLs, hard links and sparse files are
+// preserved.
+func CopyDir(source string, target string) error {
+	out, err := exec.Command("cp", "-a", "--sparse=always",
+		source+"/.", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s to %s: %s. Output = %s",
+			source, target, err, out)
 	}
 	return nil
 }
 
-// Mkfs creates a filesystem at the specified device
-func Mkfs(mkfscmd string, label string, device string) error {
-	var err error
-	var out []byte
+// Usage returns the space used and the size of the filesystem mounted at
+// mountpoint
+func Usage(mountpoint string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountpoint, &stat); err != nil {
+		return 0, 0, fmt.Errorf("Failed to stat filesystem at %s: %s", mountpoint, err)
+	}
+	return (stat.Blocks - stat.Bfree) * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// GetMountInfo returns the device and filesystem type mounted at mountpoint
+func GetMountInfo(mountpoint string) (string, string, error) {
+	data, err := ioutil.ReadFile(procMounts)
+	if err != nil {
+		return "", "", err
+	}
+	return parseMounts(string(data), mountpoint)
+}
 
-	// Workaround older versions of e2fsprogs, issue 629.
-	// If mkfscmd is of an ext* filesystem use -F flag
-	// to avoid having mkfs command to expect user confirmation.
-	if strings.Split(mkfscmd, ".")[1][0:3] == "ext" {
-		out, err = exec.Command(mkfscmd, "-F", "-L", label, device).CombinedOutput()
-	} else {
-		out, err = exec.Command(mkfscmd, "-L", label, device).CombinedOutput()
+// parseMounts finds mountpoint in the content of /proc/mounts, the last
+// mount on it wins
+func parseMounts(mounts string, mountpoint string) (string, string, error) {
+	device, fstype := "", ""
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == mountpoint {
+			device, fstype = fields[0], fields[2]
+		}
 	}
+	if device == "" {
+		return "", "", fmt.Errorf("Nothing is mounted at %s", mountpoint)
+	}
+	return device, fstype, nil
+}
+
+// RescanDevice has the kernel read the size of the disk device again,
+// after the disk was extended
+func RescanDevice(device string) error {
+	dev, err := filepath.EvalSymlinks(device)
 	if err != nil {
-		return fmt.Errorf("Failed to create filesystem on %s: %s. Output = %s",
+		return fmt.Errorf("Failed to resolve device %s: %s", device, err)
+	}
+	node := bdevPath + filepath.Base(dev) + rescanFile
+	log.Debugf("Rescanning device - device: %s, node: %s", device, node)
+	return ioutil.WriteFile(node, []byte("1"), 0644)
+}
+
+// GrowFs grows the filesystem mounted at mountpoint to the size of its
+// device, online
+func GrowFs(fstype string, device string, mountpoint string) error {
+	p, exists := profiles[fstype]
+	if !exists || p.Grow == nil {
+		return fmt.Errorf("Growing a %s filesystem is not supported", fstype)
+	}
+	cmd := p.Grow(device, mountpoint)
+	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to grow filesystem on %s: %s. Output = %s",
 			device, err, out)
 	}
 	return nil
 }
 
-// MkfsLookup finds existent filesystem tools
+// MkfsLookup finds the mkfs tools of the supported filesystems
 func MkfsLookup() map[string]string {
 	supportedFs := make(map[string]string)
 
-	for _, sp := range BinSearchPath {
-		mkftools, _ := filepath.Glob(sp + "/mkfs.*")
-		for _, mkfs := range mkftools {
-			supportedFs[strings.Split(mkfs, ".")[1]] = mkfs
+	for fstype, p := range profiles {
+		for _, sp := range BinSearchPath {
+			mkfs := filepath.Join(sp, p.Mkfs)
+			if _, err := os.Stat(mkfs); err == nil {
+				supportedFs[fstype] = mkfs
+				break
+			}
 		}
 	}
 	return supportedFs
 }
 
-// Mount the filesystem (`fs`) on the device at the given mount point.
+// Mount the filesystem (`fs`) on the device at the given mount point, with
+// the mount options of its profile.
 func Mount(mountpoint string, fstype string, device string, isReadOnly bool) error {
 	log.WithFields(log.Fields{
 		"device":     device,
@@ -169,13 +280,39 @@ func Mount(mountpoint string, fstype string, device string, isReadOnly bool) err
 	if isReadOnly {
 		flags = syscall.MS_RDONLY
 	}
-	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), "")
+	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), profiles[fstype].MountData)
 	if err != nil {
 		return fmt.Errorf("Failed to mount device %s at %s: %s", device, mountpoint, err)
 	}
 	return nil
 }
 
+// MountOverlay mounts an overlay filesystem of the read-only directory
+// lower and the directory upper at mountpoint. work is the overlayfs work
+// directory, on the same filesystem as upper.
+func MountOverlay(mountpoint string, lower string, upper string, work string) error {
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	log.WithFields(log.Fields{"mountpoint": mountpoint, "data": data}).Debug("Mounting overlay ")
+	if err := syscall.Mount("overlay", mountpoint, "overlay", 0, data); err != nil {
+		return fmt.Errorf("Failed to mount overlay at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// MountTmpfs mounts a tmpfs of sizeMB at mountpoint, 0 for the tmpfs
+// default size
+func MountTmpfs(mountpoint string, sizeMB uint64) error {
+	data := ""
+	if sizeMB != 0 {
+		data = fmt.Sprintf("size=%dm", sizeMB)
+	}
+	log.WithFields(log.Fields{"mountpoint": mountpoint, "data": data}).Debug("Mounting tmpfs ")
+	if err := syscall.Mount("tmpfs", mountpoint, "tmpfs", 0, data); err != nil {
+		return fmt.Errorf("Failed to mount tmpfs at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
 // MountWithID - mount device with ID
 func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
 	log.WithFields(log.Fields{
@@ -214,39 +351,167 @@ func Unmount(mountPoint string) error {
 	return nil
 }
 
+// Freeze the filesystem mounted at mountpoint. Writes block until Thaw.
+func Freeze(mountpoint string) error {
+	if err := mountpointIoctl(mountpoint, ioctlFreeze); err != nil {
+		return fmt.Errorf("Failed to freeze filesystem at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// Thaw a filesystem frozen by Freeze.
+func Thaw(mountpoint string) error {
+	if err := mountpointIoctl(mountpoint, ioctlThaw); err != nil {
+		return fmt.Errorf("Failed to thaw filesystem at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// fstrimRange is struct fstrim_range of linux/fs.h
+type fstrimRange struct {
+	start  uint64
+	length uint64
+	minLen uint64
+}
+
+// Trim discards the unused blocks of the filesystem mounted at mountpoint,
+// so that the space is returned to a thin device. Returns the bytes
+// trimmed, as the filesystem counts them.
+func Trim(mountpoint string) (uint64, error) {
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	r := fstrimRange{length: ^uint64(0)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), ioctlTrim, uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return 0, fmt.Errorf("Failed to trim filesystem at %s: %s", mountpoint, errno)
+	}
+	return r.length, nil
+}
+
+func mountpointIoctl(mountpoint string, request uintptr) error {
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), request, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
 func makeDevicePathWithID(id string) string {
-	return diskPathByDevID + strings.Join(strings.Split(id, "-"), "")
+	return diskPathByDevID + normalizeDiskID(id)
 }
 
-// GetDevicePathByID - return full path for device with given ID
-func GetDevicePathByID(id string) (string, error) {
+// ReleaseDevice flushes the device of an unmounted disk and removes it from
+// the guest, before the disk is detached, so that the guest doesn't keep
+// a stale device and fail I/O to it. Waits for the device to go away.
+// Devices without a delete file in sysfs (NVMe namespaces) are only
+// flushed, the kernel removes them when the disk is detached.
+func ReleaseDevice(device string) error {
+	node, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve device %s: %s", device, err)
+	}
+	mounts, err := ioutil.ReadFile(procMounts)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		// mounts by a link, e.g. in /dev/disk/by-path, show the link
+		if source, err := filepath.EvalSymlinks(fields[0]); err == nil && source == node {
+			return fmt.Errorf("Device %s is still mounted at %s", node, fields[1])
+		}
+	}
+	syscall.Sync()
+	if err = flushBuffers(node); err != nil {
+		return err
+	}
+	return deleteDevice(bdevPath, filepath.Base(node), devWaitTimeout)
+}
+
+// flushBuffers writes the dirty buffers of the block device node and drops
+// its cached ones
+func flushBuffers(node string) error {
+	dev, err := os.Open(node)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), ioctlFlushBufs, 0)
+	if errno != 0 {
+		return fmt.Errorf("Failed to flush buffers of %s: %s", node, errno)
+	}
+	return nil
+}
+
+// deleteDevice removes the SCSI device name in sysBlockDir from the guest,
+// and waits up to timeout for it to go away
+func deleteDevice(sysBlockDir string, name string, timeout time.Duration) error {
+	devDir := filepath.Join(sysBlockDir, name)
+	node := filepath.Join(devDir, deleteFile)
+	if _, err := os.Stat(node); os.IsNotExist(err) {
+		log.WithFields(log.Fields{"device": name}).Debug("Device can't be deleted, leaving it to the detach ")
+		return nil
+	}
+	log.WithFields(log.Fields{"device": name, "node": node}).Debug("Deleting device ")
+	if err := ioutil.WriteFile(node, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("Failed to delete device %s: %s", name, err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(devDir); os.IsNotExist(err) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Device %s still present %s after its delete", name, timeout)
+		}
+		time.Sleep(devPollInterval)
+	}
+}
+
+// RescanScsiHosts has the kernel scan all SCSI hosts for disks, e.g. to
+// find a disk again whose device was deleted
+func RescanScsiHosts() error {
 	hosts, err := ioutil.ReadDir(scsiHostPath)
 	if err != nil {
-		return "", err
+		return err
 	}
-	time.Sleep(10)
 	for _, host := range hosts {
-		//Scan so we may have the device before attempting a mount
 		scanHost := scsiHostPath + host.Name() + "/scan"
 		bytes := []byte("- - -")
-		log.WithFields(log.Fields{"disk id": id, "scan cmd": scanHost}).Info("Rescanning ... ")
+		log.WithFields(log.Fields{"scan cmd": scanHost}).Info("Rescanning ... ")
 		err = ioutil.WriteFile(scanHost, bytes, 0644)
 		if err != nil {
-			return "", err
+			return err
 		}
 	}
+	return nil
+}
 
-	watcher, skipInotify := DevAttachWaitPrep(id, watchPath)
+// GetDevicePathByID - return full path for device with given ID
+func GetDevicePathByID(id string) (string, error) {
+	time.Sleep(10)
+	//Scan so we may have the device before attempting a mount
+	err := RescanScsiHosts()
+	if err != nil {
+		return "", err
+	}
 
-	device := makeDevicePathWithID(id)
+	watcher := DevAttachWaitPrep(id)
 
-	if skipInotify {
-		time.Sleep(10)
-	} else {
-		// Wait for the attach to complete, may timeout
-		// in which case we continue creating the file system.
-		DevAttachWait(watcher, id, device)
-	}
+	// Wait for the attach to complete, may timeout
+	// in which case we continue creating the file system.
+	device := DevAttachWait(watcher, id, makeDevicePathWithID(id))
 	_, err = os.Stat(device)
 	if err != nil {
 		return "", err
@@ -274,38 +539,3 @@ func DeleteDevicePathWithID(id string) error {
 	}
 	return nil
 }
-
-// GetDevicePath - return device path or error
-func GetDevicePath(str []byte) (string, error) {
-	var volDev VolumeDevSpec
-	err := json.Unmarshal(str, &volDev)
-	if err != nil && len(err.Error()) != 0 {
-		return "", err
-	}
-
-	// Get the device node for the unit returned from the attach.
-	// Lookup each device that has a label and if that label matches
-	// the one for the given bus number.
-	// The device we need is then constructed from the dir name with
-	// the matching label.
-	pciSlotAddr := fmt.Sprintf("%s/%s/address", sysPciSlots, volDev.ControllerPciSlotNumber)
-
-	fh, err := os.Open(pciSlotAddr)
-	if err != nil {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
-			volDev.Unit, volDev.ControllerPciSlotNumber)
-		return "", fmt.Errorf("Device not found")
-	}
-
-	buf := make([]byte, pciAddrLen)
-	_, err = fh.Read(buf)
-
-	fh.Close()
-	if err != nil && err != io.EOF {
-		log.WithFields(log.Fields{"Error": err}).Warn("Get device path failed for unit# %s @ PCI slot %s: ",
-			volDev.Unit, volDev.ControllerPciSlotNumber)
-		return "", fmt.Errorf("Device not found")
-	}
-	return fmt.Sprintf("/dev/disk/by-path/pci-%s.0-scsi-0:0:%s:0", string(buf), volDev.Unit), nil
-
-}
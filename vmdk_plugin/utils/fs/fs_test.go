@@ -0,0 +1,64 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Test the removal of devices before the detach, in a fake sysfs where a
+// goroutine plays the kernel deleting the device
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-delete-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// no delete file, e.g. an NVMe namespace
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "nvme0n1", "device"), 0755))
+	assert.Nil(t, deleteDevice(dir, "nvme0n1", time.Second))
+
+	// the device stays
+	devDir := filepath.Join(dir, "sdb")
+	assert.Nil(t, os.MkdirAll(filepath.Join(devDir, "device"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(devDir, deleteFile), nil, 0644))
+	assert.NotNil(t, deleteDevice(dir, "sdb", 2*devPollInterval))
+
+	// the device goes away once deleted
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(devDir, deleteFile), nil, 0644))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if data, _ := ioutil.ReadFile(filepath.Join(devDir, deleteFile)); string(data) == "1" {
+				os.RemoveAll(devDir)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	assert.Nil(t, deleteDevice(dir, "sdb", 5*time.Second))
+	<-done
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Verification of the identity of an attached disk. The device path is
+// computed from the controller and unit of the attach reply, which point
+// at another disk if the controllers were renumbered. ESX returns the UUID
+// of the disk as well, which the guest sees as the WWN of the disk when
+// the VM has disk.EnableUUID set. It is compared with the WWN in sysfs, or
+// the NAA designator of VPD page 0x83, or the /dev/disk/by-id links.
+
+package fs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	sysDevWwid   = "device/wwid"     // under /sys/block/<dev>, "naa.<WWN>"
+	sysDevVpd83  = "device/vpd_pg83" // under /sys/block/<dev>, device identification VPD page
+	diskByIDDir  = "/dev/disk/by-id"
+	wwnLinkStart = "wwn-0x" // by-id link of a disk named by its WWN
+	naaPrefix    = "naa."
+	vpdPage83    = 0x83
+	vpdNaaType   = 3 // designator type of NAA designators
+)
+
+// VerifyDevice checks that device is the disk of the attach reply dev.
+// Returns an error if the device is another disk. A disk whose identity
+// can't be found is not refused, this is logged.
+func VerifyDevice(dev []byte, device string) error {
+	var volDev VolumeDevSpec
+	if err := json.Unmarshal(dev, &volDev); err != nil {
+		return err
+	}
+	if volDev.DiskUUID == "" {
+		log.WithFields(log.Fields{"device": device}).Warning("No disk UUID in the attach reply, not verifying the device ")
+		return nil
+	}
+	return verifyDiskID(sysBlock, diskByIDDir, device, volDev.DiskUUID)
+}
+
+// verifyDiskID checks that device has the WWN of the disk with uuid
+func verifyDiskID(sysBlockDir string, byIDDir string, device string, uuid string) error {
+	node, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve device %s: %s", device, err)
+	}
+	want := normalizeDiskID(uuid)
+	id, source := deviceDiskID(sysBlockDir, byIDDir, node)
+	if id == "" {
+		log.WithFields(log.Fields{"device": device, "uuid": uuid}).Warning("Disk identity not found, set disk.EnableUUID on the VM to have devices verified ")
+		return nil
+	}
+	if id != want {
+		return fmt.Errorf("Device %s is disk %s (%s), expected disk %s, refusing to use it",
+			device, id, source, want)
+	}
+	log.WithFields(log.Fields{"device": device, "wwn": id, "source": source}).Debug("Device verified ")
+	return nil
+}
+
+// deviceDiskID returns the WWN of the device node and where it was found,
+// "" if it wasn't
+func deviceDiskID(sysBlockDir string, byIDDir string, node string) (string, string) {
+	devDir := filepath.Join(sysBlockDir, filepath.Base(node))
+	if wwid, err := ioutil.ReadFile(filepath.Join(devDir, sysDevWwid)); err == nil {
+		if id := strings.TrimSpace(string(wwid)); strings.HasPrefix(id, naaPrefix) {
+			return normalizeDiskID(strings.TrimPrefix(id, naaPrefix)), sysDevWwid
+		}
+	}
+	if page, err := ioutil.ReadFile(filepath.Join(devDir, sysDevVpd83)); err == nil {
+		if id := naaOfVpd83(page); id != "" {
+			return id, sysDevVpd83
+		}
+	}
+	links, _ := ioutil.ReadDir(byIDDir)
+	for _, link := range links {
+		if !strings.HasPrefix(link.Name(), wwnLinkStart) {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(filepath.Join(byIDDir, link.Name()))
+		if err == nil && target == node {
+			return normalizeDiskID(strings.TrimPrefix(link.Name(), wwnLinkStart)), byIDDir
+		}
+	}
+	return "", ""
+}
+
+// normalizeDiskID returns a disk UUID or WWN as lower case hex digits
+func normalizeDiskID(id string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(id))
+}
+
+// naaOfVpd83 returns the NAA designator of the logical unit in the device
+// identification VPD page, "" if it has none
+func naaOfVpd83(page []byte) string {
+	if len(page) < 4 || page[1] != vpdPage83 {
+		return ""
+	}
+	end := 4 + (int(page[2])<<8 | int(page[3]))
+	if end > len(page) {
+		end = len(page)
+	}
+	for i := 4; i+4 <= end; {
+		idLen := int(page[i+3])
+		if i+4+idLen > end {
+			break
+		}
+		// association 0 is the logical unit, not the port or target
+		association := (page[i+1] >> 4) & 0x3
+		if page[i+1]&0xf == vpdNaaType && association == 0 {
+			return hex.EncodeToString(page[i+4 : i+4+idLen])
+		}
+		i += 4 + idLen
+	}
+	return ""
+}
+
+// GetLabel returns the label of the filesystem on device, "" if it has none
+func GetLabel(device string) (string, error) {
+	out, err := exec.Command("blkid", "-p", "-s", "LABEL", "-o", "value", device).CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 when nothing was found on the device
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNotFound {
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("Failed to get filesystem label of %s: %s. Output = %s", device, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Test the verification of devices against the disk UUID, in a fake sysfs
+
+package fs
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testDiskUUID = "6000C29a-1b2c-3d4e-5f60-718293a4b5c6"
+	testDiskWWN  = "6000c29a1b2c3d4e5f60718293a4b5c6"
+	otherDiskWWN = "6000c2900000000000000000000000aa"
+)
+
+// vpd83 returns a device identification VPD page with a T10 vendor ID
+// designator, and an NAA designator of the target port and of the disk
+func vpd83(wwn string) []byte {
+	naa, _ := hex.DecodeString(wwn)
+	port, _ := hex.DecodeString(otherDiskWWN)
+	t10 := []byte("VMware  Virtual disk")
+	var body []byte
+	body = append(body, 0x02, 0x01, 0x00, byte(len(t10)))
+	body = append(body, t10...)
+	body = append(body, 0x01, 0x13, 0x00, byte(len(port)))
+	body = append(body, port...)
+	body = append(body, 0x01, 0x03, 0x00, byte(len(naa)))
+	body = append(body, naa...)
+	return append([]byte{0x00, 0x83, 0x00, byte(len(body))}, body...)
+}
+
+func TestNaaOfVpd83(t *testing.T) {
+	assert.Equal(t, testDiskWWN, naaOfVpd83(vpd83(testDiskWWN)))
+	assert.Equal(t, "", naaOfVpd83([]byte{0x00, 0x80, 0x00, 0x00}))
+	// truncated
+	assert.Equal(t, "", naaOfVpd83(vpd83(testDiskWWN)[:30]))
+}
+
+func TestVerifyDiskID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-identity-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	sys := filepath.Join(dir, "sys")
+	byID := filepath.Join(dir, "by-id")
+	node := filepath.Join(dir, "sdb")
+	assert.Nil(t, os.MkdirAll(filepath.Join(sys, "sdb", "device"), 0755))
+	assert.Nil(t, os.MkdirAll(byID, 0755))
+	assert.Nil(t, ioutil.WriteFile(node, nil, 0644))
+
+	// nothing to verify against
+	assert.Nil(t, verifyDiskID(sys, byID, node, testDiskUUID))
+
+	// by-id link
+	assert.Nil(t, os.Symlink(node, filepath.Join(byID, "wwn-0x"+otherDiskWWN)))
+	assert.NotNil(t, verifyDiskID(sys, byID, node, testDiskUUID))
+
+	// VPD page, over the by-id link
+	vpd := filepath.Join(sys, "sdb", sysDevVpd83)
+	assert.Nil(t, ioutil.WriteFile(vpd, vpd83(testDiskWWN), 0644))
+	assert.Nil(t, verifyDiskID(sys, byID, node, testDiskUUID))
+
+	// WWID, over the VPD page
+	wwid := filepath.Join(sys, "sdb", sysDevWwid)
+	assert.Nil(t, ioutil.WriteFile(wwid, []byte("naa."+otherDiskWWN+"\n"), 0644))
+	assert.NotNil(t, verifyDiskID(sys, byID, node, testDiskUUID))
+	assert.Nil(t, ioutil.WriteFile(wwid, []byte("naa."+testDiskWWN+"\n"), 0644))
+	assert.Nil(t, verifyDiskID(sys, byID, node, testDiskUUID))
+
+	// the device may be a link to the node
+	link := filepath.Join(dir, "pci-0000:03:00.0-scsi-0:0:1:0")
+	assert.Nil(t, os.Symlink(node, link))
+	assert.Nil(t, verifyDiskID(sys, byID, link, testDiskUUID))
+}
@@ -0,0 +1,216 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Filesystem profiles: how volumes with each supported filesystem are
+// created, labeled, mounted, grown and checked.
+
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Profile describes the handling of a filesystem type
+type Profile struct {
+	Mkfs        string   // mkfs tool, looked up in BinSearchPath
+	MkfsArgs    []string // passed to mkfs first, e.g. to not ask for confirmation
+	LabelFlag   string   // mkfs flag setting the label
+	MaxLabelLen int      // longer labels are cut
+	// mkfs flags allowed in the mkfs-opts volume option, true for flags
+	// taking a value
+	MkfsOpts  map[string]bool
+	MountData string // filesystem specific mount options
+	// Grow returns the command growing the filesystem online, nil if the
+	// filesystem can't be grown
+	Grow func(device string, mountpoint string) []string
+	// Check returns the command checking the unmounted filesystem, with
+	// repair if the checker can, nil if the filesystem isn't checked
+	Check func(device string, repair bool, force bool) []string
+	// Highest exit code of the checker meaning no errors are left, after
+	// a check with repair
+	CheckRepaired int
+	// The mount replays the journal of an uncleanly unmounted filesystem,
+	// which the checker doesn't; a check before the mount reports what the
+	// replay fixes
+	MountRecovers bool
+}
+
+var extProfile = Profile{
+	// Workaround older versions of e2fsprogs, issue 629. -F to avoid
+	// having mkfs command to expect user confirmation.
+	MkfsArgs:    []string{"-F"},
+	LabelFlag:   "-L",
+	MaxLabelLen: 16,
+	MkfsOpts: map[string]bool{"-b": true, "-C": true, "-E": true, "-g": true, "-G": true,
+		"-i": true, "-I": true, "-j": false, "-J": true, "-m": true, "-N": true, "-O": true,
+		"-T": true},
+	Grow: func(device string, mountpoint string) []string {
+		return []string{"resize2fs", device}
+	},
+	Check: func(device string, repair bool, force bool) []string {
+		cmd := []string{"e2fsck", "-n"}
+		if repair {
+			cmd[1] = "-p"
+		}
+		if force {
+			cmd = append(cmd, "-f")
+		}
+		return append(cmd, device)
+	},
+	// 1 when the filesystem was repaired, 2 when the system should be
+	// rebooted as well, which doesn't matter for a filesystem which isn't
+	// mounted
+	CheckRepaired: 2,
+}
+
+// profiles of the supported filesystems
+var profiles = map[string]Profile{
+	"ext2": withMkfs(extProfile, "mkfs.ext2"),
+	"ext3": withMkfs(extProfile, "mkfs.ext3"),
+	"ext4": withMkfs(extProfile, "mkfs.ext4"),
+	"xfs": {
+		Mkfs:        "mkfs.xfs",
+		LabelFlag:   "-L",
+		MaxLabelLen: 12,
+		MkfsOpts: map[string]bool{"-b": true, "-d": true, "-i": true, "-l": true, "-m": true,
+			"-n": true, "-r": true, "-s": true, "-K": false},
+		// clones of a volume have the same filesystem UUID
+		MountData: "nouuid",
+		Grow: func(device string, mountpoint string) []string {
+			return []string{"xfs_growfs", mountpoint}
+		},
+		// xfs_repair doesn't preen, only check
+		Check: func(device string, repair bool, force bool) []string {
+			return []string{"xfs_repair", "-n", device}
+		},
+		// xfs_repair -n fails on a dirty log
+		MountRecovers: true,
+	},
+	"btrfs": {
+		Mkfs:        "mkfs.btrfs",
+		LabelFlag:   "-L",
+		MaxLabelLen: 255,
+		MkfsOpts: map[string]bool{"-d": true, "-m": true, "-n": true, "-s": true, "-O": true,
+			"-R": true, "-M": false, "-K": false},
+		Grow: func(device string, mountpoint string) []string {
+			return []string{"btrfs", "filesystem", "resize", "max", mountpoint}
+		},
+		// btrfs check --repair isn't safe to run unattended
+		Check: func(device string, repair bool, force bool) []string {
+			return []string{"btrfs", "check", "--readonly", device}
+		},
+	},
+	"vfat": {
+		Mkfs:        "mkfs.vfat",
+		LabelFlag:   "-n",
+		MaxLabelLen: 11,
+		MkfsOpts: map[string]bool{"-F": true, "-f": true, "-r": true, "-R": true, "-s": true,
+			"-S": true, "-I": false},
+		Check: func(device string, repair bool, force bool) []string {
+			if repair {
+				return []string{"fsck.vfat", "-a", device}
+			}
+			return []string{"fsck.vfat", "-n", device}
+		},
+		// 1 when errors were found, which -a repairs
+		CheckRepaired: 1,
+	},
+}
+
+// withMkfs returns profile p with the mkfs tool set
+func withMkfs(p Profile, mkfs string) Profile {
+	p.Mkfs = mkfs
+	return p
+}
+
+// GetProfile returns the profile of a filesystem type, false if the
+// filesystem is not supported
+func GetProfile(fstype string) (Profile, bool) {
+	p, exists := profiles[fstype]
+	return p, exists
+}
+
+// SupportedFs returns the supported filesystem types, sorted
+func SupportedFs() []string {
+	names := make([]string, 0, len(profiles))
+	for fstype := range profiles {
+		names = append(names, fstype)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckFstype returns an error listing the supported filesystems if
+// fstype is not one of them
+func CheckFstype(fstype string) error {
+	if _, exists := profiles[fstype]; !exists {
+		return fmt.Errorf("Filesystem %s is not supported. Supported filesystems: %s",
+			fstype, strings.Join(SupportedFs(), ", "))
+	}
+	return nil
+}
+
+// profileOfMkfs returns the profile of a mkfs tool found by MkfsLookup
+func profileOfMkfs(mkfscmd string) (string, Profile, bool) {
+	fstype := strings.TrimPrefix(filepath.Base(mkfscmd), "mkfs.")
+	p, exists := profiles[fstype]
+	return fstype, p, exists
+}
+
+// Label returns the filesystem label for a volume name
+func (p Profile) Label(name string) string {
+	if len(name) > p.MaxLabelLen {
+		return name[:p.MaxLabelLen]
+	}
+	return name
+}
+
+// CheckMkfsOpts validates mkfs-opts, space separated mkfs flags and their
+// values, against the profile of fstype. Returns the arguments for mkfs.
+func CheckMkfsOpts(fstype string, mkfsOpts string) ([]string, error) {
+	if err := CheckFstype(fstype); err != nil {
+		return nil, err
+	}
+	allowed := profiles[fstype].MkfsOpts
+	args := strings.Fields(mkfsOpts)
+	for i := 0; i < len(args); i++ {
+		takesValue, exists := allowed[args[i]]
+		if !exists {
+			return nil, fmt.Errorf("Option %s is not allowed in mkfs-opts for %s. Allowed options: %s",
+				args[i], fstype, strings.Join(sortedFlags(allowed), " "))
+		}
+		if takesValue {
+			if i+1 == len(args) || strings.HasPrefix(args[i+1], "-") {
+				return nil, fmt.Errorf("Option %s in mkfs-opts expects a value", args[i])
+			}
+			i++
+		}
+	}
+	return args, nil
+}
+
+// sortedFlags returns the flags of a MkfsOpts map, sorted
+func sortedFlags(flags map[string]bool) []string {
+	names := make([]string, 0, len(flags))
+	for flag := range flags {
+		names = append(names, flag)
+	}
+	sort.Strings(names)
+	return names
+}
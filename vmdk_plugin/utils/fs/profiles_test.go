@@ -0,0 +1,69 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Test the filesystem profiles and the validation of mkfs-opts
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMkfsOpts(t *testing.T) {
+	args, err := CheckMkfsOpts("ext4", " -m 1  -E lazy_itable_init=0 -j")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-m", "1", "-E", "lazy_itable_init=0", "-j"}, args)
+
+	args, err = CheckMkfsOpts("xfs", "")
+	assert.Nil(t, err)
+	assert.Empty(t, args)
+
+	// the label and the device are the plugin's
+	_, err = CheckMkfsOpts("ext4", "-L other")
+	assert.NotNil(t, err)
+	_, err = CheckMkfsOpts("ext4", "-m 1 /dev/sdb")
+	assert.NotNil(t, err)
+	// missing values
+	_, err = CheckMkfsOpts("xfs", "-b")
+	assert.NotNil(t, err)
+	_, err = CheckMkfsOpts("btrfs", "-d -M")
+	assert.NotNil(t, err)
+
+	_, err = CheckMkfsOpts("zfs", "")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "btrfs, ext2, ext3, ext4, vfat, xfs")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	p, exists := GetProfile("xfs")
+	assert.True(t, exists)
+	assert.Equal(t, "volume-name-", p.Label("volume-name-is-long"))
+	assert.Equal(t, "short", p.Label("short"))
+
+	fstype, p, exists := profileOfMkfs("/usr/sbin/mkfs.ext4")
+	assert.True(t, exists)
+	assert.Equal(t, "ext4", fstype)
+	assert.Equal(t, []string{"e2fsck", "-p", "-f", "/dev/sdb"}, p.Check("/dev/sdb", true, true))
+	_, _, exists = profileOfMkfs("/sbin/mkfs.f")
+	assert.False(t, exists)
+
+	p, _ = GetProfile("vfat")
+	assert.Nil(t, p.Grow)
+	assert.Equal(t, 1, p.CheckRepaired)
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Discovery of the device of an attached disk. The kernel announces the
+// new SCSI disk or NVMe namespace with an "add" uevent on a netlink socket,
+// which is opened before the attach so the event can't be missed. The udev
+// symlinks to the device may appear late, or never in a container, so the
+// device node named in the event is used until they do. Without the
+// netlink socket the device is polled for, in /dev and in sysfs.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	ueventGroupKernel = 1                      // netlink multicast group of kernel uevents
+	ueventBufSize     = 16 * 1024              // uevents are smaller than a page
+	devPollInterval   = 100 * time.Millisecond // between checks for the device
+	sysBlock          = "/sys/block"
+	devDir            = "/dev"
+)
+
+var (
+	// /dev/disk/by-path/pci-<PCI address>-scsi-<host>:<channel>:<target>:<lun>
+	byPathPattern = regexp.MustCompile(`^/dev/disk/by-path/pci-([0-9a-f:.]+)-scsi-[0-9]+:([0-9]+):([0-9]+):([0-9]+)$`)
+	// /dev/disk/by-path/pci-<PCI address>-nvme-<namespace ID>
+	nvmeByPathPattern = regexp.MustCompile(`^/dev/disk/by-path/pci-([0-9a-f:.]+)-nvme-([0-9]+)$`)
+	// nvme<controller>n<namespace ID>
+	nvmeNamePattern = regexp.MustCompile(`^nvme[0-9]+n([0-9]+)$`)
+)
+
+// DevWatcher listens for the device of a disk being attached
+type DevWatcher struct {
+	sock  int       // netlink uevent socket, -1 to poll
+	start time.Time // when the attach started
+}
+
+// attachedDisk tells the block device of a disk being attached
+type attachedDisk interface {
+	// matches returns true if the block device name, at the sysfs device
+	// path devPath, is the disk
+	matches(name string, devPath string) bool
+}
+
+// scsiDisk is the location of a disk on a SCSI controller
+type scsiDisk struct {
+	pciAddr string // PCI address of the controller
+	addr    string // <channel>:<target>:<lun>, the host number is not known
+}
+
+// nvmeDisk is a namespace of an NVMe controller
+type nvmeDisk struct {
+	pciAddr string // PCI address of the controller
+	ns      string // namespace ID
+}
+
+// wwnDisk is a disk with a WWN
+type wwnDisk struct {
+	wwn         string // lower case hex digits
+	sysBlockDir string // where its WWN is found
+}
+
+// DevAttachWaitPrep starts listening for the device of the disk attached
+// next, wait for it with DevAttachWait.
+func DevAttachWaitPrep(name string) *DevWatcher {
+	w := &DevWatcher{sock: -1, start: time.Now()}
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err == nil {
+		err = syscall.Bind(sock, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK,
+			Groups: ueventGroupKernel})
+		if err == nil {
+			// wake up to check for the device now and then, in case
+			// the uevent is lost
+			tv := syscall.NsecToTimeval(int64(devPollInterval))
+			err = syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		}
+		if err != nil {
+			syscall.Close(sock)
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to listen for uevents, polling for the device ")
+		return w
+	}
+	w.sock = sock
+	return w
+}
+
+// DevAttachWait waits for the attached device to show up, and returns the
+// path to use for it: device once it exists, or the device node of the
+// disk until then. Gives up after devWaitTimeout, returning device.
+func DevAttachWait(w *DevWatcher, name string, device string) string {
+	defer w.Close()
+	disk, known := parseDevice(device)
+	deadline := w.start.Add(devWaitTimeout)
+	buf := make([]byte, ueventBufSize)
+	for {
+		if _, err := os.Stat(device); err == nil {
+			w.logLatency(name, device, "device link")
+			return device
+		}
+		if time.Now().After(deadline) {
+			log.WithFields(log.Fields{"timeout": devWaitTimeout, "device": device}).Warning("Exceeded timeout while waiting for device attach to complete ")
+			return device
+		}
+		via := "poll"
+		if w.sock >= 0 {
+			// times out after devPollInterval
+			n, _, err := syscall.Recvfrom(w.sock, buf, 0)
+			if err == nil {
+				if known {
+					if node := nodeOfUevent(disk, parseUevent(buf[:n])); node != "" {
+						w.logLatency(name, node, "uevent")
+						return node
+					}
+				}
+				continue
+			}
+			// in case the uevent was lost
+			via = "poll after uevent timeout"
+		} else {
+			time.Sleep(devPollInterval)
+		}
+		if known {
+			if node := nodeInSysfs(disk, sysBlock); node != "" {
+				w.logLatency(name, node, via)
+				return node
+			}
+		}
+	}
+}
+
+// Close stops listening for uevents, DevAttachWait does it when done
+func (w *DevWatcher) Close() {
+	if w.sock >= 0 {
+		syscall.Close(w.sock)
+		w.sock = -1
+	}
+}
+
+// logLatency logs the time from the start of the attach until device was
+// found
+func (w *DevWatcher) logLatency(name string, device string, via string) {
+	log.WithFields(log.Fields{"name": name, "device": device, "via": via,
+		"latency": time.Since(w.start)}).Info("Attached device found ")
+}
+
+// parseDevice returns the disk of a by-path or WWN device link
+func parseDevice(device string) (attachedDisk, bool) {
+	if match := byPathPattern.FindStringSubmatch(device); match != nil {
+		return scsiDisk{pciAddr: match[1], addr: strings.Join(match[2:], ":")}, true
+	}
+	if match := nvmeByPathPattern.FindStringSubmatch(device); match != nil {
+		return nvmeDisk{pciAddr: match[1], ns: match[2]}, true
+	}
+	if strings.HasPrefix(device, diskPathByDevID) {
+		return wwnDisk{wwn: strings.TrimPrefix(device, diskPathByDevID), sysBlockDir: sysBlock}, true
+	}
+	return nil, false
+}
+
+// parseUevent returns the variables of a kernel uevent,
+// "<action>@<devpath>\0KEY=value\0..."
+func parseUevent(msg []byte) map[string]string {
+	env := make(map[string]string)
+	for _, field := range strings.Split(string(msg), "\x00") {
+		if kv := strings.SplitN(field, "=", 2); len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	return env
+}
+
+// nodeOfUevent returns the device node of the disk if the uevent adds it,
+// "" otherwise
+func nodeOfUevent(disk attachedDisk, env map[string]string) string {
+	if env["ACTION"] != "add" || env["SUBSYSTEM"] != "block" || env["DEVTYPE"] != "disk" {
+		return ""
+	}
+	if env["DEVNAME"] == "" || !disk.matches(filepath.Base(env["DEVNAME"]), env["DEVPATH"]) {
+		return ""
+	}
+	node := filepath.Join(devDir, env["DEVNAME"])
+	if _, err := os.Stat(node); err != nil {
+		return ""
+	}
+	return node
+}
+
+// nodeInSysfs returns the device node of the disk if one of the block
+// devices in sysBlockDir is the disk, "" otherwise
+func nodeInSysfs(disk attachedDisk, sysBlockDir string) string {
+	devs, err := ioutil.ReadDir(sysBlockDir)
+	if err != nil {
+		return ""
+	}
+	for _, dev := range devs {
+		devPath, err := os.Readlink(filepath.Join(sysBlockDir, dev.Name()))
+		if err != nil || !disk.matches(dev.Name(), devPath) {
+			continue
+		}
+		node := filepath.Join(devDir, dev.Name())
+		if _, err := os.Stat(node); err == nil {
+			return node
+		}
+	}
+	return ""
+}
+
+// matches returns true if the sysfs device path is of the disk,
+// .../<PCI address>/host<n>/target<n>:<c>:<t>/<n>:<c>:<t>:<l>/block/<dev>
+func (disk scsiDisk) matches(name string, devPath string) bool {
+	elems := strings.Split(devPath, "/")
+	onController := false
+	for _, elem := range elems {
+		if elem == disk.pciAddr {
+			onController = true
+		} else if onController && strings.HasSuffix(elem, ":"+disk.addr) &&
+			!strings.HasPrefix(elem, "target") {
+			host := strings.TrimSuffix(elem, ":"+disk.addr)
+			return host != "" && strings.Trim(host, "0123456789") == ""
+		}
+	}
+	return false
+}
+
+// matches returns true if the sysfs device path is of the namespace,
+// .../<PCI address>/nvme/nvme<n>/nvme<n>n<namespace ID>
+func (disk nvmeDisk) matches(name string, devPath string) bool {
+	match := nvmeNamePattern.FindStringSubmatch(name)
+	if match == nil || match[1] != disk.ns {
+		return false
+	}
+	for _, elem := range strings.Split(devPath, "/") {
+		if elem == disk.pciAddr {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the block device has the WWN of the disk
+func (disk wwnDisk) matches(name string, devPath string) bool {
+	id, _ := deviceDiskID(disk.sysBlockDir, "", name)
+	return id == disk.wwn
+}
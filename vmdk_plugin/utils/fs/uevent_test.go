@@ -0,0 +1,104 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Test the matching of uevents and sysfs devices to an attached disk. The
+// fake devices are named "null", so that their device node exists.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDevPath = "/devices/pci0000:00/0000:00:15.0/0000:03:00.0/host2/target2:0:1/2:0:1:0/block/null"
+
+const testNvmeDevPath = "/devices/pci0000:00/0000:00:16.0/0000:0b:00.0/nvme/nvme0/nvme0n2"
+
+func TestParseDevice(t *testing.T) {
+	disk, ok := parseDevice("/dev/disk/by-path/pci-0000:03:00.0-scsi-0:0:1:0")
+	assert.True(t, ok)
+	assert.Equal(t, scsiDisk{pciAddr: "0000:03:00.0", addr: "0:1:0"}, disk)
+
+	disk, ok = parseDevice("/dev/disk/by-path/pci-0000:0b:00.0-nvme-2")
+	assert.True(t, ok)
+	assert.Equal(t, nvmeDisk{pciAddr: "0000:0b:00.0", ns: "2"}, disk)
+
+	disk, ok = parseDevice("/dev/disk/by-id/wwn-0x6000c29")
+	assert.True(t, ok)
+	assert.Equal(t, wwnDisk{wwn: "6000c29", sysBlockDir: sysBlock}, disk)
+
+	_, ok = parseDevice("/dev/sdb")
+	assert.False(t, ok)
+}
+
+func TestUeventMatch(t *testing.T) {
+	disk := scsiDisk{pciAddr: "0000:03:00.0", addr: "0:1:0"}
+	msg := []byte("add@" + testDevPath + "\x00ACTION=add\x00DEVPATH=" + testDevPath +
+		"\x00SUBSYSTEM=block\x00DEVNAME=null\x00DEVTYPE=disk\x00SEQNUM=1234\x00")
+	env := parseUevent(msg)
+	assert.Equal(t, "block", env["SUBSYSTEM"])
+	assert.Equal(t, "/dev/null", nodeOfUevent(disk, env))
+
+	env["DEVTYPE"] = "partition"
+	assert.Equal(t, "", nodeOfUevent(disk, env))
+	env["DEVTYPE"] = "disk"
+	env["ACTION"] = "remove"
+	assert.Equal(t, "", nodeOfUevent(disk, env))
+
+	// other target, other controller
+	assert.False(t, scsiDisk{pciAddr: "0000:03:00.0", addr: "0:2:0"}.matches("null", testDevPath))
+	assert.False(t, scsiDisk{pciAddr: "0000:0b:00.0", addr: "0:1:0"}.matches("null", testDevPath))
+}
+
+func TestNvmeMatch(t *testing.T) {
+	disk := nvmeDisk{pciAddr: "0000:0b:00.0", ns: "2"}
+	assert.True(t, disk.matches("nvme0n2", testNvmeDevPath))
+	// other namespace, other controller
+	assert.False(t, disk.matches("nvme0n1", testNvmeDevPath))
+	assert.False(t, disk.matches("nvme0n12", testNvmeDevPath))
+	assert.False(t, nvmeDisk{pciAddr: "0000:13:00.0", ns: "2"}.matches("nvme0n2", testNvmeDevPath))
+	// not a namespace
+	assert.False(t, disk.matches("null", testNvmeDevPath))
+}
+
+func TestNodeInSysfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vsphere-sysfs-test")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	disk := scsiDisk{pciAddr: "0000:03:00.0", addr: "0:1:0"}
+	assert.Equal(t, "", nodeInSysfs(disk, dir))
+	assert.Nil(t, os.Symlink("../devices/virtual/block/loop0", filepath.Join(dir, "loop0")))
+	assert.Equal(t, "", nodeInSysfs(disk, dir))
+	assert.Nil(t, os.Symlink(".."+testDevPath, filepath.Join(dir, "null")))
+	assert.Equal(t, "/dev/null", nodeInSysfs(disk, dir))
+
+	// by WWN
+	wwn := wwnDisk{wwn: testDiskWWN, sysBlockDir: dir}
+	assert.Equal(t, "", nodeInSysfs(wwn, dir))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "devices", "null", "device"), 0755))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "null")))
+	assert.Nil(t, os.Symlink("devices/null", filepath.Join(dir, "null")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "null", sysDevWwid), []byte("naa."+testDiskWWN+"\n"), 0644))
+	assert.Equal(t, "/dev/null", nodeInSysfs(wwn, dir))
+}
@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/vmdk_plugin/drivers"
@@ -32,6 +33,21 @@ const (
 	// index datastore from volume meta
 	// "datastore" key is defined in vmdkops service
 	datastoreKey = "datastore"
+
+	// EphemeralDir is the directory under the mount root with the mounts of
+	// ephemeral volumes, which are not VMDK volumes
+	EphemeralDir = ".ephemeral"
+
+	// values of the "access" volume option which mount the volume read-only
+	accessReadOnly     = "read-only"
+	accessReadOnlyMany = "read-only-many"
+)
+
+// Volumes moved to another datastore, the name Docker knows a volume by ->
+// its full name after the move. See SetVolumeMoved.
+var (
+	movedMtx     sync.Mutex
+	movedVolumes = make(map[string]string)
 )
 
 // VolumeInfo - Volume fullname, datastore and metadata
@@ -79,6 +95,67 @@ func AlreadyMounted(name string, mountRoot string) bool {
 	return false
 }
 
+// IsEphemeralMount - check if a mount source is an ephemeral volume
+func IsEphemeralMount(source string) bool {
+	return strings.Contains(source, "/"+EphemeralDir+"/")
+}
+
+// IsReadOnlyAccess - check if the access option of a volume needs a
+// read-only mount. read-only-many volumes may be attached to several VMs.
+func IsReadOnlyAccess(access interface{}) bool {
+	return access == accessReadOnly || access == accessReadOnlyMany
+}
+
+// IsReadOnlyManyAccess - check if the access option of a volume lets
+// several VMs attach it
+func IsReadOnlyManyAccess(access interface{}) bool {
+	return access == accessReadOnlyMany
+}
+
+// SetVolumeMoved - have GetVolumeInfo resolve oldName to newName, the full
+// name of the volume after a move. An empty newName forgets oldName.
+func SetVolumeMoved(oldName string, newName string) {
+	movedMtx.Lock()
+	defer movedMtx.Unlock()
+	if newName == "" {
+		delete(movedVolumes, oldName)
+		return
+	}
+	for name, moved := range movedVolumes {
+		if moved == oldName {
+			// moved again
+			movedVolumes[name] = newName
+		}
+	}
+	// moved back
+	delete(movedVolumes, newName)
+	if oldName != newName {
+		movedVolumes[oldName] = newName
+	}
+}
+
+// MovedVolumes - return a copy of the recorded moves, old name -> new name
+func MovedVolumes() map[string]string {
+	movedMtx.Lock()
+	defer movedMtx.Unlock()
+	moves := make(map[string]string, len(movedVolumes))
+	for name, moved := range movedVolumes {
+		moves[name] = moved
+	}
+	return moves
+}
+
+// MovedVolumeName - return the full name of a moved volume, name if it
+// wasn't moved
+func MovedVolumeName(name string) string {
+	movedMtx.Lock()
+	defer movedMtx.Unlock()
+	if moved, exists := movedVolumes[name]; exists {
+		return moved
+	}
+	return name
+}
+
 // JoinVolName - return a full name in format volume@datastore
 func JoinVolName(volName string, datastoreName string) string {
 	return strings.Join([]string{volName, datastoreName}, "@")
@@ -122,6 +199,9 @@ func GetNameFromRefmap(volName string, d drivers.VolumeDriver) string {
 // Optionally returns datastore and volume metadata if retrieved from ESX.
 // If Volume Metadata is nil then caller can use getVolume()
 func GetVolumeInfo(name string, datastoreName string, d drivers.VolumeDriver) (*VolumeInfo, error) {
+	// names Docker has for volumes moved to another datastore
+	name = MovedVolumeName(name)
+
 	// if fullname already, return
 	if IsFullVolName(name) {
 		return &VolumeInfo{name, "", nil}, nil
@@ -129,7 +209,8 @@ func GetVolumeInfo(name string, datastoreName string, d drivers.VolumeDriver) (*
 
 	// if datastore name is provided, append and return
 	if datastoreName != "" {
-		return &VolumeInfo{JoinVolName(name, datastoreName), datastoreName, nil}, nil
+		fullName := MovedVolumeName(JoinVolName(name, datastoreName))
+		return &VolumeInfo{fullName, SplitVolName(fullName)[1], nil}, nil
 	}
 
 	// find full volume names using refmap if possible
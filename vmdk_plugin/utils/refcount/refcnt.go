@@ -93,6 +93,7 @@ const (
 	dockerConnTimeoutSec    = 2
 	refCountDelayStartSec   = 2
 	refCountRetryAttempts   = 20
+	shortIDLen              = 12 // container IDs as shown by docker ps
 
 	photonDriver = "photon"
 )
@@ -157,6 +158,19 @@ func newRefCount() *refCount {
 	}
 }
 
+// InitCounts - sets the refcounts of volumes without discovering them
+// from Docker, and marks refcounting successful. Used by driver tests.
+func (r *RefCountsMap) InitCounts(counts map[string]uint) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for vol, count := range counts {
+		rc := newRefCount()
+		rc.count = count
+		r.refMap[vol] = rc
+	}
+	r.refcntInitSuccess = true
+}
+
 // return if refcount initialization has been successful
 func (r *RefCountsMap) GetInitSuccess() bool {
 	return r.refcntInitSuccess
@@ -250,6 +264,41 @@ func (r *RefCountsMap) calculate(d drivers.VolumeDriver, mountDir string, name s
 	return nil
 }
 
+// GetVolumeContainers returns the short IDs of the running, paused or
+// restarting containers using a volume, known to Docker under any of names
+func GetVolumeContainers(names ...string) ([]string, error) {
+	c, err := client.NewClient(DockerUSocket, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		return nil, err
+	}
+	filters := filters.NewArgs()
+	filters.Add("status", "running")
+	filters.Add("status", "paused")
+	filters.Add("status", "restarting")
+	for _, name := range names {
+		filters.Add("volume", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+	defer cancel()
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{
+		All:    true,
+		Filter: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, ct := range containers {
+		id := ct.ID
+		if len(id) > shortIDLen {
+			id = id[:shortIDLen]
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
 // Returns ref count for the volume.
 // If volume is not referred (not in the map), return 0
 func (r *RefCountsMap) GetCount(vol string) uint {
@@ -403,6 +452,10 @@ func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 			if isVMDKMount(mount.Source) != true {
 				continue
 			}
+			// ephemeral volumes are refcounted by the driver
+			if plugin_utils.IsEphemeralMount(mount.Source) {
+				continue
+			}
 
 			volumeInfo, err := plugin_utils.GetVolumeInfo(mount.Name, datastoreName, d)
 			if err != nil {
@@ -485,12 +538,7 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 						}
 					}
 
-					isReadOnly := false
-					if access, exists := status["access"]; exists {
-						if access == "read-only" {
-							isReadOnly = true
-						}
-					}
+					isReadOnly := plugin_utils.IsReadOnlyAccess(status["access"])
 					_, err = d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
 					if err != nil {
 						log.Warning("Failed to mount - manual recovery may be needed")